@@ -1,161 +1,747 @@
 package alderman
 
 import (
-	"crypto"
-    "crypto/x509"
+    "bytes"
     "crypto/ecdsa"
 	"github.com/tusharjois/councilfs/por"
     "github.com/tusharjois/councilfs/client"
+    "github.com/tusharjois/councilfs/ledger"
+    "encoding/hex"
     "encoding/json"
+    "errors"
     "fmt"
+    "sync"
     "time"
 )
 
-type Proof struct {
-	challenge []byte
-	proof []byte
+// Alderman holds the state of a single alderman: its key, its channels with
+// clients, the demerits it has recorded against other aldermen and the payment
+// timers of its channels. Other parties are identified by the fingerprint of
+// their public key, as computed by por.Fingerprint. An Alderman is safe for
+// concurrent use, and a process can run any number of them.
+type Alderman struct {
+	key *ecdsa.PrivateKey
+
+	mu       sync.Mutex
+	channels map[string]*client.PaymentChannel
+	demerits map[string]Reputation
+	policy   ReputationPolicy
+	evidence map[string][]FailureEvidence
+	council  *Council
+	ledger   ledger.Ledger
+	payments *PaymentScheduler
+	clock    Clock
+	store    *Store
+
+	// what the alderman asks for each shard a client downloads
+	shardPrice uint
+
+	// the shortest dispute window the alderman accepts a channel with
+	minDisputeWindow time.Duration
+
+	// challenges issued by the alderman that are awaiting an answer, and
+	// those already counted as answered or unanswered, keyed by hex digest
+	responseWindow time.Duration
+	outstanding    map[string]*Challenge
+	judged         map[string]bool
+}
+
+// New creates an Alderman with the given key, reading the time from clock. Its
+// state is held only in memory.
+func New(aldermanKey *ecdsa.PrivateKey, clock Clock) *Alderman {
+	return &Alderman{
+		key:      aldermanKey,
+		channels: make(map[string]*client.PaymentChannel),
+		demerits: make(map[string]Reputation),
+		policy:   DefaultReputationPolicy(),
+		evidence: make(map[string][]FailureEvidence),
+		payments: NewPaymentScheduler(aldermanKey, clock),
+		clock:    clock,
+
+		minDisputeWindow: client.DefaultDisputeWindow,
+
+		responseWindow: DefaultResponseWindow,
+		outstanding:    make(map[string]*Challenge),
+		judged:         make(map[string]bool),
+	}
+}
+
+// Open creates an Alderman whose state is persisted in the Store in dir,
+// recovering any state left there by a previous run.
+func Open(aldermanKey *ecdsa.PrivateKey, clock Clock, dir string) (*Alderman, error) {
+	store, state, records, err := OpenStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	a := New(aldermanKey, clock)
+	for id, channel := range state.Channels {
+		a.channels[id] = channel
+	}
+	for id, lastPaid := range state.Tracked {
+		if channel, ok := a.channels[id]; ok {
+			a.payments.trackAt(channel, time.Unix(0, lastPaid), state.StoragePaid[id])
+		}
+	}
+	for miner, rep := range state.Reputations {
+		a.demerits[miner] = rep
+	}
+	for miner, evidence := range state.Evidence {
+		a.evidence[miner] = evidence
+	}
+	for id := range state.Judged {
+		a.judged[id] = true
+	}
+	for _, rec := range records {
+		if err := a.apply(rec); err != nil {
+			store.Close()
+			return nil, fmt.Errorf("recovering record %v: %v", rec.Seq, err)
+		}
+	}
+	a.store = store
+	if err := a.snapshot(); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// apply replays a record of the write-ahead log.
+func (a *Alderman) apply(rec *record) error {
+	if rec.Type == recordAccept {
+		a.channels[channelKey(rec.Channel.GetID())] = rec.Channel
+		return nil
+	}
+	if rec.Type == recordDemerits {
+		a.demerits[rec.Miner] = *rec.Reputation
+		if rec.Evidence != nil {
+			a.evidence[rec.Miner] = append(a.evidence[rec.Miner], *rec.Evidence)
+		}
+		return nil
+	}
+	if rec.Type == recordJudged {
+		a.judged[rec.Challenge] = true
+		return nil
+	}
+	channel, ok := a.channels[channelKey(rec.ChannelID)]
+	if !ok {
+		return fmt.Errorf("channel %v does not exist", channelKey(rec.ChannelID))
+	}
+	switch rec.Type {
+	case recordMessage:
+		if err := channel.UpdateMessages(rec.Message); err != nil {
+			return err
+		}
+		if rec.Time != 0 {
+			a.payments.paid(rec.ChannelID, time.Unix(0, rec.Time))
+		}
+	case recordFunding:
+		if err := channel.UpdateMessages(rec.Message); err != nil {
+			return err
+		}
+		channel.FundingID = rec.FundingID
+		channel.FundingAmount = rec.Amount
+		a.payments.trackAt(channel, time.Unix(0, rec.Time), channel.StoragePaid())
+	case recordUntrack:
+		a.payments.Untrack(rec.ChannelID)
+	case recordShards:
+		channel.Encoding = rec.Encoding
+	default:
+		return fmt.Errorf("unknown record type %v", rec.Type)
+	}
+	return nil
+}
+
+// persist logs a record to the alderman's store, if it has one.
+func (a *Alderman) persist(rec *record) error {
+	if a.store == nil {
+		return nil
+	}
+	return a.store.Append(rec)
+}
+
+// persistMessage logs the message most recently added to channel. If it cannot
+// be logged, the message is removed again.
+func (a *Alderman) persistMessage(channel *client.PaymentChannel, rec *record) error {
+	rec.ChannelID = channel.GetID()
+	rec.Message = channel.GetMostRecent()
+	if err := a.persist(rec); err != nil {
+		channel.Messages = channel.Messages[:len(channel.Messages)-1]
+		return err
+	}
+	return nil
+}
+
+func (a *Alderman) snapshot() error {
+	state := &storedState{
+		Channels:    a.channels,
+		Tracked:     make(map[string]int64),
+		StoragePaid: make(map[string]uint),
+		Reputations: a.demerits,
+		Evidence:    a.evidence,
+		Judged:      a.judged,
+	}
+	lastPayments, storagePaid := a.payments.lastPayments()
+	for id, lastPaid := range lastPayments {
+		state.Tracked[id] = lastPaid.UnixNano()
+		state.StoragePaid[id] = storagePaid[id]
+	}
+	return a.store.WriteSnapshot(state)
+}
+
+// Snapshot writes the whole state of the alderman to its store and empties the
+// write-ahead log.
+func (a *Alderman) Snapshot() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.store == nil {
+		return nil
+	}
+	return a.snapshot()
 }
 
-// need data structure for alderman to keep track of demerits on exisitng alderman 
-// create a hash table from public key of miners to a demertit counter
-var OtherAlderman map[crypto.PublicKey]int = make(map[crypto.PublicKey]int)  
+// Close closes the store of the alderman.
+func (a *Alderman) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.store == nil {
+		return nil
+	}
+	return a.store.Close()
+}
+
+// PublicKey returns the public key of the alderman.
+func (a *Alderman) PublicKey() *ecdsa.PublicKey {
+	return &a.key.PublicKey
+}
+
+// Demerits returns the demerits the alderman currently holds against the
+// miner with the given key fingerprint, as judged by its reputation policy.
+func (a *Alderman) Demerits(fingerprint string) float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.policy.Demerits(a.demerits[fingerprint], a.clock())
+}
+
+// Reputation returns the reputation the alderman has recorded for the miner
+// with the given key fingerprint.
+func (a *Alderman) Reputation(fingerprint string) Reputation {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.demerits[fingerprint]
+}
+
+// SetReputationPolicy makes the alderman judge miners by policy from now on.
+// Reputations already recorded are kept, and judged by the new policy.
+func (a *Alderman) SetReputationPolicy(policy ReputationPolicy) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.policy = policy
+}
+
+// Channel returns the channel with the given ID, or nil if the alderman has
+// no such channel.
+func (a *Alderman) Channel(channelID []byte) *client.PaymentChannel {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.channels[channelKey(channelID)]
+}
 
-// Client Payment time counters
-var ClientPayment map[string]int64 = make(map[string]int64)
+// IssueChallenge creates a challenge from the alderman to the miner with
+// minerKey, asking for a ticket of k segments over dataset. The challenge is
+// stamped with the alderman's clock, and must be answered within the
+// alderman's response window; until then it is outstanding.
+func (a *Alderman) IssueChallenge(minerKey *ecdsa.PublicKey, dataset *por.EncodedDataset, k uint) *Challenge {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.clock()
+	challenge := NewChallenge(a.key, minerKey, dataset, k, now.Unix(), now.Add(a.responseWindow).Unix())
+	digest := challenge.Digest()
+	a.outstanding[hex.EncodeToString(digest[:])] = challenge
+	return challenge
+}
 
 // Can only be done by alderman to other alderman
 // only occurs if a wrong proof was submitted 
 // if the alderman refuses to respond, demerit and using BFT with other 
 // alderman decide if they should be kicked out or not
-// NOTE: this function does not protect against non availability 
+// NOTE: this function does not protect against non availability; see CheckDeadlines
+// and RecordTimeout for miners that do not answer at all
 
-func ProofofFailure(challenge []byte, proof_returned []byte, aldermanKey *ecdsa.PrivateKey) ([]byte, []byte) {
-    punishmentProof := new(Proof)
-    punishmentProof.challenge = challenge
-    punishmentProof.proof = proof_returned
+// ProofofFailure builds the evidence that the miner failed challenge with
+// response, and returns it marshaled along with the alderman's signature over
+// it. An error is returned if the response does not answer the challenge, or
+// if the miner did not fail it.
+func ProofofFailure(challenge *Challenge, response *TicketResponse, dataset *por.EncodedDataset,
+	aldermanKey *ecdsa.PrivateKey) ([]byte, []byte, error) {
+	evidence := &FailureEvidence{Challenge: *challenge, Response: *response, Hashes: dataset.Hashes()}
+	if err := evidence.Verify(); err != nil {
+		return nil, nil, err
+	}
+	proofOfFailure, err := json.Marshal(evidence)
+	if err != nil {
+		return nil, nil, err
+	}
+	sig := por.SignAndMarshal(aldermanKey, proofOfFailure)
+	return proofOfFailure, sig, nil
+}
 
-    proofOfFailure, err := json.Marshal(punishmentProof)
-    if err != nil {
-    	panic(err)
-    }
-    // sign this proof and attach to file
-    // NOTE : this is bad because there is no check that this was actually the challenge the proof was computed on right now
-    sig := por.SignAndMarshal(aldermanKey, proofOfFailure)
-    return proofOfFailure, sig
+
+// submitProof publishes a proof of failure of the miner with key miner to the
+// alderman's ledger, if it has one. The transaction is signed by the alderman.
+func (a *Alderman) submitProof(miner []byte, proof []byte) error {
+	a.mu.Lock()
+	l := a.ledger
+	a.mu.Unlock()
+	if l == nil {
+		return nil
+	}
+	_, err := l.Submit(ledger.NewTransaction(ledger.FailureProof, miner, json.RawMessage(proof), a.key))
+	return err
 }
 
+// FailureProofs returns the evidence, published to l, that the miner with key
+// miner failed its challenges. Proofs that do not verify are skipped.
+func FailureProofs(l ledger.Ledger, miner *ecdsa.PublicKey) ([]FailureEvidence, error) {
+	txs, err := l.References(marshalKey(miner))
+	if err != nil {
+		return nil, err
+	}
+	var proofs []FailureEvidence
+	for _, tx := range txs {
+		if tx.Kind != ledger.FailureProof {
+			continue
+		}
+		var evidence FailureEvidence
+		if json.Unmarshal(tx.Payload, &evidence) != nil || evidence.Verify() != nil {
+			continue
+		}
+		proofs = append(proofs, evidence)
+	}
+	return proofs, nil
+}
 
-// function stub to submit to blockchain
-func submitProof(proof []byte, aldermanSignature []byte) {
-    return
+// SetLedger makes the alderman publish its proofs of failure to l.
+func (a *Alderman) SetLedger(l ledger.Ledger) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ledger = l
 }
 
-func getMinerKey(ticket []byte) ecdsa.PublicKey {
-	ticketFromPOR := por.ParseTicket(ticket)
-    key, err := x509.ParsePKIXPublicKey(ticketFromPOR.PublicKey)
-    if err != nil {
-    	panic(err)
-    }
-    identifierKey, correctType := key.(*ecdsa.PublicKey)
-    if !correctType {
-    	panic(correctType)
-    }
-	return *identifierKey
+// checkForQuorum proposes to the council that the miner with key target be
+// ejected, once the alderman holds enough evidence against it. Miners that are
+// not aldermen have no seat to lose, so the proposal is only made for members
+// of the council. An error is returned if the proposal is rejected.
+func (a *Alderman) checkForQuorum(target []byte, evidence []FailureEvidence) error {
+	a.mu.Lock()
+	council := a.council
+	a.mu.Unlock()
+	if council == nil || len(evidence) < EjectionThreshold || !council.IsMember(por.FingerprintPKIX(target)) {
+		return nil
+	}
+	targetKey, err := parseKey(target)
+	if err != nil {
+		return err
+	}
+	if err := council.Propose(targetKey, evidence); err != nil {
+		return fmt.Errorf("ejection proposal rejected: %v", err)
+	}
+	return nil
 }
 
-// Decide whether or not an alderman should be "voted off the island" and whether or not 
-// a miner should be promoted to alderman
-func checkForQuorum() {
-	fmt.Println("Asked for a quorum check")
-	return
+// checkForPromotion proposes to the council that the miner with key candidate
+// be promoted to alderman, if it meets the admission rules and is not already
+// a member or up for promotion. An error is returned if the proposal is
+// rejected.
+func (a *Alderman) checkForPromotion(candidate []byte) error {
+	a.mu.Lock()
+	council := a.council
+	a.mu.Unlock()
+	if council == nil {
+		return nil
+	}
+	fingerprint := por.FingerprintPKIX(candidate)
+	if council.IsMember(fingerprint) || council.Pending(Promotion, fingerprint) ||
+		len(council.Members()) >= council.Registry().MaxSize ||
+		!council.Registry().Admits(council.Registry().Stats(fingerprint)) {
+		return nil
+	}
+	candidateKey, err := parseKey(candidate)
+	if err != nil {
+		return err
+	}
+	if err := council.ProposePromotion(candidateKey); err != nil {
+		return fmt.Errorf("promotion proposal rejected: %v", err)
+	}
+	return nil
 }
 
+// JoinCouncil makes the alderman a member of council, to which it proposes
+// the ejection of aldermen that fail its challenges and the promotion of
+// miners that pass them.
+func (a *Alderman) JoinCouncil(council *Council) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.council = council
+}
 
-// verify that a miner is storing the file F correctly. It is meant to be called
-// after the alderman/miner has issued genChallenge to another miner and recieved back a ticket
-func VerifyMiner(k uint, genChallenge []byte, ticket []byte, fileCheck *por.EncodedDataset, isAlderman bool, 
-	aldermanKey *ecdsa.PrivateKey, minerKey crypto.PublicKey) bool{
+// Evidence returns the evidence of the failed challenges the alderman has
+// recorded against the miner with fingerprint.
+func (a *Alderman) Evidence(fingerprint string) []FailureEvidence {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]FailureEvidence(nil), a.evidence[fingerprint]...)
+}
 
-    if por.VerifyPOR(fileCheck, genChallenge, ticket, k) {
-    	if getMinerKey(ticket) != minerKey {
-    		panic("Miner key for communication and miner key in ticket do not match")
+// VerifyMiner checks the response of a miner to a challenge over fileCheck,
+// and reports whether the ticket passed. If the response is signed by the
+// challenged miner but its ticket fails, and this is an alderman, the miner
+// receives a demerit, and a proof of failure is submitted if the alderman
+// issued the challenge, as the ledger takes it from no one else. A response
+// that does not answer the challenge is not evidence of anything, and is
+// rejected with an error and without a demerit; so is a response checked
+// against a dataset other than the challenged one, a response to a challenge
+// already judged, and a response that arrives after the deadline, which is
+// left to CheckDeadlines.
+// Passed and failed challenges are recorded in the registry of the alderman's
+// council, and a miner that meets its admission rules is proposed for
+// promotion. An error is also returned if the result cannot be recorded, if a
+// proposal it leads to is rejected, or if the proof of failure cannot be
+// submitted, in which case the demerit stands.
+func (a *Alderman) VerifyMiner(challenge *Challenge, response *TicketResponse, fileCheck *por.EncodedDataset,
+	isAlderman bool) (bool, error) {
+
+    if err := response.Verify(challenge); err != nil {
+    	return false, err
+    }
+    if !bytes.Equal(fileCheck.Root(), challenge.Root) {
+    	return false, errors.New("dataset is not the challenged one")
+    }
+    if err := a.answered(challenge); err != nil {
+    	return false, err
+    }
+    fault := por.CheckPOR(fileCheck.Hashes(), challenge.Value, response.Ticket, challenge.K)
+    passed := fault == nil
+    a.mu.Lock()
+    council := a.council
+    a.mu.Unlock()
+    if council != nil {
+    	council.Registry().RecordChallenge(por.FingerprintPKIX(challenge.Miner), passed)
+    }
+    if passed {
+    	if isAlderman {
+    		if err := a.recordPass(por.FingerprintPKIX(challenge.Miner)); err != nil {
+    			return true, err
+    		}
     	}
-    	return true
+    	return true, a.checkForPromotion(challenge.Miner)
     } else {
     	if isAlderman {
-    		proof, alderSig := ProofofFailure(genChallenge, ticket, aldermanKey)
-    		submitProof(proof, alderSig)
-    		keyFromTicket := getMinerKey(ticket)
-    		_, keyExists := OtherAlderman[keyFromTicket]
-    		if keyExists {
-                OtherAlderman[keyFromTicket] = OtherAlderman[keyFromTicket] + 1
-    		} else {
-                OtherAlderman[keyFromTicket] = 1
+    		// without a proof of failure the miner is judged on the alderman's
+    		// word alone
+    		var evidence *FailureEvidence
+    		var submitErr error
+    		if proof, _, err := ProofofFailure(challenge, response, fileCheck, a.key); err == nil {
+    			if por.FingerprintPKIX(challenge.Issuer) == por.Fingerprint(&a.key.PublicKey) {
+    				submitErr = a.submitProof(challenge.Miner, proof)
+    			}
+    			evidence = &FailureEvidence{Challenge: *challenge, Response: *response, Hashes: fileCheck.Hashes()}
+    		}
+    		if err := a.recordFailure(challenge.Miner, failureOf(fault), evidence); err != nil {
+    			return false, err
     		}
-    		// need to decide when the "acceptable amounts of demerits" pass a threshold in which the miners should vote in
-    		// I can easily see how you would do this if you had smart contract 
-    		if OtherAlderman[keyFromTicket] >= 3 {
-    			checkForQuorum();
+    		if submitErr != nil {
+    			return false, fmt.Errorf("proof of failure not submitted: %v", submitErr)
     		}
     	}
-    	return false
+    	return false, nil
     }
 }
 
-func AcceptChannel(aldermanKey *ecdsa.PrivateKey, clientMsg client.ChannelMessage) (*client.PaymentChannel, client.ChannelMessage) {
-     clientChannel := new(client.PaymentChannel)
-     _, payload, err := clientMsg.GetPayload()
-     if err != nil {
-        panic(err)
-     }
-     msg := json.RawMessage(payload)
-
-     err = json.Unmarshal(msg, &clientChannel)
-     if err != nil {
-     	panic(err)
-     }
-     // store this somewhere please 
-     channelPaymentID := append(clientMsg.GetSenderKey(), clientMsg.GetID()...)
-     
-     //channelPaymentID := append(clientMsg.GetSenderKey(), clientChannel.GetID()...)
-     _, ok := ClientPayment[string(channelPaymentID)];
-     if ok {
-     	// the channel already exists -- don't respond to the client but add it to messages?
-     	panic("Channel already exists")
-     } 
-     
-     addMsg := new(client.ChannelMessage)
-     *addMsg = clientMsg
-     clientChannel.UpdateMessages(addMsg)
-     sendNewMsg := client.NewMessage(client.ChannelAccepted, clientChannel, addMsg.GetID(), aldermanKey, addMsg)
-     clientChannel.UpdateMessages(sendNewMsg)
-
-     return clientChannel, *sendNewMsg
-}
-
-// function runs on channel and checks for a funds transfer
-// isn't this tied to a blockchain? what do you need to do specifically
-// for 
-func CheckPayment(channel *client.PaymentChannel, minerKey *ecdsa.PrivateKey, timeCurrent int64) *client.ChannelMessage {
-	// TODO do check to see if a client has paid yet 
-    mostRecentMsg := channel.GetMostRecent()
-	// if channelID dictionary is empty or nil then a client has no
-	// outstanding payment due, otherwise 
-	channelPaymentID := append(mostRecentMsg.GetSenderKey(), channel.GetID()...)
-    if startTime, ok := ClientPayment[string(channelPaymentID)]; ok {
-    	unixCurrentTime := time.Unix(timeCurrent, int64(0))
-    	if unixCurrentTime.Sub(time.Unix(startTime, int64(0))) > channel.GetInterval() {
-    		// close payment channel
-            closeMessage := client.NewMessage(client.CloseChannel, make([]byte, 0), channel.GetID(),
-        		minerKey, mostRecentMsg)
-            //channel.UpdateMessages(closeMessage)
-        	return closeMessage
-    	}
-    }
-    // in a main loop for the payment channel, reset ClientPayment whenever a payment
-    // is received and have the alderman iterate through the ClientPayment dictionary checking for payment 
-    // and closing out channels appropriately
-    return nil 
+// recordPass updates the reputation of the miner with fingerprint after it
+// passed a challenge. Miners without demerits or a streak to keep are left
+// alone, so passing challenges costs nothing to log. An error is returned if
+// the update cannot be logged, and the reputation is then left as it was.
+func (a *Alderman) recordPass(minerID string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rep, ok := a.demerits[minerID]
+	if !ok {
+		return nil
+	}
+	rep = a.policy.Pass(rep, a.clock())
+	if err := a.persist(&record{Type: recordDemerits, Miner: minerID, Reputation: &rep}); err != nil {
+		return err
+	}
+	a.demerits[minerID] = rep
+	return nil
+}
+
+// recordFailure updates the reputation of the miner with key miner after it
+// failed a challenge, keeping the evidence of the failure if there is any, and
+// proposes its ejection if the alderman's policy calls for it. An error is
+// returned if the update cannot be logged, and nothing is changed, or if the
+// ejection is proposed but rejected.
+func (a *Alderman) recordFailure(miner []byte, failure Failure, evidence *FailureEvidence) error {
+	minerID := por.FingerprintPKIX(miner)
+	a.mu.Lock()
+	now := a.clock()
+	rep := a.policy.Fail(a.demerits[minerID], failure, now)
+	if err := a.persist(&record{Type: recordDemerits, Miner: minerID, Reputation: &rep, Evidence: evidence}); err != nil {
+		a.mu.Unlock()
+		return err
+	}
+	a.demerits[minerID] = rep
+	if evidence != nil {
+		a.evidence[minerID] = append(a.evidence[minerID], *evidence)
+	}
+	eject := a.policy.Eject(rep, now)
+	collected := append([]FailureEvidence(nil), a.evidence[minerID]...)
+	a.mu.Unlock()
+	// the council still needs EjectionThreshold pieces of evidence, whatever
+	// the policy of this alderman
+	if eject {
+		return a.checkForQuorum(miner, collected)
+	}
+	return nil
+}
+
+// AcceptChannel accepts a channel opened by a client with a ChannelOpen
+// message, and returns the alderman's view of the channel along with the
+// ChannelAccepted message to send back. An error is returned if the message
+// does not open a valid channel, its dispute window is shorter than the
+// alderman's minimum, or the channel already exists. Any funding the client
+// claims in the message is ignored until it is checked on the ledger.
+func (a *Alderman) AcceptChannel(clientMsg client.ChannelMessage) (*client.PaymentChannel, client.ChannelMessage, error) {
+	clientChannel := new(client.PaymentChannel)
+	msgType, payload, err := clientMsg.GetPayload()
+	if err != nil {
+		return nil, client.ChannelMessage{}, err
+	}
+	if msgType != client.ChannelOpen {
+		return nil, client.ChannelMessage{}, fmt.Errorf("cannot accept channel from %v message", msgType)
+	}
+	if err := json.Unmarshal(payload, clientChannel); err != nil {
+		return nil, client.ChannelMessage{}, err
+	}
+	clientChannel.FundingID = nil
+	clientChannel.FundingAmount = 0
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if clientChannel.DisputeWindow < a.minDisputeWindow {
+		return nil, client.ChannelMessage{}, fmt.Errorf("dispute window of %v is shorter than %v",
+			clientChannel.DisputeWindow, a.minDisputeWindow)
+	}
+	id := channelKey(clientMsg.GetID())
+	if _, ok := a.channels[id]; ok {
+		// the channel already exists -- don't respond to the client
+		return nil, client.ChannelMessage{}, fmt.Errorf("channel %v already exists", id)
+	}
+
+	addMsg := new(client.ChannelMessage)
+	*addMsg = clientMsg
+	if err := clientChannel.UpdateMessages(addMsg); err != nil {
+		return nil, client.ChannelMessage{}, err
+	}
+	sendNewMsg := client.NewMessage(client.ChannelAccepted, clientChannel, addMsg.GetID(), a.key, addMsg)
+	if err := clientChannel.UpdateMessages(sendNewMsg); err != nil {
+		return nil, client.ChannelMessage{}, err
+	}
+	if err := a.persist(&record{Type: recordAccept, Channel: clientChannel}); err != nil {
+		return nil, client.ChannelMessage{}, err
+	}
+	a.channels[id] = clientChannel
+
+	return clientChannel, *sendNewMsg, nil
+}
+
+// Receive adds a message from a client to its channel. Payments on a funded
+// channel that complete a Payment for storage reset the channel's payment
+// timer.
+func (a *Alderman) Receive(msg *client.ChannelMessage) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	channel, ok := a.channels[channelKey(msg.GetID())]
+	if !ok {
+		return fmt.Errorf("channel %v does not exist", channelKey(msg.GetID()))
+	}
+	if err := channel.UpdateMessages(msg); err != nil {
+		return err
+	}
+	rec := &record{Type: recordMessage}
+	var now time.Time
+	if msgType, _, _ := msg.GetPayload(); msgType == client.SendPayment {
+		now = a.clock()
+		rec.Time = now.UnixNano()
+	}
+	if err := a.persistMessage(channel, rec); err != nil {
+		return err
+	}
+	if rec.Time != 0 {
+		a.payments.paid(msg.GetID(), now)
+	}
+	return nil
+}
+
+// ApproveFunding is called by the alderman after receiving the client's
+// FundsCreated message. It checks the funding transaction on the ledger and,
+// if it covers the channel's payment, returns the FundsApproved message that
+// makes the channel usable for PORs and payments. From then on the client's
+// payments on the channel are due every Interval.
+func (a *Alderman) ApproveFunding(channelID []byte, l ledger.Ledger) (client.ChannelMessage, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	channel, ok := a.channels[channelKey(channelID)]
+	if !ok {
+		return client.ChannelMessage{}, fmt.Errorf("channel %v does not exist", channelKey(channelID))
+	}
+	approval, err := ApproveFunding(a.key, channel, l)
+	if err != nil {
+		return client.ChannelMessage{}, err
+	}
+	now := a.clock()
+	rec := &record{Type: recordFunding, FundingID: channel.FundingID, Amount: channel.FundingAmount, Time: now.UnixNano()}
+	if err := a.persistMessage(channel, rec); err != nil {
+		channel.FundingID = nil
+		channel.FundingAmount = 0
+		return client.ChannelMessage{}, err
+	}
+	a.payments.trackAt(channel, now, channel.StoragePaid())
+	return approval, nil
+}
+
+// RespondToPOR answers the PORRequest most recently received on a channel.
+func (a *Alderman) RespondToPOR(channelID []byte, k uint) (client.ChannelMessage, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	channel, ok := a.channels[channelKey(channelID)]
+	if !ok {
+		return client.ChannelMessage{}, fmt.Errorf("channel %v does not exist", channelKey(channelID))
+	}
+	response, err := channel.RespondToPOR(a.key, k)
+	if err != nil {
+		return client.ChannelMessage{}, err
+	}
+	if err := a.persistMessage(channel, &record{Type: recordMessage}); err != nil {
+		return client.ChannelMessage{}, err
+	}
+	return response, nil
+}
+
+// SetShardPrice sets what the alderman asks for each shard a client
+// downloads. Shards are free until it is set.
+func (a *Alderman) SetShardPrice(price uint) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.shardPrice = price
+}
+
+// SetMinDisputeWindow sets the shortest dispute window the alderman accepts
+// new channels with. It is client.DefaultDisputeWindow until it is set.
+func (a *Alderman) SetMinDisputeWindow(window time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.minDisputeWindow = window
+}
+
+// SendShards answers the ShardRequest most recently received on a channel
+// with the requested shards the alderman holds for it, at the alderman's
+// price. An error is returned if the client has not paid for the shards
+// already sent.
+func (a *Alderman) SendShards(channelID []byte) (client.ChannelMessage, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	channel, ok := a.channels[channelKey(channelID)]
+	if !ok {
+		return client.ChannelMessage{}, fmt.Errorf("channel %v does not exist", channelKey(channelID))
+	}
+	response, err := channel.SendShards(a.key, a.shardPrice)
+	if err != nil {
+		return client.ChannelMessage{}, err
+	}
+	if err := a.persistMessage(channel, &record{Type: recordMessage}); err != nil {
+		return client.ChannelMessage{}, err
+	}
+	return response, nil
+}
+
+// StoreShards records the shards the alderman holds for a channel.
+func (a *Alderman) StoreShards(channelID []byte, encoding *por.EncodedDataset) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	channel, ok := a.channels[channelKey(channelID)]
+	if !ok {
+		return fmt.Errorf("channel %v does not exist", channelKey(channelID))
+	}
+	if err := a.persist(&record{Type: recordShards, ChannelID: channelID, Encoding: encoding}); err != nil {
+		return err
+	}
+	channel.Encoding = encoding
+	return nil
+}
+
+// ApproveFunding checks the funding transaction named in the most recent
+// FundsCreated message of channel and, if it covers the channel's payment,
+// adds the FundsApproved message to the channel and returns it.
+func ApproveFunding(aldermanKey *ecdsa.PrivateKey, channel *client.PaymentChannel, l ledger.Ledger) (client.ChannelMessage, error) {
+	txID, amount, err := channel.CheckFunding(l)
+	if err != nil {
+		return client.ChannelMessage{}, err
+	}
+	approval := client.NewMessage(client.FundsApproved, txID, channel.GetID(), aldermanKey, channel.GetMostRecent())
+	if err := channel.UpdateMessages(approval); err != nil {
+		return client.ChannelMessage{}, err
+	}
+	channel.FundingID = txID
+	channel.FundingAmount = amount
+	return *approval, nil
+}
+
+// CheckPayments closes every channel of the alderman whose client has not paid
+// within the channel's Interval, and returns the CloseChannel messages to send
+// to the clients. An error is returned if a close cannot be persisted.
+func (a *Alderman) CheckPayments() ([]client.ChannelMessage, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var closes []client.ChannelMessage
+	for _, channel := range a.payments.due() {
+		closeMessage, err := a.closeChannel(channel)
+		if err != nil {
+			return closes, err
+		}
+		closes = append(closes, closeMessage)
+	}
+	return closes, nil
+}
+
+// CloseChannel closes a channel of the alderman, either proposing the final
+// balance or countersigning the client's proposal, and returns the
+// CloseChannel message to send to the client.
+func (a *Alderman) CloseChannel(channelID []byte) (client.ChannelMessage, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	channel, ok := a.channels[channelKey(channelID)]
+	if !ok {
+		return client.ChannelMessage{}, fmt.Errorf("channel %v does not exist", channelKey(channelID))
+	}
+	return a.closeChannel(channel)
+}
+
+// closeChannel adds the alderman's CloseChannel message to channel and stops
+// its payment timer.
+func (a *Alderman) closeChannel(channel *client.PaymentChannel) (client.ChannelMessage, error) {
+	closeMessage, err := channel.Close(a.key)
+	if err != nil {
+		return client.ChannelMessage{}, err
+	}
+	if err := a.persistMessage(channel, &record{Type: recordMessage}); err != nil {
+		return client.ChannelMessage{}, err
+	}
+	if err := a.persist(&record{Type: recordUntrack, ChannelID: channel.GetID()}); err != nil {
+		return client.ChannelMessage{}, err
+	}
+	a.payments.Untrack(channel.GetID())
+	return closeMessage, nil
 }
 
 // DownloadFile is called when a client requests from an alderman a EncodedDataset
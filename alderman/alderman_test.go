@@ -1,17 +1,36 @@
 package alderman
 
 import (
+    "bytes"
+    "crypto/ecdsa"
+    "encoding/json"
     "testing"
+    "time"
     "github.com/tusharjois/councilfs/client"
+    "github.com/tusharjois/councilfs/ledger"
     "github.com/tusharjois/councilfs/por"
     "reflect"
 )
 
 func NetworkFunctionality(pay *client.PaymentChannel, addMsg client.ChannelMessage) {
-    giveToClient := new(client.ChannelMessage)
-    *giveToClient = addMsg
-    // maybe this will work I don't know 
-    pay.UpdateMessages(giveToClient)
+    // send the message through its wire encoding
+    giveToClient, err := client.ParseMessage(addMsg.Marshal())
+    if err != nil {
+        panic(err)
+    }
+    if err := pay.UpdateMessages(giveToClient); err != nil {
+        panic(err)
+    }
+}
+
+func SendToAlderman(alder *Alderman, addMsg client.ChannelMessage) {
+    giveToAlderman, err := client.ParseMessage(addMsg.Marshal())
+    if err != nil {
+        panic(err)
+    }
+    if err := alder.Receive(giveToAlderman); err != nil {
+        panic(err)
+    }
 }
 
 func TestClientAldermanInteraction(test *testing.T) {
@@ -41,20 +60,62 @@ func TestClientAldermanInteraction(test *testing.T) {
     */
 	clientchannel, firstCMsg, encoding := client.OpenChannel(clientKey, &aldermanPublic, 20, 10, aldermanPiece)
 
-    alderchannel, firstAMsg := AcceptChannel(aldermanKey, firstCMsg)
+    alder := New(aldermanKey, time.Now)
+    alderchannel, firstAMsg, err := alder.AcceptChannel(firstCMsg)
+    if err != nil {
+        test.Fatal(err)
+    }
+    if _, _, err := alder.AcceptChannel(firstCMsg); err == nil {
+        test.Errorf("channel accepted twice")
+    }
+    memLedger := ledger.NewMemory()
 
     alderchannel.Encoding = &encoding
     // do a simple walkthrough of the protocol 
     // have client send a POR request
     NetworkFunctionality(clientchannel, firstAMsg)
 
-    secondCMsg := clientchannel.RequestPOR(clientKey, k)
-    NetworkFunctionality(alderchannel, secondCMsg)
+    // the channel cannot be used before it is funded
+    if _, err := clientchannel.RequestPOR(clientKey, k); err == nil {
+        test.Errorf("POR requested on a channel that is not funded")
+    }
+    fundsCMsg, err := clientchannel.CreateFunding(clientKey, memLedger, 100)
+    if err != nil {
+        test.Fatal(err)
+    }
+    SendToAlderman(alder, fundsCMsg)
+    fundsAMsg, err := alder.ApproveFunding(alderchannel.GetID(), memLedger)
+    if err != nil {
+        test.Fatal(err)
+    }
+    NetworkFunctionality(clientchannel, fundsAMsg)
+
+    secondCMsg, err := clientchannel.RequestPOR(clientKey, k)
+    if err != nil {
+        test.Fatal(err)
+    }
+    SendToAlderman(alder, secondCMsg)
 
-    secondAMsg := alderchannel.RespondToPOR(aldermanKey, k)
+    secondAMsg, err := alder.RespondToPOR(alderchannel.GetID(), k)
+    if err != nil {
+        test.Fatal(err)
+    }
     NetworkFunctionality(clientchannel, secondAMsg)
-    thirdCMsg := clientchannel.VerifyPOR(clientKey, k)
-    NetworkFunctionality(alderchannel, thirdCMsg)
+    thirdCMsg, err := clientchannel.VerifyPOR(clientKey, k)
+    if err != nil {
+        test.Fatal(err)
+    }
+    SendToAlderman(alder, thirdCMsg)
+
+    if state, err := alderchannel.State(); err != nil || state != client.StateActive {
+        test.Errorf("channel in state %v after payment, expected %v", state, client.StateActive)
+    }
+    if err := alderchannel.Validate(); err != nil {
+        test.Error(err)
+    }
+    if paid, remaining := alderchannel.Balance(); paid != 20 || remaining != 80 {
+        test.Errorf("alderman sees %v paid and %v remaining, expected 20 and 80", paid, remaining)
+    }
 
     // make sure the communication channels have correct values
     // make sure they agree
@@ -77,4 +138,395 @@ func TestClientAldermanInteraction(test *testing.T) {
     alderchannel.DebugPrint()
     clientchannel.DebugPrint()
     return
-}
\ No newline at end of file
+}
+func TestApproveFunding(test *testing.T) {
+    encodedFile, err := por.CreateErasureCoding([]byte("Left Munich at 8:35 P. M., on 1st May"), 2, 4)
+    if err != nil {
+        test.Fatal(err)
+    }
+    clientKey := por.GenerateKey()
+    aldermanKey := por.GenerateKey()
+    memLedger := ledger.NewMemory()
+
+    clientchannel, firstCMsg, _ := client.OpenChannel(clientKey, &aldermanKey.PublicKey, 20, 10, encodedFile)
+    alder := New(aldermanKey, time.Now)
+    alderchannel, firstAMsg, err := alder.AcceptChannel(firstCMsg)
+    if err != nil {
+        test.Fatal(err)
+    }
+    NetworkFunctionality(clientchannel, firstAMsg)
+
+    // a funding transaction for less than the payment is never created
+    if _, err := clientchannel.CreateFunding(clientKey, memLedger, 10); err == nil {
+        test.Errorf("funding created for less than the channel payment")
+    }
+
+    // a funding transaction that is not on the ledger is not approved
+    fundsCMsg, err := clientchannel.CreateFunding(clientKey, ledger.NewMemory(), 20)
+    if err != nil {
+        test.Fatal(err)
+    }
+    SendToAlderman(alder, fundsCMsg)
+    if _, err := alder.ApproveFunding(alderchannel.GetID(), memLedger); err == nil {
+        test.Errorf("funding approved without a transaction on the ledger")
+    }
+    if state, _ := alderchannel.State(); state != client.StateFunded {
+        test.Errorf("channel in state %v, expected %v", state, client.StateFunded)
+    }
+}
+
+func TestAcceptChannelTerms(test *testing.T) {
+    encodedFile, err := por.CreateErasureCoding([]byte("Left Munich at 8:35 P. M., on 1st May"), 2, 4)
+    if err != nil {
+        test.Fatal(err)
+    }
+    clientKey := por.GenerateKey()
+    aldermanKey := por.GenerateKey()
+    alder := New(aldermanKey, time.Now)
+
+    // the client picks the terms of its ChannelOpen message
+    clientchannel, _, _ := client.OpenChannel(clientKey, &aldermanKey.PublicKey, 20, 10, encodedFile)
+    terms := *clientchannel
+    terms.Messages = nil
+    terms.DisputeWindow = time.Minute
+    terms.FundingID = []byte("not a funding transaction")
+    terms.FundingAmount = 1000
+    openMsg := client.NewMessage(client.ChannelOpen, &terms, terms.ChannelID, clientKey, nil)
+
+    if _, _, err := alder.AcceptChannel(*openMsg); err == nil {
+        test.Errorf("channel accepted with a dispute window shorter than the minimum")
+    }
+    alder.SetMinDisputeWindow(time.Minute)
+    alderchannel, _, err := alder.AcceptChannel(*openMsg)
+    if err != nil {
+        test.Fatal(err)
+    }
+    if alderchannel.FundingID != nil || alderchannel.FundingAmount != 0 {
+        test.Errorf("channel accepted with funding %x of %v claimed by the client",
+            alderchannel.FundingID, alderchannel.FundingAmount)
+    }
+}
+
+// openFundedChannel opens and funds a channel between a new client and the
+// alderman, returning the client's view of the channel and key.
+func openFundedChannel(test *testing.T, alder *Alderman, interval time.Duration) (*client.PaymentChannel, *ecdsa.PrivateKey) {
+    encodedFile, err := por.CreateErasureCoding([]byte("Left Munich at 8:35 P. M., on 1st May"), 2, 4)
+    if err != nil {
+        test.Fatal(err)
+    }
+    clientKey := por.GenerateKey()
+    memLedger := ledger.NewMemory()
+
+    clientchannel, firstCMsg, _ := client.OpenChannel(clientKey, alder.PublicKey(), 20, interval, encodedFile)
+    _, firstAMsg, err := alder.AcceptChannel(firstCMsg)
+    if err != nil {
+        test.Fatal(err)
+    }
+    NetworkFunctionality(clientchannel, firstAMsg)
+    fundsCMsg, err := clientchannel.CreateFunding(clientKey, memLedger, 100)
+    if err != nil {
+        test.Fatal(err)
+    }
+    SendToAlderman(alder, fundsCMsg)
+    fundsAMsg, err := alder.ApproveFunding(clientchannel.GetID(), memLedger)
+    if err != nil {
+        test.Fatal(err)
+    }
+    NetworkFunctionality(clientchannel, fundsAMsg)
+    return clientchannel, clientKey
+}
+
+func TestPaymentScheduler(test *testing.T) {
+    now := time.Unix(1000, 0)
+    alder := New(por.GenerateKey(), func() time.Time { return now })
+    clientchannel, clientKey := openFundedChannel(test, alder, time.Minute)
+    scheduler := NewPaymentScheduler(alder.key, func() time.Time { return now })
+    alderchannel := alder.Channel(clientchannel.GetID())
+    if err := scheduler.Track(alderchannel); err != nil {
+        test.Fatal(err)
+    }
+    if err := scheduler.Track(alderchannel); err == nil {
+        test.Errorf("channel tracked twice")
+    }
+
+    // a payment within the interval resets the timer
+    now = now.Add(50 * time.Second)
+    if closes, err := scheduler.Check(); err != nil || len(closes) != 0 {
+        test.Errorf("channel closed before its payment was due")
+    }
+    payment, err := clientchannel.SendPayment(clientKey, 20)
+    if err != nil {
+        test.Fatal(err)
+    }
+    if err := scheduler.Receive(&payment); err != nil {
+        test.Fatal(err)
+    }
+    now = now.Add(50 * time.Second)
+    if closes, err := scheduler.Check(); err != nil || len(closes) != 0 {
+        test.Errorf("channel closed although the client paid")
+    }
+
+    // a scheduler that cannot close the lapsed channel keeps tracking it
+    lapsed := false
+    impostor := NewPaymentScheduler(por.GenerateKey(), func() time.Time {
+        if lapsed {
+            return now.Add(time.Hour)
+        }
+        return now
+    })
+    if err := impostor.Track(alderchannel); err != nil {
+        test.Fatal(err)
+    }
+    lapsed = true
+    if closes, err := impostor.Check(); err == nil || len(closes) != 0 {
+        test.Errorf("close with the wrong key was not reported")
+    }
+    if impostor.Tracked() != 1 {
+        test.Errorf("channel that failed to close is no longer tracked")
+    }
+
+    // once the payment lapses, the channel is closed through Run
+    now = now.Add(20 * time.Second)
+    ticks := make(chan time.Time, 1)
+    ticks <- now
+    close(ticks)
+    var sent []client.ChannelMessage
+    scheduler.Run(ticks, func(msg client.ChannelMessage) { sent = append(sent, msg) }, func(err error) { test.Error(err) })
+    if len(sent) != 1 {
+        test.Fatalf("expected one CloseChannel message, got %v", len(sent))
+    }
+    if msgType, _, err := sent[0].GetPayload(); err != nil || msgType != client.CloseChannel {
+        test.Errorf("scheduler sent %v, expected %v", msgType, client.CloseChannel)
+    }
+    NetworkFunctionality(clientchannel, sent[0])
+    if state, _ := clientchannel.State(); state != client.StateClosing {
+        test.Errorf("client channel in state %v, expected %v", state, client.StateClosing)
+    }
+    if scheduler.Tracked() != 0 {
+        test.Errorf("closed channel is still tracked")
+    }
+}
+
+func TestPaymentSchedulerStorage(test *testing.T) {
+    now := time.Unix(1000, 0)
+    alder := New(por.GenerateKey(), func() time.Time { return now })
+    alder.SetShardPrice(20)
+    encodedFile, err := por.CreateErasureCoding([]byte("Left Munich at 8:35 P. M., on 1st May"), 2, 4)
+    if err != nil {
+        test.Fatal(err)
+    }
+    retriever, retrieverKey := openFundedChannel(test, alder, time.Minute)
+    if err := alder.StoreShards(retriever.GetID(), encodedFile); err != nil {
+        test.Fatal(err)
+    }
+    saver, saverKey := openFundedChannel(test, alder, time.Minute)
+    pay := func(channel *client.PaymentChannel, key *ecdsa.PrivateKey, amount uint) {
+        payment, err := channel.SendPayment(key, amount)
+        if err != nil {
+            test.Fatal(err)
+        }
+        SendToAlderman(alder, payment)
+    }
+
+    // paying for a shard does not pay for storage
+    now = now.Add(30 * time.Second)
+    request, err := retriever.RequestShards(retrieverKey, []int{0})
+    if err != nil {
+        test.Fatal(err)
+    }
+    SendToAlderman(alder, request)
+    response, err := alder.SendShards(retriever.GetID())
+    if err != nil {
+        test.Fatal(err)
+    }
+    NetworkFunctionality(retriever, response)
+    pay(retriever, retrieverKey, 20)
+
+    // neither does half a payment, until the other half arrives
+    pay(saver, saverKey, 10)
+    now = now.Add(20 * time.Second)
+    pay(retriever, retrieverKey, 10)
+    pay(saver, saverKey, 10)
+
+    now = now.Add(20 * time.Second)
+    closes, err := alder.CheckPayments()
+    if err != nil {
+        test.Fatal(err)
+    }
+    if len(closes) != 1 || !bytes.Equal(closes[0].GetID(), retriever.GetID()) {
+        test.Errorf("%v channels closed, expected only the one that paid for a shard", len(closes))
+    }
+}
+
+func TestPaymentSchedulerRace(test *testing.T) {
+    now := time.Unix(1000, 0)
+    alder := New(por.GenerateKey(), func() time.Time { return now })
+    clientchannel, clientKey := openFundedChannel(test, alder, time.Minute)
+    scheduler := NewPaymentScheduler(alder.key, func() time.Time { return now })
+    if err := scheduler.Track(alder.Channel(clientchannel.GetID())); err != nil {
+        test.Fatal(err)
+    }
+    now = now.Add(2 * time.Minute)
+
+    // a late payment races the close of the lapsed channel: either the
+    // payment lands and the channel stays open, or the channel is closed and
+    // the payment refused
+    payment, err := clientchannel.SendPayment(clientKey, 20)
+    if err != nil {
+        test.Fatal(err)
+    }
+    received := make(chan error)
+    go func() { received <- scheduler.Receive(&payment) }()
+    closes, closeErr := scheduler.Check()
+    if closeErr != nil {
+        test.Fatal(closeErr)
+    }
+    err = <-received
+    if (len(closes) == 1) == (err == nil) {
+        test.Errorf("%v closes with the payment refused by %v", len(closes), err)
+    }
+}
+
+func TestMultipleAldermen(test *testing.T) {
+    now := time.Unix(1000, 0)
+    clock := func() time.Time { return now }
+    first := New(por.GenerateKey(), clock)
+    second := New(por.GenerateKey(), clock)
+
+    // each alderman holds its own channels and payment timers
+    firstChannel, firstClientKey := openFundedChannel(test, first, time.Minute)
+    secondChannel, _ := openFundedChannel(test, second, 2*time.Minute)
+    if first.Channel(secondChannel.GetID()) != nil || second.Channel(firstChannel.GetID()) != nil {
+        test.Errorf("aldermen share channels")
+    }
+    now = now.Add(90 * time.Second)
+    if closes, err := first.CheckPayments(); err != nil || len(closes) != 1 {
+        test.Errorf("first alderman closed %v channels, expected 1", len(closes))
+    }
+    if closes, err := second.CheckPayments(); err != nil || len(closes) != 0 {
+        test.Errorf("second alderman closed %v channels, expected 0", len(closes))
+    }
+
+    // demerits are keyed by fingerprint and kept per alderman
+    encodedFile, err := por.CreateErasureCoding([]byte("Left Munich at 8:35 P. M., on 1st May"), 2, 4)
+    if err != nil {
+        test.Fatal(err)
+    }
+    minerKey := firstClientKey.PublicKey
+    challenge := first.IssueChallenge(&minerKey, encodedFile, 2)
+    response := RespondToChallenge(firstClientKey, challenge, encodedFile)
+    if passed, err := first.VerifyMiner(challenge, response, encodedFile, true); err != nil || !passed {
+        test.Errorf("correct ticket failed to verify")
+    }
+    response = forgeResponse(firstClientKey, challenge, encodedFile)
+    if _, err := first.VerifyMiner(challenge, response, encodedFile, true); err == nil {
+        test.Errorf("challenge judged twice")
+    }
+    minerID := por.Fingerprint(&minerKey)
+    if first.Demerits(minerID) != 0 {
+        test.Errorf("miner has %v demerits for a challenge it passed, expected 0", first.Demerits(minerID))
+    }
+    challenge = first.IssueChallenge(&minerKey, encodedFile, 2)
+    response = forgeResponse(firstClientKey, challenge, encodedFile)
+    if passed, err := first.VerifyMiner(challenge, response, encodedFile, true); err != nil || passed {
+        test.Errorf("incorrect ticket verified")
+    }
+
+    // a ticket checked against another dataset proves nothing
+    otherFile, err := por.CreateErasureCoding([]byte("arriving at Vienna early next morning"), 2, 4)
+    if err != nil {
+        test.Fatal(err)
+    }
+    response = RespondToChallenge(firstClientKey, challenge, encodedFile)
+    if _, err := first.VerifyMiner(challenge, response, otherFile, true); err == nil {
+        test.Errorf("ticket verified against another dataset")
+    }
+    if first.Demerits(minerID) != 1 || second.Demerits(minerID) != 0 {
+        test.Errorf("demerits are %v and %v, expected 1 and 0", first.Demerits(minerID), second.Demerits(minerID))
+    }
+}
+
+// forgeResponse answers challenge with a ticket whose segments carry each
+// other's signatures, signed by the miner so that the failure is provable.
+func forgeResponse(minerKey *ecdsa.PrivateKey, challenge *Challenge, dataset *por.EncodedDataset) *TicketResponse {
+    forged := por.ParseTicket(RespondToChallenge(minerKey, challenge, dataset).Ticket)
+    forged.ProofFiles[0].Signature = forged.ProofFiles[1].Signature
+    return NewTicketResponse(minerKey, challenge, por.TicketMarshal(*forged))
+}
+
+func TestFailureEvidence(test *testing.T) {
+    now := time.Unix(1000, 0)
+    alder := New(por.GenerateKey(), func() time.Time { return now })
+    minerKey := por.GenerateKey()
+    encodedFile, err := por.CreateErasureCoding([]byte("Bistritz.--Left Munich at 8:35 P. M."), 2, 4)
+    if err != nil {
+        test.Fatal(err)
+    }
+    challenge := alder.IssueChallenge(&minerKey.PublicKey, encodedFile, 2)
+    if err := challenge.Verify(); err != nil {
+        test.Fatalf("challenge failed to verify: %v", err)
+    }
+
+    // a correct response is not a failure
+    response := RespondToChallenge(minerKey, challenge, encodedFile)
+    if _, _, err := ProofofFailure(challenge, response, encodedFile, alder.key); err == nil {
+        test.Errorf("built proof of failure for a correct response")
+    }
+
+    // a failed response yields evidence that a third party can check
+    forged := forgeResponse(minerKey, challenge, encodedFile)
+    proof, sig, err := ProofofFailure(challenge, forged, encodedFile, alder.key)
+    if err != nil {
+        test.Fatal(err)
+    }
+    if !por.VerifyAndUnMarshal(alder.PublicKey(), proof, sig) {
+        test.Errorf("alderman signature on proof of failure failed to verify")
+    }
+    evidence := new(FailureEvidence)
+    if err := json.Unmarshal(proof, evidence); err != nil {
+        test.Fatal(err)
+    }
+    if fault, err := evidence.Fault(); err != nil || fault != por.ErrBadSignature {
+        test.Errorf("evidence shows fault %v and error %v, expected %v", fault, err, por.ErrBadSignature)
+    }
+
+    // the evidence cannot be moved to another challenge, miner or dataset
+    other := alder.IssueChallenge(&minerKey.PublicKey, encodedFile, 2)
+    moved := *evidence
+    moved.Challenge = *other
+    if moved.Verify() == nil {
+        test.Errorf("evidence verified against a different challenge")
+    }
+    reSigned := *evidence
+    impostor := por.GenerateKey()
+    reSigned.Response = *NewTicketResponse(impostor, challenge, forged.Ticket)
+    if reSigned.Verify() == nil {
+        test.Errorf("evidence verified with a response signed by another key")
+    }
+    otherFile, err := por.CreateErasureCoding([]byte("Buda-Pesth seems a wonderful place"), 2, 4)
+    if err != nil {
+        test.Fatal(err)
+    }
+    swapped := *evidence
+    swapped.Hashes = otherFile.Hashes()
+    if swapped.Verify() == nil {
+        test.Errorf("evidence verified against a different dataset")
+    }
+    tampered := *evidence
+    tampered.Challenge.K = 1
+    if tampered.Verify() == nil {
+        test.Errorf("evidence verified with a tampered challenge")
+    }
+
+    // a response that does not answer the challenge earns no demerit
+    if _, err := alder.VerifyMiner(other, forged, encodedFile, true); err == nil {
+        test.Errorf("response to another challenge verified")
+    }
+    minerID := por.Fingerprint(&minerKey.PublicKey)
+    if alder.Demerits(minerID) != 0 {
+        test.Errorf("miner has %v demerits for an unbound response, expected 0", alder.Demerits(minerID))
+    }
+    if passed, err := alder.VerifyMiner(challenge, forged, encodedFile, true); err != nil || passed || alder.Demerits(minerID) != 1 {
+        test.Errorf("miner has %v demerits after failing, expected 1", alder.Demerits(minerID))
+    }
+}
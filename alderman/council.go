@@ -0,0 +1,622 @@
+package alderman
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/tusharjois/councilfs/ledger"
+	"github.com/tusharjois/councilfs/por"
+)
+
+// EjectionThreshold is the number of failed challenges, proven by distinct
+// FailureEvidence, for which a member of the council is ejected.
+const EjectionThreshold = 3
+
+// ProposalKind identifies the change of membership a Proposal makes.
+type ProposalKind int8
+
+const (
+	// Ejection removes a member that failed EjectionThreshold challenges.
+	Ejection ProposalKind = iota
+
+	// Promotion admits a miner that meets the admission rules of the
+	// council's Registry.
+	Promotion
+)
+
+func (k ProposalKind) String() string {
+	switch k {
+	case Ejection:
+		return "Ejection"
+	case Promotion:
+		return "Promotion"
+	default:
+		return fmt.Sprintf("ProposalKind(%d)", int8(k))
+	}
+}
+
+// CouncilMessageType identifies the step of the voting protocol a
+// CouncilMessage belongs to.
+type CouncilMessageType int8
+
+const (
+	// Propose carries a Proposal to every member of the council.
+	Propose CouncilMessageType = iota
+
+	// CastVote carries a member's Vote on a proposal.
+	CastVote
+
+	// Commit carries the Certificate that finalized a change of membership,
+	// so members that missed some votes can still apply it.
+	Commit
+)
+
+// CouncilMessage is a message of the voting protocol, sent over a Transport.
+type CouncilMessage struct {
+	Type        CouncilMessageType
+	Proposal    *Proposal    `json:",omitempty"`
+	Vote        *Vote        `json:",omitempty"`
+	Certificate *Certificate `json:",omitempty"`
+}
+
+// Transport delivers council messages between members, who are identified by
+// the fingerprint of their public key.
+type Transport interface {
+	// Broadcast sends msg from the member from to every member, including
+	// itself.
+	Broadcast(from string, msg CouncilMessage)
+}
+
+// Proposal proposes a change of membership of Target at Epoch, the number of
+// membership changes the council had seen when it was proposed. To eject a
+// member, the Evidence must prove that Target failed at least
+// EjectionThreshold distinct challenges issued by members of the council. To
+// promote a miner, Stats holds the record of the miner observed by the
+// proposer; every voter checks the miner against its own observations.
+type Proposal struct {
+	Kind      ProposalKind
+	Epoch     uint64
+	Target    []byte
+	Evidence  []FailureEvidence `json:",omitempty"`
+	Stats     *MinerStats       `json:",omitempty"`
+	Proposer  []byte
+	Signature []byte
+}
+
+// Digest returns the digest of the proposal signed by its proposer and by the
+// voters.
+func (p *Proposal) Digest() [sha256.Size]byte {
+	h := sha256.New()
+	var header [9]byte
+	header[0] = byte(p.Kind)
+	binary.BigEndian.PutUint64(header[1:], p.Epoch)
+	h.Write(header[:])
+	for _, field := range [][]byte{p.Target, p.Proposer} {
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(len(field)))
+		h.Write(length[:])
+		h.Write(field)
+	}
+	for i := range p.Evidence {
+		challenge := p.Evidence[i].Challenge.Digest()
+		response := p.Evidence[i].Response.digest()
+		h.Write(challenge[:])
+		h.Write(response[:])
+	}
+	if p.Stats != nil {
+		h.Write(p.Stats.digest())
+	}
+	var digest [sha256.Size]byte
+	copy(digest[:], h.Sum(nil))
+	return digest
+}
+
+// Vote is a member's signed agreement to a Proposal.
+type Vote struct {
+	Proposal  []byte
+	Voter     []byte
+	Signature []byte
+}
+
+// Certificate finalizes a change of membership. It holds the proposal and the
+// votes of a quorum of the members of the council at the proposal's epoch. The
+// certificate of a promotion is the signed record that the miner became an
+// alderman.
+type Certificate struct {
+	Proposal Proposal
+	Votes    []Vote
+}
+
+// Quorum returns the number of votes needed among n members to tolerate f
+// faulty ones, where f is the largest number with n >= 3f+1. A quorum is more
+// than (n+f)/2 votes, so any two quorums share an honest member, who votes
+// for one proposal per epoch; when n = 3f+1 that is 2f+1.
+func Quorum(n int) int {
+	f := (n - 1) / 3
+	return (n+f)/2 + 1
+}
+
+// checkProposal checks that proposal is signed by a member. An ejection must
+// target another member and carry enough valid evidence against it; a
+// promotion must target a miner that is not yet a member.
+func checkProposal(members map[string]*ecdsa.PublicKey, proposal *Proposal) error {
+	proposer := por.FingerprintPKIX(proposal.Proposer)
+	if _, ok := members[proposer]; !ok {
+		return errors.New("proposer is not a member of the council")
+	}
+	digest := proposal.Digest()
+	if !por.VerifyAndUnMarshal(members[proposer], digest[:], proposal.Signature) {
+		return errors.New("proposal signature does not verify")
+	}
+	switch proposal.Kind {
+	case Ejection:
+		return checkEvidence(members, proposal)
+	case Promotion:
+		if _, err := parseKey(proposal.Target); err != nil {
+			return err
+		}
+		if _, ok := members[por.FingerprintPKIX(proposal.Target)]; ok {
+			return errors.New("miner is already a member of the council")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown proposal kind %v", proposal.Kind)
+	}
+}
+
+// checkEvidence checks that an ejection targets another member, and carries
+// evidence that it failed EjectionThreshold distinct challenges.
+func checkEvidence(members map[string]*ecdsa.PublicKey, proposal *Proposal) error {
+	target := por.FingerprintPKIX(proposal.Target)
+	if _, ok := members[target]; !ok {
+		return errors.New("target is not a member of the council")
+	}
+	if por.FingerprintPKIX(proposal.Proposer) == target {
+		return errors.New("member proposed its own ejection")
+	}
+	challenges := make(map[[sha256.Size]byte]bool)
+	for i := range proposal.Evidence {
+		evidence := &proposal.Evidence[i]
+		if por.FingerprintPKIX(evidence.Challenge.Miner) != target {
+			return fmt.Errorf("evidence %v is against another miner", i)
+		}
+		if _, ok := members[por.FingerprintPKIX(evidence.Challenge.Issuer)]; !ok {
+			return fmt.Errorf("evidence %v was issued outside the council", i)
+		}
+		if err := evidence.Verify(); err != nil {
+			return fmt.Errorf("evidence %v: %v", i, err)
+		}
+		challenges[evidence.Challenge.Digest()] = true
+	}
+	if len(challenges) < EjectionThreshold {
+		return fmt.Errorf("evidence of %v failed challenges, need %v", len(challenges), EjectionThreshold)
+	}
+	return nil
+}
+
+// Verify checks that the certificate changes the membership of the council
+// made up of members, as it stood at the proposal's epoch. The target's own
+// vote is not counted.
+func (c *Certificate) Verify(members map[string]*ecdsa.PublicKey) error {
+	if err := checkProposal(members, &c.Proposal); err != nil {
+		return err
+	}
+	digest := c.Proposal.Digest()
+	target := por.FingerprintPKIX(c.Proposal.Target)
+	voters := make(map[string]bool)
+	for _, vote := range c.Votes {
+		voter := por.FingerprintPKIX(vote.Voter)
+		key, ok := members[voter]
+		if !ok || voter == target || string(vote.Proposal) != string(digest[:]) {
+			continue
+		}
+		if por.VerifyAndUnMarshal(key, digest[:], vote.Signature) {
+			voters[voter] = true
+		}
+	}
+	if len(voters) < Quorum(len(members)) {
+		return fmt.Errorf("certificate has %v valid votes, need %v", len(voters), Quorum(len(members)))
+	}
+	return nil
+}
+
+// Council is a single member's view of the alderman council. It proposes
+// ejections and promotions, votes on the proposals of other members, and
+// changes the membership once a quorum of votes is gathered. Members are
+// identified by the fingerprint of their public key. A member votes for the
+// first valid proposal it receives in an epoch and for no other, so at most
+// one change of membership gains a quorum in each epoch; if conflicting
+// proposals split the votes so that none does, the epoch does not end.
+type Council struct {
+	key       *ecdsa.PrivateKey
+	id        string
+	transport Transport
+	registry  *Registry
+	ledger    ledger.Ledger
+
+	mu        sync.Mutex
+	members   map[string]*ecdsa.PublicKey
+	epoch     uint64
+	proposals map[string]*Proposal
+	votes     map[string]map[string]Vote
+	history   []Certificate
+
+	// the digest of the proposal the member voted for in this epoch, if any;
+	// it votes for no other, and applies no certificate for another
+	locked []byte
+
+	// certificates of changes the member proposed that it could not submit
+	// to its ledger yet
+	unpublished []Certificate
+}
+
+// NewCouncil creates the view of the council of the member with key, made up
+// of members, communicating over transport. members should include the key of
+// the member itself. The member decides on promotions with registry.
+func NewCouncil(key *ecdsa.PrivateKey, members []*ecdsa.PublicKey, transport Transport, registry *Registry) *Council {
+	c := &Council{
+		key:       key,
+		id:        por.Fingerprint(&key.PublicKey),
+		transport: transport,
+		registry:  registry,
+		members:   make(map[string]*ecdsa.PublicKey),
+		proposals: make(map[string]*Proposal),
+		votes:     make(map[string]map[string]Vote),
+	}
+	for _, member := range members {
+		c.members[por.Fingerprint(member)] = member
+	}
+	return c
+}
+
+// SetLedger makes the member publish the certificates of the changes of
+// membership it proposed to l.
+func (c *Council) SetLedger(l ledger.Ledger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ledger = l
+}
+
+// Publish submits to the member's ledger the certificates of changes it
+// proposed that could not be submitted when they were applied. An error is
+// returned if any of them still cannot be, and those are kept for the next
+// call.
+func (c *Council) Publish() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ledger == nil {
+		return nil
+	}
+	return c.publish()
+}
+
+// publish submits the unpublished certificates to the ledger, keeping those
+// that cannot be submitted. The caller must hold c.mu.
+func (c *Council) publish() error {
+	var kept []Certificate
+	var err error
+	for i := range c.unpublished {
+		certificate := &c.unpublished[i]
+		tx := ledger.NewTransaction(ledger.MembershipChange, certificate.Proposal.Target, certificate, c.key)
+		if _, submitErr := c.ledger.Submit(tx); submitErr != nil {
+			kept = append(kept, *certificate)
+			err = fmt.Errorf("membership change of epoch %v not submitted: %v", certificate.Proposal.Epoch, submitErr)
+		}
+	}
+	c.unpublished = kept
+	return err
+}
+
+// Registry returns the registry the member decides on promotions with.
+func (c *Council) Registry() *Registry {
+	return c.registry
+}
+
+// ID returns the fingerprint identifying the member in the council.
+func (c *Council) ID() string {
+	return c.id
+}
+
+// Epoch returns the number of membership changes the member has applied.
+func (c *Council) Epoch() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.epoch
+}
+
+// IsMember reports whether the member with fingerprint is in the council.
+func (c *Council) IsMember(fingerprint string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.members[fingerprint]
+	return ok
+}
+
+// Members returns the public keys of the members of the council, keyed by
+// fingerprint.
+func (c *Council) Members() map[string]*ecdsa.PublicKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	members := make(map[string]*ecdsa.PublicKey, len(c.members))
+	for id, key := range c.members {
+		members[id] = key
+	}
+	return members
+}
+
+// History returns the certificates of every change of membership the member
+// applied, in order.
+func (c *Council) History() []Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Certificate(nil), c.history...)
+}
+
+// Propose broadcasts a proposal to eject the member with key target, backed
+// by evidence. An error is returned if the proposal would not be accepted by
+// honest members.
+func (c *Council) Propose(target *ecdsa.PublicKey, evidence []FailureEvidence) error {
+	return c.propose(&Proposal{Kind: Ejection, Target: marshalKey(target), Evidence: evidence})
+}
+
+// ProposePromotion broadcasts a proposal to promote the miner with key
+// candidate to alderman. An error is returned if the council is full, or if
+// the miner does not meet the admission rules of the member's registry.
+func (c *Council) ProposePromotion(candidate *ecdsa.PublicKey) error {
+	stats := c.registry.Stats(por.Fingerprint(candidate))
+	if !c.registry.Admits(stats) {
+		return errors.New("miner does not meet the admission rules")
+	}
+	return c.propose(&Proposal{Kind: Promotion, Target: marshalKey(candidate), Stats: &stats})
+}
+
+func (c *Council) propose(proposal *Proposal) error {
+	c.mu.Lock()
+	if c.locked != nil {
+		c.mu.Unlock()
+		return fmt.Errorf("member already voted for a proposal in epoch %v", c.epoch)
+	}
+	if proposal.Kind == Promotion && len(c.members) >= c.registry.MaxSize {
+		c.mu.Unlock()
+		return fmt.Errorf("council already has %v members", len(c.members))
+	}
+	proposal.Epoch = c.epoch
+	proposal.Proposer = marshalKey(&c.key.PublicKey)
+	digest := proposal.Digest()
+	proposal.Signature = por.SignAndMarshal(c.key, digest[:])
+	if err := checkProposal(c.members, proposal); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.proposals[hex.EncodeToString(digest[:])] = proposal
+	c.mu.Unlock()
+	c.transport.Broadcast(c.id, CouncilMessage{Type: Propose, Proposal: proposal})
+	return nil
+}
+
+// Pending reports whether a proposal of kind about the miner with fingerprint
+// is waiting for votes in the current epoch.
+func (c *Council) Pending(kind ProposalKind, fingerprint string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, proposal := range c.proposals {
+		if proposal.Kind == kind && por.FingerprintPKIX(proposal.Target) == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// Handle processes a message received from the transport. Invalid messages,
+// and messages for epochs the member has already left, are dropped.
+func (c *Council) Handle(msg CouncilMessage) {
+	switch msg.Type {
+	case Propose:
+		if msg.Proposal != nil {
+			c.handleProposal(msg.Proposal)
+		}
+	case CastVote:
+		if msg.Vote != nil {
+			c.handleVote(msg.Vote)
+		}
+	case Commit:
+		if msg.Certificate != nil {
+			c.handleCommit(msg.Certificate)
+		}
+	}
+}
+
+func (c *Council) handleProposal(proposal *Proposal) {
+	c.mu.Lock()
+	if proposal.Epoch != c.epoch || checkProposal(c.members, proposal) != nil {
+		c.mu.Unlock()
+		return
+	}
+	digest := proposal.Digest()
+	id := hex.EncodeToString(digest[:])
+	c.proposals[id] = proposal
+	if por.FingerprintPKIX(proposal.Target) == c.id {
+		// the target does not vote on its own ejection
+		c.mu.Unlock()
+		return
+	}
+	if proposal.Kind == Promotion && (len(c.members) >= c.registry.MaxSize ||
+		!c.registry.Admits(c.registry.Stats(por.FingerprintPKIX(proposal.Target)))) {
+		// the proposal stays known, so a certificate for it is still applied
+		c.mu.Unlock()
+		return
+	}
+	if c.locked != nil && string(c.locked) != string(digest[:]) {
+		// the member voted for another proposal in this epoch
+		c.mu.Unlock()
+		return
+	}
+	c.locked = digest[:]
+	vote := &Vote{
+		Proposal:  digest[:],
+		Voter:     marshalKey(&c.key.PublicKey),
+		Signature: por.SignAndMarshal(c.key, digest[:]),
+	}
+	c.mu.Unlock()
+	c.transport.Broadcast(c.id, CouncilMessage{Type: CastVote, Vote: vote})
+}
+
+func (c *Council) handleVote(vote *Vote) {
+	c.mu.Lock()
+	id := hex.EncodeToString(vote.Proposal)
+	voter := por.FingerprintPKIX(vote.Voter)
+	key, ok := c.members[voter]
+	if !ok || !por.VerifyAndUnMarshal(key, vote.Proposal, vote.Signature) {
+		c.mu.Unlock()
+		return
+	}
+	if c.votes[id] == nil {
+		c.votes[id] = make(map[string]Vote)
+	}
+	c.votes[id][voter] = *vote
+	proposal, ok := c.proposals[id]
+	if !ok || proposal.Epoch != c.epoch {
+		// votes can arrive before the proposal; keep them until it does
+		c.mu.Unlock()
+		return
+	}
+	certificate := &Certificate{Proposal: *proposal}
+	for _, v := range c.votes[id] {
+		certificate.Votes = append(certificate.Votes, v)
+	}
+	if certificate.Verify(c.members) != nil || !c.mayApply(certificate) || c.apply(certificate) != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+	c.transport.Broadcast(c.id, CouncilMessage{Type: Commit, Certificate: certificate})
+}
+
+func (c *Council) handleCommit(certificate *Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if certificate.Proposal.Epoch != c.epoch || certificate.Verify(c.members) != nil || !c.mayApply(certificate) {
+		return
+	}
+	c.apply(certificate)
+}
+
+// mayApply reports whether the member may apply a verified certificate of the
+// current epoch: only the one for the proposal it voted for, if it voted. As
+// every honest member votes once an epoch, a quorum for another proposal
+// cannot have formed.
+func (c *Council) mayApply(certificate *Certificate) bool {
+	digest := certificate.Proposal.Digest()
+	return c.locked == nil || string(c.locked) == string(digest[:])
+}
+
+// apply makes the change of membership of a verified certificate and moves to
+// the next epoch, discarding the pending proposals of this one. The proposer
+// of the change publishes its certificate, or keeps it for Publish. An error is returned, and nothing
+// changes, if the key of a promoted miner cannot be parsed.
+func (c *Council) apply(certificate *Certificate) error {
+	target := por.FingerprintPKIX(certificate.Proposal.Target)
+	switch certificate.Proposal.Kind {
+	case Ejection:
+		delete(c.members, target)
+	case Promotion:
+		key, err := parseKey(certificate.Proposal.Target)
+		if err != nil {
+			return err
+		}
+		c.members[target] = key
+	}
+	c.epoch++
+	c.history = append(c.history, *certificate)
+	if c.ledger != nil && por.FingerprintPKIX(certificate.Proposal.Proposer) == c.id {
+		// a certificate that cannot be submitted now waits for Publish
+		c.unpublished = append(c.unpublished, *certificate)
+		c.publish()
+	}
+	c.proposals = make(map[string]*Proposal)
+	c.votes = make(map[string]map[string]Vote)
+	c.locked = nil
+	return nil
+}
+
+// LocalTransport delivers council messages between members in the same
+// process. Messages are queued by Broadcast and handed to the members by
+// Deliver, so a test controls when and whether they arrive.
+type LocalTransport struct {
+	mu       sync.Mutex
+	handlers map[string]func(CouncilMessage)
+	order    []string
+	down     map[string]bool
+	queue    []localEnvelope
+}
+
+type localEnvelope struct {
+	to  string
+	msg CouncilMessage
+}
+
+// NewLocalTransport creates a LocalTransport with no members.
+func NewLocalTransport() *LocalTransport {
+	return &LocalTransport{
+		handlers: make(map[string]func(CouncilMessage)),
+		down:     make(map[string]bool),
+	}
+}
+
+// Join registers council to receive the messages broadcast on the transport.
+func (t *LocalTransport) Join(council *Council) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.handlers[council.ID()]; !ok {
+		t.order = append(t.order, council.ID())
+	}
+	t.handlers[council.ID()] = council.Handle
+}
+
+// Disconnect drops every message sent to or from the member id from now on,
+// as if it had crashed.
+func (t *LocalTransport) Disconnect(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.down[id] = true
+}
+
+// Broadcast queues msg for every member joined to the transport.
+func (t *LocalTransport) Broadcast(from string, msg CouncilMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.down[from] {
+		return
+	}
+	for _, id := range t.order {
+		t.queue = append(t.queue, localEnvelope{to: id, msg: msg})
+	}
+}
+
+// Deliver hands queued messages to their members until no messages are left,
+// including those broadcast while handling others. It returns the number of
+// messages delivered.
+func (t *LocalTransport) Deliver() int {
+	delivered := 0
+	for {
+		t.mu.Lock()
+		if len(t.queue) == 0 {
+			t.mu.Unlock()
+			return delivered
+		}
+		envelope := t.queue[0]
+		t.queue = t.queue[1:]
+		handler := t.handlers[envelope.to]
+		down := t.down[envelope.to]
+		t.mu.Unlock()
+		if !down {
+			handler(envelope.msg)
+			delivered++
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package alderman
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tusharjois/councilfs/ledger"
+	"github.com/tusharjois/councilfs/por"
+)
+
+// newTestCouncil creates n aldermen that are members of one council, joined
+// to a LocalTransport.
+func newTestCouncil(n int, clock Clock) ([]*Alderman, []*Council, *LocalTransport) {
+	transport := NewLocalTransport()
+	aldermen := make([]*Alderman, n)
+	var keys []*ecdsa.PublicKey
+	for i := range aldermen {
+		aldermen[i] = New(por.GenerateKey(), clock)
+		keys = append(keys, aldermen[i].PublicKey())
+	}
+	councils := make([]*Council, n)
+	for i, alder := range aldermen {
+		registry := NewRegistry(clock, MinUptime{Challenges: 3, Ratio: 0.9}, MinWins{Wins: 2})
+		councils[i] = NewCouncil(alder.key, keys, transport, registry)
+		alder.JoinCouncil(councils[i])
+		transport.Join(councils[i])
+	}
+	return aldermen, councils, transport
+}
+
+func TestCouncilEjection(test *testing.T) {
+	now := time.Unix(1000, 0)
+	aldermen, councils, transport := newTestCouncil(7, func() time.Time { return now })
+	encodedFile, err := por.CreateErasureCoding([]byte("Left Munich at 8:35 P. M., on 1st May"), 2, 4)
+	if err != nil {
+		test.Fatal(err)
+	}
+	challenger, target := aldermen[0], aldermen[4]
+	targetID := por.Fingerprint(target.PublicKey())
+
+	// one honest member has crashed, which a council of seven tolerates as
+	// well as the faulty target
+	transport.Disconnect(councils[3].ID())
+
+	// proofs and membership changes are published to the ledger
+	l := ledger.NewMemory()
+	var published []*ledger.Transaction
+	l.Subscribe(func(block *ledger.Block) { published = append(published, block.Transactions...) })
+	for i := range aldermen {
+		aldermen[i].SetLedger(l)
+		councils[i].SetLedger(l)
+	}
+
+	for i := 0; i < EjectionThreshold; i++ {
+		challenge := challenger.IssueChallenge(target.PublicKey(), encodedFile, 2)
+		response := forgeResponse(target.key, challenge, encodedFile)
+		if passed, err := challenger.VerifyMiner(challenge, response, encodedFile, true); err != nil || passed {
+			test.Fatalf("incorrect ticket verified")
+		}
+		now = now.Add(time.Second)
+		if i < EjectionThreshold-1 && transport.Deliver() != 0 {
+			test.Errorf("proposal made after %v failures", i+1)
+		}
+	}
+	transport.Deliver()
+	for i, council := range councils {
+		if i == 3 || i == 4 {
+			continue
+		}
+		if council.IsMember(targetID) || council.Epoch() != 1 {
+			test.Errorf("member %v did not eject the target", i)
+		}
+	}
+	if !councils[3].IsMember(targetID) {
+		test.Errorf("crashed member applied the ejection")
+	}
+	if proofs, err := FailureProofs(l, target.PublicKey()); err != nil || len(proofs) != EjectionThreshold {
+		test.Errorf("%v proofs of failure on the ledger, expected %v", len(proofs), EjectionThreshold)
+	}
+	l.Seal()
+	kinds := make(map[ledger.Kind]int)
+	for _, tx := range published {
+		kinds[tx.Kind]++
+	}
+	if kinds[ledger.FailureProof] != EjectionThreshold || kinds[ledger.MembershipChange] != 1 {
+		test.Errorf("sealed block holds %v proofs and %v membership changes, expected %v and 1",
+			kinds[ledger.FailureProof], kinds[ledger.MembershipChange], EjectionThreshold)
+	}
+
+	// anyone that knows the genesis council can replay the ejection, and the
+	// failures behind it, from the ledger
+	var genesis []*ecdsa.PublicKey
+	for _, alder := range aldermen {
+		genesis = append(genesis, alder.PublicKey())
+	}
+	replayed, err := LedgerMembership(l, genesis, nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if _, ok := replayed[targetID]; ok || len(replayed) != 6 {
+		test.Errorf("replayed council of %v members, expected 6 without the target", len(replayed))
+	}
+	policy := DefaultReputationPolicy()
+	if demerits, err := LedgerReputation(l, target.PublicKey(), policy, now); err != nil || demerits < policy.Threshold {
+		test.Errorf("target carries %v demerits on the ledger, expected at least %v", demerits, policy.Threshold)
+	}
+
+	// the certificate convinces a third party that knows the old council
+	ejections := councils[0].History()
+	if len(ejections) != 1 {
+		test.Fatalf("%v changes of membership, expected 1", len(ejections))
+	}
+	members := councils[3].Members()
+	certificate := ejections[0]
+	if err := certificate.Verify(members); err != nil {
+		test.Errorf("certificate failed to verify: %v", err)
+	}
+	duplicated := certificate
+	duplicated.Votes = []Vote{certificate.Votes[0], certificate.Votes[0], certificate.Votes[0]}
+	if duplicated.Verify(members) == nil {
+		test.Errorf("certificate with one voter repeated verified")
+	}
+	short := certificate
+	short.Votes = certificate.Votes[:Quorum(len(members))-1]
+	if short.Verify(members) == nil {
+		test.Errorf("certificate without a quorum verified")
+	}
+
+	// the crashed member catches up from the certificate
+	councils[3].Handle(CouncilMessage{Type: Commit, Certificate: &certificate})
+	if councils[3].IsMember(targetID) || councils[3].Epoch() != 1 {
+		test.Errorf("member did not apply the certificate")
+	}
+	councils[3].Handle(CouncilMessage{Type: Commit, Certificate: &certificate})
+	if councils[3].Epoch() != 1 {
+		test.Errorf("certificate applied twice")
+	}
+}
+
+func TestCouncilRejectsWeakProposals(test *testing.T) {
+	now := time.Unix(1000, 0)
+	aldermen, councils, transport := newTestCouncil(4, func() time.Time { return now })
+	encodedFile, err := por.CreateErasureCoding([]byte("Left Munich at 8:35 P. M., on 1st May"), 2, 4)
+	if err != nil {
+		test.Fatal(err)
+	}
+	challenger, target := aldermen[0], aldermen[3]
+	targetID := por.Fingerprint(target.PublicKey())
+
+	// the same failure counted three times is not enough evidence
+	challenge := challenger.IssueChallenge(target.PublicKey(), encodedFile, 2)
+	evidence := FailureEvidence{
+		Challenge: *challenge,
+		Response:  *forgeResponse(target.key, challenge, encodedFile),
+		Hashes:    encodedFile.Hashes(),
+	}
+	repeated := []FailureEvidence{evidence, evidence, evidence}
+	if err := councils[0].Propose(target.PublicKey(), repeated); err == nil {
+		test.Errorf("proposal with repeated evidence accepted")
+	}
+
+	// a byzantine proposer that broadcasts it anyway gets no votes
+	proposal := &Proposal{
+		Kind:     Ejection,
+		Target:   marshalKey(target.PublicKey()),
+		Evidence: repeated,
+		Proposer: marshalKey(challenger.PublicKey()),
+	}
+	digest := proposal.Digest()
+	proposal.Signature = por.SignAndMarshal(challenger.key, digest[:])
+	transport.Broadcast(councils[0].ID(), CouncilMessage{Type: Propose, Proposal: proposal})
+	if delivered := transport.Deliver(); delivered != len(councils) {
+		test.Errorf("%v messages delivered, expected only the proposal to each member", delivered)
+	}
+
+	// correct responses are not evidence
+	var passed []FailureEvidence
+	for i := 0; i < EjectionThreshold; i++ {
+		challenge := challenger.IssueChallenge(target.PublicKey(), encodedFile, 2)
+		passed = append(passed, FailureEvidence{
+			Challenge: *challenge,
+			Response:  *RespondToChallenge(target.key, challenge, encodedFile),
+			Hashes:    encodedFile.Hashes(),
+		})
+	}
+	if err := councils[1].Propose(target.PublicKey(), passed); err == nil {
+		test.Errorf("proposal backed by passed challenges accepted")
+	}
+	transport.Deliver()
+	for i, council := range councils {
+		if !council.IsMember(targetID) || council.Epoch() != 0 {
+			test.Errorf("member %v ejected the target", i)
+		}
+	}
+}
+
+func TestCouncilPromotion(test *testing.T) {
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+	aldermen, councils, transport := newTestCouncil(4, clock)
+	encodedFile, err := por.CreateErasureCoding([]byte("Left Munich at 8:35 P. M., on 1st May"), 2, 4)
+	if err != nil {
+		test.Fatal(err)
+	}
+	minerKey := por.GenerateKey()
+	minerID := por.Fingerprint(&minerKey.PublicKey)
+
+	// every member challenges the miner, which keeps passing
+	for round := 0; round < 3; round++ {
+		for _, alder := range aldermen {
+			challenge := alder.IssueChallenge(&minerKey.PublicKey, encodedFile, 2)
+			response := RespondToChallenge(minerKey, challenge, encodedFile)
+			if passed, err := alder.VerifyMiner(challenge, response, encodedFile, true); err != nil || !passed {
+				test.Fatalf("correct ticket failed to verify")
+			}
+		}
+		now = now.Add(time.Hour)
+		if round < 2 && transport.Deliver() != 0 {
+			test.Errorf("promotion proposed after %v rounds", round+1)
+		}
+	}
+	transport.Deliver()
+	for i, council := range councils {
+		if !council.IsMember(minerID) || council.Epoch() != 1 {
+			test.Errorf("member %v did not promote the miner", i)
+		}
+	}
+
+	// the certificate is the signed record of the promotion
+	history := councils[0].History()
+	if len(history) != 1 || history[0].Proposal.Kind != Promotion {
+		test.Fatalf("expected a single promotion in the history")
+	}
+	before := councils[0].Members()
+	delete(before, minerID)
+	if err := history[0].Verify(before); err != nil {
+		test.Errorf("promotion certificate failed to verify: %v", err)
+	}
+	if history[0].Proposal.Stats == nil || history[0].Proposal.Stats.Passed != 3 {
+		test.Errorf("promotion does not record the miner's stats")
+	}
+
+	// the new alderman now counts towards the quorum
+	if Quorum(len(councils[0].Members())) != 4 {
+		test.Errorf("quorum of %v members is %v, expected 4", len(councils[0].Members()), Quorum(len(councils[0].Members())))
+	}
+}
+
+func TestCouncilConflictingProposals(test *testing.T) {
+	now := time.Unix(1000, 0)
+	_, councils, transport := newTestCouncil(4, func() time.Time { return now })
+	first, second := por.GenerateKey(), por.GenerateKey()
+	for _, council := range councils {
+		council.Registry().MaxSize = 6
+		for _, miner := range []*ecdsa.PrivateKey{first, second} {
+			council.Registry().RecordWin(por.Fingerprint(&miner.PublicKey))
+			council.Registry().RecordWin(por.Fingerprint(&miner.PublicKey))
+		}
+	}
+
+	// two members propose different promotions in the same epoch, and every
+	// member votes only for the first it receives
+	if err := councils[0].ProposePromotion(&first.PublicKey); err != nil {
+		test.Fatal(err)
+	}
+	if err := councils[1].ProposePromotion(&second.PublicKey); err != nil {
+		test.Fatal(err)
+	}
+	transport.Deliver()
+	for i, council := range councils {
+		if !council.IsMember(por.Fingerprint(&first.PublicKey)) || council.IsMember(por.Fingerprint(&second.PublicKey)) ||
+			council.Epoch() != 1 {
+			test.Errorf("member %v did not apply only the first promotion", i)
+		}
+	}
+}
+
+func TestCouncilPromotionLimits(test *testing.T) {
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+	aldermen, councils, transport := newTestCouncil(4, clock)
+	winner := por.GenerateKey()
+	winnerID := por.Fingerprint(&winner.PublicKey)
+
+	// a single member's observations cannot promote a miner
+	councils[0].Registry().RecordWin(winnerID)
+	councils[0].Registry().RecordWin(winnerID)
+	if err := councils[0].ProposePromotion(&winner.PublicKey); err != nil {
+		test.Fatal(err)
+	}
+	transport.Deliver()
+	if councils[0].IsMember(winnerID) {
+		test.Errorf("miner promoted without a quorum of observers")
+	}
+
+	// wins age out of the admission window
+	for _, council := range councils[1:] {
+		council.Registry().RecordWin(winnerID)
+	}
+	now = now.Add(DefaultAdmissionWindow + time.Hour)
+	for _, council := range councils[1:] {
+		council.Registry().RecordWin(winnerID)
+	}
+	if stats := councils[1].Registry().Stats(winnerID); stats.Wins != 1 {
+		test.Errorf("%v wins in the window, expected 1", stats.Wins)
+	}
+	if err := councils[1].ProposePromotion(&winner.PublicKey); err == nil {
+		test.Errorf("miner with stale wins proposed")
+	}
+
+	// a full council admits no one
+	for _, council := range councils {
+		council.Registry().RecordWin(winnerID)
+		council.Registry().MaxSize = len(aldermen)
+	}
+	if err := councils[1].ProposePromotion(&winner.PublicKey); err == nil {
+		test.Errorf("promotion proposed to a full council")
+	}
+	for _, council := range councils {
+		council.Registry().MaxSize = len(aldermen) + 1
+	}
+	if err := councils[1].ProposePromotion(&winner.PublicKey); err != nil {
+		test.Fatal(err)
+	}
+	transport.Deliver()
+	for i, council := range councils[1:] {
+		if !council.IsMember(winnerID) {
+			test.Errorf("member %v did not promote the miner", i+1)
+		}
+	}
+	// the first member voted for its own proposal in this epoch, so it
+	// applies no other
+	if councils[0].IsMember(winnerID) || councils[0].Epoch() != 0 {
+		test.Errorf("member applied a certificate for a proposal it did not vote for")
+	}
+}
+
+// downLedger is a ledger that rejects every transaction while it is down.
+type downLedger struct {
+	ledger.Ledger
+	down bool
+}
+
+func (l *downLedger) Submit(tx *ledger.Transaction) ([]byte, error) {
+	if l.down {
+		return nil, errors.New("ledger is down")
+	}
+	return l.Ledger.Submit(tx)
+}
+
+func TestCouncilUnpublished(test *testing.T) {
+	now := time.Unix(1000, 0)
+	aldermen, councils, transport := newTestCouncil(4, func() time.Time { return now })
+	l := &downLedger{Ledger: ledger.NewMemory(), down: true}
+	for i := range aldermen {
+		aldermen[i].SetLedger(l)
+		councils[i].SetLedger(l)
+	}
+
+	// a proof of failure that cannot be submitted is reported, and the
+	// demerit stands
+	encodedFile, err := por.CreateErasureCoding([]byte("Left Munich at 8:35 P. M., on 1st May"), 2, 4)
+	if err != nil {
+		test.Fatal(err)
+	}
+	minerKey := por.GenerateKey()
+	challenge := aldermen[0].IssueChallenge(&minerKey.PublicKey, encodedFile, 2)
+	response := forgeResponse(minerKey, challenge, encodedFile)
+	if _, err := aldermen[0].VerifyMiner(challenge, response, encodedFile, true); err == nil {
+		test.Errorf("unsubmitted proof of failure was not reported")
+	}
+	if demerits := aldermen[0].Demerits(por.Fingerprint(&minerKey.PublicKey)); demerits != 1 {
+		test.Errorf("%v demerits, expected 1", demerits)
+	}
+
+	// a certificate that cannot be submitted is kept until it can
+	winner := por.GenerateKey()
+	winnerID := por.Fingerprint(&winner.PublicKey)
+	for _, council := range councils {
+		council.Registry().RecordWin(winnerID)
+		council.Registry().RecordWin(winnerID)
+	}
+	if err := councils[0].ProposePromotion(&winner.PublicKey); err != nil {
+		test.Fatal(err)
+	}
+	transport.Deliver()
+	if !councils[0].IsMember(winnerID) {
+		test.Fatalf("miner was not promoted")
+	}
+	if councils[0].Publish() == nil {
+		test.Errorf("certificate published to a ledger that is down")
+	}
+	l.down = false
+	if err := councils[0].Publish(); err != nil {
+		test.Fatal(err)
+	}
+	if txs, err := l.References(marshalKey(&winner.PublicKey)); err != nil || len(txs) != 1 {
+		test.Errorf("%v certificates on the ledger, expected 1", len(txs))
+	}
+	if err := councils[0].Publish(); err != nil {
+		test.Fatal(err)
+	}
+	if txs, _ := l.References(marshalKey(&winner.PublicKey)); len(txs) != 1 {
+		test.Errorf("certificate published %v times, expected once", len(txs))
+	}
+}
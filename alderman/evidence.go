@@ -0,0 +1,202 @@
+package alderman
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	"github.com/tusharjois/councilfs/por"
+)
+
+// Challenge is a proof of retrievability challenge issued by an alderman to a
+// miner. The miner must produce a ticket of K segments over the dataset with
+// Merkle root Root, using Value as the blockchainVal, by Deadline: an answer
+// is late only once the second of the deadline has passed. Times are in Unix
+// seconds. The challenge is signed by the alderman that issued it.
+type Challenge struct {
+	Issuer    []byte
+	Miner     []byte
+	Value     []byte
+	K         uint
+	Root      []byte
+	IssuedAt  int64
+	Deadline  int64
+	Signature []byte
+}
+
+// Digest returns the digest of the challenge signed by its issuer.
+func (c *Challenge) Digest() [sha256.Size]byte {
+	h := sha256.New()
+	for _, field := range [][]byte{c.Issuer, c.Miner, c.Value, c.Root} {
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(len(field)))
+		h.Write(length[:])
+		h.Write(field)
+	}
+	var numbers [24]byte
+	binary.BigEndian.PutUint64(numbers[:8], uint64(c.K))
+	binary.BigEndian.PutUint64(numbers[8:16], uint64(c.IssuedAt))
+	binary.BigEndian.PutUint64(numbers[16:], uint64(c.Deadline))
+	h.Write(numbers[:])
+	var digest [sha256.Size]byte
+	copy(digest[:], h.Sum(nil))
+	return digest
+}
+
+// Verify checks that the challenge is signed by its issuer.
+func (c *Challenge) Verify() error {
+	return verifySignature(c.Issuer, c.Digest(), c.Signature)
+}
+
+// NewChallenge creates a challenge from the alderman with issuerKey to the
+// miner with minerKey over dataset, to be answered between issuedAt and
+// deadline, signed by the alderman. The challenge value is chosen at random,
+// so the miner cannot precompute its ticket.
+func NewChallenge(issuerKey *ecdsa.PrivateKey, minerKey *ecdsa.PublicKey, dataset *por.EncodedDataset,
+	k uint, issuedAt int64, deadline int64) *Challenge {
+	value := make([]byte, 32)
+	if _, err := rand.Read(value); err != nil {
+		panic(err)
+	}
+	challenge := &Challenge{
+		Issuer:   marshalKey(&issuerKey.PublicKey),
+		Miner:    marshalKey(minerKey),
+		Value:    value,
+		K:        k,
+		Root:     dataset.Root(),
+		IssuedAt: issuedAt,
+		Deadline: deadline,
+	}
+	digest := challenge.Digest()
+	challenge.Signature = por.SignAndMarshal(issuerKey, digest[:])
+	return challenge
+}
+
+// TicketResponse is a miner's answer to a Challenge. The miner signs the ticket
+// together with the digest of the challenge, so they cannot later deny having
+// answered that challenge with that ticket.
+type TicketResponse struct {
+	Challenge []byte
+	Ticket    []byte
+	Signature []byte
+}
+
+func (r *TicketResponse) digest() [sha256.Size]byte {
+	return sha256.Sum256(append(append([]byte{}, r.Challenge...), r.Ticket...))
+}
+
+// RespondToChallenge is done by a miner holding dataset. It produces the ticket
+// asked for by the challenge and signs the response.
+func RespondToChallenge(minerKey *ecdsa.PrivateKey, challenge *Challenge, dataset *por.EncodedDataset) *TicketResponse {
+	seed := make([]byte, 12)
+	if _, err := rand.Read(seed); err != nil {
+		panic(err)
+	}
+	return NewTicketResponse(minerKey, challenge, por.ProducePOR(minerKey, challenge.Value, dataset, challenge.K, seed))
+}
+
+// NewTicketResponse signs ticket as the miner's answer to challenge.
+func NewTicketResponse(minerKey *ecdsa.PrivateKey, challenge *Challenge, ticket []byte) *TicketResponse {
+	challengeDigest := challenge.Digest()
+	response := &TicketResponse{Challenge: challengeDigest[:], Ticket: ticket}
+	digest := response.digest()
+	response.Signature = por.SignAndMarshal(minerKey, digest[:])
+	return response
+}
+
+// Verify checks that the response answers challenge and is signed by the
+// miner the challenge was issued to, and that the ticket inside it is the
+// miner's own.
+func (r *TicketResponse) Verify(challenge *Challenge) error {
+	challengeDigest := challenge.Digest()
+	if !bytes.Equal(r.Challenge, challengeDigest[:]) {
+		return errors.New("response does not answer the challenge")
+	}
+	if err := verifySignature(challenge.Miner, r.digest(), r.Signature); err != nil {
+		return err
+	}
+	var ticket por.Ticket
+	if err := json.Unmarshal(r.Ticket, &ticket); err != nil {
+		return err
+	}
+	if !bytes.Equal(ticket.PublicKey, challenge.Miner) {
+		return errors.New("ticket was not produced by the challenged miner")
+	}
+	return nil
+}
+
+// FailureEvidence proves to any third party that a miner failed a challenge.
+// It holds the challenge signed by the alderman that issued it, the response
+// signed by the miner, and the hashes of the shards of the challenged dataset,
+// whose Merkle root is the root named in the challenge. Anyone can re-run the
+// verification of the ticket against the hashes with Verify.
+type FailureEvidence struct {
+	Challenge Challenge
+	Response  TicketResponse
+	Hashes    [][]byte
+}
+
+// Fault re-runs the verification of the ticket in the evidence, and returns
+// the por error describing why it fails, or nil if the ticket verifies. An
+// error is also returned if the evidence itself is not well formed.
+func (e *FailureEvidence) Fault() (error, error) {
+	if err := e.Challenge.Verify(); err != nil {
+		return nil, err
+	}
+	if err := e.Response.Verify(&e.Challenge); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(por.MerkleRoot(e.Hashes), e.Challenge.Root) {
+		return nil, errors.New("hashes do not match the challenged dataset")
+	}
+	return por.CheckPOR(e.Hashes, e.Challenge.Value, e.Response.Ticket, e.Challenge.K), nil
+}
+
+// Verify checks that the evidence is well formed and that the miner really
+// failed the challenge.
+func (e *FailureEvidence) Verify() error {
+	fault, err := e.Fault()
+	if err != nil {
+		return err
+	}
+	if fault == nil {
+		return errors.New("miner did not fail the challenge")
+	}
+	return nil
+}
+
+func marshalKey(key *ecdsa.PublicKey) []byte {
+	keyBytes, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		panic(err)
+	}
+	return keyBytes
+}
+
+func parseKey(keyBytes []byte) (*ecdsa.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaKey, correctType := key.(*ecdsa.PublicKey)
+	if !correctType {
+		return nil, errors.New("public key is not an ecdsa key")
+	}
+	return ecdsaKey, nil
+}
+
+func verifySignature(keyBytes []byte, digest [sha256.Size]byte, signature []byte) error {
+	key, err := parseKey(keyBytes)
+	if err != nil {
+		return err
+	}
+	if !por.VerifyAndUnMarshal(key, digest[:], signature) {
+		return errors.New("signature does not verify")
+	}
+	return nil
+}
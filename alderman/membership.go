@@ -0,0 +1,107 @@
+package alderman
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/tusharjois/councilfs/ledger"
+	"github.com/tusharjois/councilfs/por"
+)
+
+// LedgerMembership replays the changes of membership published to l on top of
+// the genesis members of the council, and returns the members after them,
+// keyed by fingerprint. The ledger finds changes by the key they concern, so
+// candidates lists the PKIX encodings of every key that may have joined or
+// left, such as those of the aldermen that announced themselves. Changes are
+// applied in order of epoch, each only if its certificate verifies against the
+// members before it, and the replay stops at the first epoch for which no
+// certificate verifies. Of several certificates that verify for an epoch, the
+// one whose proposal has the lowest digest is applied, so every replay agrees.
+func LedgerMembership(l ledger.Ledger, genesis []*ecdsa.PublicKey, candidates [][]byte) (map[string]*ecdsa.PublicKey, error) {
+	members := make(map[string]*ecdsa.PublicKey)
+	for _, member := range genesis {
+		members[por.Fingerprint(member)] = member
+		candidates = append(candidates, marshalKey(member))
+	}
+
+	byEpoch := make(map[uint64][]Certificate)
+	searched := make(map[string]bool)
+	for _, candidate := range candidates {
+		if searched[hex.EncodeToString(candidate)] {
+			continue
+		}
+		searched[hex.EncodeToString(candidate)] = true
+		txs, err := l.References(candidate)
+		if err != nil {
+			return nil, err
+		}
+		for _, tx := range txs {
+			var certificate Certificate
+			if tx.Kind != ledger.MembershipChange || json.Unmarshal(tx.Payload, &certificate) != nil {
+				continue
+			}
+			epoch := certificate.Proposal.Epoch
+			byEpoch[epoch] = append(byEpoch[epoch], certificate)
+		}
+	}
+
+	for epoch := uint64(0); ; epoch++ {
+		certificates := byEpoch[epoch]
+		sort.Slice(certificates, func(i, j int) bool {
+			a, b := certificates[i].Proposal.Digest(), certificates[j].Proposal.Digest()
+			return bytes.Compare(a[:], b[:]) < 0
+		})
+		applied := false
+		for _, certificate := range certificates {
+			if certificate.Verify(members) != nil {
+				continue
+			}
+			target := por.FingerprintPKIX(certificate.Proposal.Target)
+			switch certificate.Proposal.Kind {
+			case Ejection:
+				delete(members, target)
+			case Promotion:
+				key, err := parseKey(certificate.Proposal.Target)
+				if err != nil {
+					continue
+				}
+				members[target] = key
+			}
+			applied = true
+			break
+		}
+		if !applied {
+			return members, nil
+		}
+	}
+}
+
+// LedgerReputation judges the miner with key miner by the proofs of its
+// failures published to l, as policy would had the miner failed only those
+// challenges, and returns the demerits it carries at now.
+func LedgerReputation(l ledger.Ledger, miner *ecdsa.PublicKey, policy ReputationPolicy, now time.Time) (float64, error) {
+	proofs, err := FailureProofs(l, miner)
+	if err != nil {
+		return 0, err
+	}
+	sort.SliceStable(proofs, func(i, j int) bool {
+		return proofs[i].Challenge.IssuedAt < proofs[j].Challenge.IssuedAt
+	})
+	// several aldermen may publish the same failure
+	counted := make(map[[32]byte]bool)
+	var rep Reputation
+	for _, evidence := range proofs {
+		digest := evidence.Challenge.Digest()
+		if counted[digest] {
+			continue
+		}
+		counted[digest] = true
+		fault, _ := evidence.Fault()
+		rep = policy.Fail(rep, failureOf(fault), time.Unix(evidence.Challenge.IssuedAt, 0))
+	}
+	return policy.Demerits(rep, now), nil
+}
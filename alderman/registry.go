@@ -0,0 +1,178 @@
+package alderman
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// DefaultMaxCouncilSize bounds the number of aldermen in a council, so the
+// cost of reaching a quorum stays bounded as miners are promoted.
+const DefaultMaxCouncilSize = 21
+
+// DefaultAdmissionWindow is the period over which a Registry judges miners.
+const DefaultAdmissionWindow = 7 * 24 * time.Hour
+
+// MinerStats is the record of a miner over the admission window of a
+// Registry: the challenges it passed and failed, the winning tickets it mined,
+// and the time, in Unix seconds, it was first observed in the window.
+type MinerStats struct {
+	Passed int
+	Failed int
+	Wins   int
+	Since  int64
+}
+
+// Uptime returns the fraction of challenges the miner passed, or 0 if it was
+// never challenged.
+func (s MinerStats) Uptime() float64 {
+	if s.Passed+s.Failed == 0 {
+		return 0
+	}
+	return float64(s.Passed) / float64(s.Passed+s.Failed)
+}
+
+func (s MinerStats) digest() []byte {
+	var encoded [32]byte
+	binary.BigEndian.PutUint64(encoded[:8], uint64(s.Passed))
+	binary.BigEndian.PutUint64(encoded[8:16], uint64(s.Failed))
+	binary.BigEndian.PutUint64(encoded[16:24], uint64(s.Wins))
+	binary.BigEndian.PutUint64(encoded[24:], uint64(s.Since))
+	digest := sha256.Sum256(encoded[:])
+	return digest[:]
+}
+
+// AdmissionRule decides whether a miner with the given record may be promoted
+// to alderman.
+type AdmissionRule interface {
+	Admits(stats MinerStats) bool
+}
+
+// MinWins admits miners that mined at least Wins winning tickets.
+type MinWins struct {
+	Wins int
+}
+
+// Admits implements AdmissionRule.
+func (r MinWins) Admits(stats MinerStats) bool {
+	return stats.Wins >= r.Wins
+}
+
+// MinUptime admits miners that were challenged at least Challenges times and
+// passed at least the fraction Ratio of those challenges.
+type MinUptime struct {
+	Challenges int
+	Ratio      float64
+}
+
+// Admits implements AdmissionRule.
+func (r MinUptime) Admits(stats MinerStats) bool {
+	return stats.Passed+stats.Failed >= r.Challenges && stats.Uptime() >= r.Ratio
+}
+
+// observationKind is what a Registry observed a miner do.
+type observationKind int8
+
+const (
+	observedPass observationKind = iota
+	observedFailure
+	observedWin
+)
+
+type observation struct {
+	kind observationKind
+	at   time.Time
+}
+
+// Registry records what a member of the council observes of miners, and
+// decides from it which miners may be promoted to alderman. A miner is
+// admitted if it meets any one of the Rules over the last Window; a council
+// admits no more than MaxSize members.
+type Registry struct {
+	MaxSize int
+	Window  time.Duration
+	Rules   []AdmissionRule
+
+	clock        Clock
+	mu           sync.Mutex
+	observations map[string][]observation
+}
+
+// NewRegistry creates a Registry with the default council size and admission
+// window, admitting miners by rules, and reading the time from clock.
+func NewRegistry(clock Clock, rules ...AdmissionRule) *Registry {
+	return &Registry{
+		MaxSize:      DefaultMaxCouncilSize,
+		Window:       DefaultAdmissionWindow,
+		Rules:        rules,
+		clock:        clock,
+		observations: make(map[string][]observation),
+	}
+}
+
+// RecordChallenge records that the miner with fingerprint passed or failed a
+// challenge.
+func (r *Registry) RecordChallenge(fingerprint string, passed bool) {
+	kind := observedFailure
+	if passed {
+		kind = observedPass
+	}
+	r.observe(fingerprint, kind)
+}
+
+// RecordWin records that the miner with fingerprint mined a winning ticket. A
+// chain.Chain whose Wins is the registry records the producer of every block
+// that joins its main chain.
+func (r *Registry) RecordWin(fingerprint string) {
+	r.observe(fingerprint, observedWin)
+}
+
+// observe records an observation, dropping those that left the window.
+func (r *Registry) observe(fingerprint string, kind observationKind) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.clock()
+	kept := r.observations[fingerprint][:0]
+	for _, o := range r.observations[fingerprint] {
+		if now.Sub(o.at) <= r.Window {
+			kept = append(kept, o)
+		}
+	}
+	r.observations[fingerprint] = append(kept, observation{kind: kind, at: now})
+}
+
+// Stats returns the record of the miner with fingerprint over the window.
+func (r *Registry) Stats(fingerprint string) MinerStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.clock()
+	var stats MinerStats
+	for _, o := range r.observations[fingerprint] {
+		if now.Sub(o.at) > r.Window {
+			continue
+		}
+		if stats.Since == 0 {
+			stats.Since = o.at.Unix()
+		}
+		switch o.kind {
+		case observedPass:
+			stats.Passed++
+		case observedFailure:
+			stats.Failed++
+		case observedWin:
+			stats.Wins++
+		}
+	}
+	return stats
+}
+
+// Admits reports whether a miner with stats meets any of the admission rules.
+func (r *Registry) Admits(stats MinerStats) bool {
+	for _, rule := range r.Rules {
+		if rule.Admits(stats) {
+			return true
+		}
+	}
+	return false
+}
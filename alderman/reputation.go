@@ -0,0 +1,148 @@
+package alderman
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/tusharjois/councilfs/por"
+)
+
+// Failure is the way in which a miner failed a challenge.
+type Failure int8
+
+const (
+	// BadSignature is a ticket with a segment signature that does not verify.
+	BadSignature Failure = iota
+
+	// WrongSegment is a ticket with a segment that is not part of the
+	// challenged dataset.
+	WrongSegment
+
+	// MalformedTicket is a ticket that cannot be parsed or is too short.
+	MalformedTicket
+
+	// NoResponse is a challenge the miner did not answer in time.
+	NoResponse
+)
+
+func (f Failure) String() string {
+	switch f {
+	case BadSignature:
+		return "BadSignature"
+	case WrongSegment:
+		return "WrongSegment"
+	case MalformedTicket:
+		return "MalformedTicket"
+	case NoResponse:
+		return "NoResponse"
+	default:
+		return fmt.Sprintf("Failure(%d)", int8(f))
+	}
+}
+
+// failureOf returns the Failure described by an error of por.CheckPOR.
+func failureOf(err error) Failure {
+	switch err {
+	case por.ErrBadSignature:
+		return BadSignature
+	case por.ErrWrongSegment:
+		return WrongSegment
+	default:
+		return MalformedTicket
+	}
+}
+
+// Reputation is what an alderman holds against a miner: the demerits of its
+// failures as of Updated, in Unix nanoseconds, and the number of challenges
+// the miner has passed in a row since its last failure or forgiveness.
+type Reputation struct {
+	Demerits float64
+	Updated  int64
+	Streak   int
+}
+
+// ReputationPolicy decides how an alderman judges the miners it challenges.
+// Policies are pure functions of a Reputation and the time, so the same
+// history always yields the same judgement.
+type ReputationPolicy interface {
+	// Fail returns the reputation after the miner failed a challenge at now.
+	Fail(rep Reputation, failure Failure, now time.Time) Reputation
+
+	// Pass returns the reputation after the miner passed a challenge at now.
+	Pass(rep Reputation, now time.Time) Reputation
+
+	// Demerits returns the demerits the reputation carries at now.
+	Demerits(rep Reputation, now time.Time) float64
+
+	// Eject reports whether a miner with the reputation should be ejected
+	// from the council at now.
+	Eject(rep Reputation, now time.Time) bool
+}
+
+// DecayPolicy is a ReputationPolicy under which each failure adds its weight
+// in demerits, demerits halve every HalfLife, and ForgiveAfter passed
+// challenges in a row remove the fraction Forgiveness of the demerits left. A
+// miner is ejected once it holds Threshold demerits. A zero HalfLife or
+// ForgiveAfter disables decay or forgiveness.
+type DecayPolicy struct {
+	Threshold    float64
+	Weights      map[Failure]float64
+	HalfLife     time.Duration
+	ForgiveAfter int
+	Forgiveness  float64
+}
+
+// DefaultReputationPolicy returns the policy an alderman uses unless told
+// otherwise. Demerits halve every month, and the threshold sits below three
+// so that three failed proofs within about a week lead to ejection despite
+// the decay between them. Missed challenges count half as much as failed
+// proofs, and ten good proofs in a row wipe the slate clean.
+func DefaultReputationPolicy() *DecayPolicy {
+	return &DecayPolicy{
+		Threshold: 2.5,
+		Weights: map[Failure]float64{
+			BadSignature:    1,
+			WrongSegment:    1,
+			MalformedTicket: 1,
+			NoResponse:      0.5,
+		},
+		HalfLife:     30 * 24 * time.Hour,
+		ForgiveAfter: 10,
+		Forgiveness:  1,
+	}
+}
+
+// Demerits implements ReputationPolicy.
+func (p *DecayPolicy) Demerits(rep Reputation, now time.Time) float64 {
+	elapsed := now.Sub(time.Unix(0, rep.Updated))
+	if p.HalfLife <= 0 || elapsed <= 0 || rep.Demerits == 0 {
+		return rep.Demerits
+	}
+	return rep.Demerits * math.Exp2(-float64(elapsed)/float64(p.HalfLife))
+}
+
+// Fail implements ReputationPolicy. Failures without a weight count as one
+// demerit.
+func (p *DecayPolicy) Fail(rep Reputation, failure Failure, now time.Time) Reputation {
+	weight, ok := p.Weights[failure]
+	if !ok {
+		weight = 1
+	}
+	return Reputation{Demerits: p.Demerits(rep, now) + weight, Updated: now.UnixNano()}
+}
+
+// Pass implements ReputationPolicy.
+func (p *DecayPolicy) Pass(rep Reputation, now time.Time) Reputation {
+	passed := Reputation{Demerits: p.Demerits(rep, now), Updated: now.UnixNano(), Streak: rep.Streak + 1}
+	if p.ForgiveAfter > 0 && passed.Streak >= p.ForgiveAfter {
+		passed.Demerits *= 1 - p.Forgiveness
+		passed.Streak = 0
+	}
+	return passed
+}
+
+// Eject implements ReputationPolicy.
+func (p *DecayPolicy) Eject(rep Reputation, now time.Time) bool {
+	return p.Demerits(rep, now) >= p.Threshold
+}
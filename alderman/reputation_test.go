@@ -0,0 +1,136 @@
+package alderman
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/tusharjois/councilfs/por"
+)
+
+// event is a step of a reputation scenario: a pass, or a failure of the given
+// kind, some time after the previous step.
+type event struct {
+	after   time.Duration
+	pass    bool
+	failure Failure
+}
+
+func TestDecayPolicy(test *testing.T) {
+	day := 24 * time.Hour
+	policy := DefaultReputationPolicy()
+	fail := func(failure Failure, after time.Duration) event { return event{after: after, failure: failure} }
+	pass := func(after time.Duration) event { return event{after: after, pass: true} }
+	passes := func(n int) []event {
+		var events []event
+		for i := 0; i < n; i++ {
+			events = append(events, pass(time.Hour))
+		}
+		return events
+	}
+
+	scenarios := []struct {
+		name     string
+		events   []event
+		demerits float64
+		eject    bool
+	}{
+		{"three quick failures", []event{fail(BadSignature, 0), fail(WrongSegment, day), fail(MalformedTicket, day)}, 2.932, true},
+		{"three failures months apart", []event{fail(BadSignature, 0), fail(BadSignature, 60*day), fail(BadSignature, 60*day)}, 1.3125, false},
+		{"missed challenges count half", []event{fail(NoResponse, 0), fail(NoResponse, 0), fail(NoResponse, 0)}, 1.5, false},
+		{"demerits halve every half-life", []event{fail(BadSignature, 0), fail(BadSignature, 0), pass(30 * day)}, 1, false},
+		{"ten passes forgive", append([]event{fail(BadSignature, 0), fail(BadSignature, 0)}, passes(10)...), 0, false},
+		{"a failure breaks the streak", append(append([]event{fail(BadSignature, 0)}, passes(9)...),
+			append([]event{fail(BadSignature, 0)}, passes(9)...)...), 1.974, false},
+	}
+	for _, scenario := range scenarios {
+		now := time.Unix(1000, 0)
+		var rep Reputation
+		for _, e := range scenario.events {
+			now = now.Add(e.after)
+			if e.pass {
+				rep = policy.Pass(rep, now)
+			} else {
+				rep = policy.Fail(rep, e.failure, now)
+			}
+		}
+		if demerits := policy.Demerits(rep, now); math.Abs(demerits-scenario.demerits) > 0.01 {
+			test.Errorf("%v: %.4f demerits, expected %v", scenario.name, demerits, scenario.demerits)
+		}
+		if policy.Eject(rep, now) != scenario.eject {
+			test.Errorf("%v: ejection is %v, expected %v", scenario.name, !scenario.eject, scenario.eject)
+		}
+	}
+
+	// without a half-life demerits never decay
+	constant := &DecayPolicy{Threshold: 3}
+	rep := constant.Fail(Reputation{}, BadSignature, time.Unix(0, 0))
+	if demerits := constant.Demerits(rep, time.Unix(0, 0).Add(365*day)); demerits != 1 {
+		test.Errorf("%v demerits after a year without decay, expected 1", demerits)
+	}
+}
+
+func TestAldermanReputationPolicy(test *testing.T) {
+	now := time.Unix(1000, 0)
+	alder := New(por.GenerateKey(), func() time.Time { return now })
+	alder.SetReputationPolicy(&DecayPolicy{
+		Threshold:    4,
+		Weights:      map[Failure]float64{WrongSegment: 2, NoResponse: 0.25},
+		ForgiveAfter: 2,
+		Forgiveness:  0.5,
+	})
+	minerKey := por.GenerateKey()
+	minerID := por.Fingerprint(&minerKey.PublicKey)
+	encodedFile, err := por.CreateErasureCoding([]byte("Left Munich at 8:35 P. M., on 1st May"), 2, 4)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	// failures are weighted by the kind of fault in the ticket
+	challenge := alder.IssueChallenge(&minerKey.PublicKey, encodedFile, 2)
+	response := forgeResponse(minerKey, challenge, encodedFile)
+	if _, err := alder.VerifyMiner(challenge, response, encodedFile, true); err != nil {
+		test.Fatal(err)
+	}
+	challenge = alder.IssueChallenge(&minerKey.PublicKey, encodedFile, 2)
+	forged := por.ParseTicket(RespondToChallenge(minerKey, challenge, encodedFile).Ticket)
+	forged.ProofFiles[0].FileSegment = []byte("not a segment")
+	response = NewTicketResponse(minerKey, challenge, por.TicketMarshal(*forged))
+	if _, err := alder.VerifyMiner(challenge, response, encodedFile, true); err != nil {
+		test.Fatal(err)
+	}
+	alder.IssueChallenge(&minerKey.PublicKey, encodedFile, 2)
+	now = now.Add(DefaultResponseWindow + time.Second)
+	if err := alder.RecordTimeout(alder.CheckDeadlines()); err != nil {
+		test.Fatal(err)
+	}
+	if demerits := alder.Demerits(minerID); demerits != 3.25 {
+		test.Errorf("%v demerits, expected 3.25", demerits)
+	}
+
+	// good proofs earn forgiveness
+	for i := 0; i < 2; i++ {
+		challenge := alder.IssueChallenge(&minerKey.PublicKey, encodedFile, 2)
+		response := RespondToChallenge(minerKey, challenge, encodedFile)
+		if passed, err := alder.VerifyMiner(challenge, response, encodedFile, true); err != nil || !passed {
+			test.Fatalf("correct ticket failed to verify")
+		}
+	}
+	if demerits := alder.Demerits(minerID); demerits != 1.625 {
+		test.Errorf("%v demerits after forgiveness, expected 1.625", demerits)
+	}
+	if rep := alder.Reputation(minerID); rep.Streak != 0 {
+		test.Errorf("streak of %v after forgiveness, expected 0", rep.Streak)
+	}
+
+	// miners that never failed have no reputation to keep
+	other := por.GenerateKey()
+	challenge = alder.IssueChallenge(&other.PublicKey, encodedFile, 2)
+	response = RespondToChallenge(other, challenge, encodedFile)
+	if _, err := alder.VerifyMiner(challenge, response, encodedFile, true); err != nil {
+		test.Fatal(err)
+	}
+	if rep := alder.Reputation(por.Fingerprint(&other.PublicKey)); rep != (Reputation{}) {
+		test.Errorf("clean miner has reputation %+v", rep)
+	}
+}
@@ -0,0 +1,209 @@
+package alderman
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tusharjois/councilfs/client"
+)
+
+// Clock returns the current time. It is replaced in tests to control the
+// passing of time.
+type Clock func() time.Time
+
+// scheduledChannel is a channel tracked by a PaymentScheduler along with the
+// last time the client paid on it, and what the client had paid for storage
+// by then.
+type scheduledChannel struct {
+	channel     *client.PaymentChannel
+	lastPaid    time.Time
+	storagePaid uint
+}
+
+// pay resets the timer of the channel to at if the client has paid at least
+// the channel's Payment for storage since the timer was last reset.
+// Payments for shards delivered do not count.
+func (tracked *scheduledChannel) pay(at time.Time) {
+	storagePaid := tracked.channel.StoragePaid()
+	if storagePaid >= tracked.storagePaid+tracked.channel.Payment {
+		tracked.lastPaid = at
+		tracked.storagePaid = storagePaid
+	}
+}
+
+// PaymentScheduler tracks the open channels of an alderman. Whenever verified
+// payments on a channel add up to the channel's Payment for storage its timer
+// is reset, and a channel whose client has not paid within the channel's
+// Interval is closed. It is safe for concurrent use.
+type PaymentScheduler struct {
+	key   *ecdsa.PrivateKey
+	clock Clock
+
+	mu       sync.Mutex
+	channels map[string]*scheduledChannel
+}
+
+// NewPaymentScheduler creates a scheduler that closes channels with the
+// alderman's key, reading the time from clock.
+func NewPaymentScheduler(aldermanKey *ecdsa.PrivateKey, clock Clock) *PaymentScheduler {
+	return &PaymentScheduler{key: aldermanKey, clock: clock, channels: make(map[string]*scheduledChannel)}
+}
+
+func channelKey(channelID []byte) string {
+	return hex.EncodeToString(channelID)
+}
+
+// Track starts tracking payments on a channel, with the client's first
+// payment due one Interval from now.
+func (s *PaymentScheduler) Track(channel *client.PaymentChannel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := channelKey(channel.GetID())
+	if _, present := s.channels[id]; present {
+		return fmt.Errorf("channel %v is already tracked", id)
+	}
+	s.channels[id] = &scheduledChannel{channel: channel, lastPaid: s.clock(), storagePaid: channel.StoragePaid()}
+	return nil
+}
+
+// Untrack stops tracking a channel.
+func (s *PaymentScheduler) Untrack(channelID []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.channels, channelKey(channelID))
+}
+
+// Tracked returns the number of channels being tracked.
+func (s *PaymentScheduler) Tracked() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.channels)
+}
+
+// Receive adds a message from the client to its tracked channel. If the
+// message is a SendPayment that verifies and completes a Payment for storage,
+// the payment timer of the channel is reset. An error is returned if the channel is not tracked or the message is
+// refused by the channel.
+func (s *PaymentScheduler) Receive(msg *client.ChannelMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tracked, present := s.channels[channelKey(msg.GetID())]
+	if !present {
+		return fmt.Errorf("channel %v is not tracked", channelKey(msg.GetID()))
+	}
+	if err := tracked.channel.UpdateMessages(msg); err != nil {
+		return err
+	}
+	if msgType, _, _ := msg.GetPayload(); msgType == client.SendPayment {
+		tracked.pay(s.clock())
+	}
+	return nil
+}
+
+// Check closes every tracked channel whose client has not paid within the
+// channel's Interval, and returns the CloseChannel messages to send to the
+// clients. Closed channels are no longer tracked. A channel that cannot be
+// closed stays tracked, and the first such error is returned once the other
+// channels are closed. The channels are closed holding the scheduler's lock,
+// so a payment received meanwhile either lands before the channel is found
+// lapsed or is refused by the closing channel.
+func (s *PaymentScheduler) Check() ([]client.ChannelMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var closes []client.ChannelMessage
+	var closeErr error
+	for _, channel := range s.lapsed() {
+		closeMessage, err := channel.Close(s.key)
+		if err != nil {
+			if closeErr == nil {
+				closeErr = fmt.Errorf("closing channel %v: %v", channelKey(channel.GetID()), err)
+			}
+			continue
+		}
+		delete(s.channels, channelKey(channel.GetID()))
+		closes = append(closes, closeMessage)
+	}
+	return closes, closeErr
+}
+
+// due returns the tracked channels whose client has not paid within the
+// channel's Interval. Channels that are already closing stop being tracked.
+// The caller must keep payments from being received until it has closed the
+// channels, as the Alderman does by holding its own lock.
+func (s *PaymentScheduler) due() []*client.PaymentChannel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lapsed()
+}
+
+// lapsed is due with s.mu held.
+func (s *PaymentScheduler) lapsed() []*client.PaymentChannel {
+	now := s.clock()
+	var lapsed []*client.PaymentChannel
+	for id, tracked := range s.channels {
+		state, err := tracked.channel.State()
+		if err != nil || state == client.StateClosing || state == client.StateClosed {
+			delete(s.channels, id)
+			continue
+		}
+		if now.Sub(tracked.lastPaid) > tracked.channel.GetInterval() {
+			lapsed = append(lapsed, tracked.channel)
+		}
+	}
+	return lapsed
+}
+
+// trackAt tracks a channel whose client last paid at lastPaid, having paid
+// storagePaid for storage by then, replacing any timer the channel already
+// has.
+func (s *PaymentScheduler) trackAt(channel *client.PaymentChannel, lastPaid time.Time, storagePaid uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.channels[channelKey(channel.GetID())] = &scheduledChannel{channel: channel, lastPaid: lastPaid, storagePaid: storagePaid}
+}
+
+// paid resets the timer of a tracked channel to at, if the client has paid
+// for storage since it was last reset. It reports whether the channel is
+// tracked.
+func (s *PaymentScheduler) paid(channelID []byte, at time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tracked, present := s.channels[channelKey(channelID)]
+	if present {
+		tracked.pay(at)
+	}
+	return present
+}
+
+// lastPayments returns the time of the last payment on every tracked channel,
+// and what the client had paid for storage by then.
+func (s *PaymentScheduler) lastPayments() (map[string]time.Time, map[string]uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payments := make(map[string]time.Time, len(s.channels))
+	storagePaid := make(map[string]uint, len(s.channels))
+	for id, tracked := range s.channels {
+		payments[id] = tracked.lastPaid
+		storagePaid[id] = tracked.storagePaid
+	}
+	return payments, storagePaid
+}
+
+// Run checks the tracked channels every time a value arrives on ticks, such
+// as from a time.Ticker, passes each CloseChannel message to send, and passes
+// the error of a check that failed to close a channel to fail. It returns when
+// ticks is closed.
+func (s *PaymentScheduler) Run(ticks <-chan time.Time, send func(client.ChannelMessage), fail func(error)) {
+	for range ticks {
+		closes, err := s.Check()
+		for _, closeMessage := range closes {
+			send(closeMessage)
+		}
+		if err != nil {
+			fail(err)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package alderman
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/tusharjois/councilfs/client"
+	"github.com/tusharjois/councilfs/transport"
+)
+
+// Server answers the channel messages that clients send to an Alderman over
+// the network. Each message is applied to its channel and answered according
+// to its MessageType. A message the alderman has already applied, resent by a
+// client that did not hear the reply, is answered with the same reply as
+// before. A Server is safe for concurrent use.
+type Server struct {
+	alderman *Alderman
+	k        uint
+
+	// the connection each channel's client last sent a message on, used to
+	// reach the client with the alderman's own messages
+	mu    sync.Mutex
+	conns map[string]*transport.Conn
+}
+
+// NewServer creates a Server for a, which answers PORRequests with proofs over
+// k segments. Funding is checked on the ledger given to a by SetLedger.
+func NewServer(a *Alderman, k uint) *Server {
+	return &Server{alderman: a, k: k, conns: make(map[string]*transport.Conn)}
+}
+
+// Serve accepts connections from clients on l and answers their messages until
+// l is closed. Every connection is a transport.SecureConn, on which the alderman
+// proves the key in AldermanPublicKey, and the client may only send messages
+// on the channels whose ClientPublicKey it proved.
+func (s *Server) Serve(l net.Listener) error {
+	return transport.ServeSecure(l, s.alderman.key, s.handle)
+}
+
+func (s *Server) handle(from *transport.Conn, msg *client.ChannelMessage) (*client.ChannelMessage, error) {
+	if err := s.authorize(from.PeerKey(), msg); err != nil {
+		return nil, err
+	}
+	reply, err := s.Handle(msg)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.conns[channelKey(msg.GetID())] = from
+	s.mu.Unlock()
+	return reply, nil
+}
+
+// authorize checks that msg belongs to a channel of the client whose key peer
+// was proven on the connection that carried it.
+func (s *Server) authorize(peer []byte, msg *client.ChannelMessage) error {
+	if peer == nil {
+		return errors.New("connection is not authenticated")
+	}
+	owner := msg.GetSenderKey()
+	if mType, _, _ := msg.GetPayload(); mType != client.ChannelOpen {
+		channel := s.alderman.Channel(msg.GetID())
+		if channel == nil {
+			return fmt.Errorf("channel %v does not exist", channelKey(msg.GetID()))
+		}
+		owner = channel.ClientPublicKey
+	}
+	if !bytes.Equal(owner, peer) {
+		return errors.New("message is not from the client of its channel")
+	}
+	return nil
+}
+
+// Handle applies a message from a client and returns the alderman's reply, or
+// nil if the message needs none:
+//
+//	ChannelOpen   -> ChannelAccepted
+//	FundsCreated  -> FundsApproved
+//	PORRequest    -> PORResponse
+//	SendPayment   -> nil
+//	ShardRequest  -> ShardResponse
+//	CloseChannel  -> CloseChannel, unless it countersigns the alderman's
+//
+// An error is returned if the message is refused, as a ShardRequest is while
+// the shards already sent on its channel are not paid for.
+func (s *Server) Handle(msg *client.ChannelMessage) (*client.ChannelMessage, error) {
+	a := s.alderman
+	mType, _, err := msg.GetPayload()
+	if err != nil {
+		return nil, err
+	}
+	reply, seen, latest := a.replay(msg)
+	if reply != nil || (seen && !latest) {
+		return reply, nil
+	}
+
+	if mType == client.ChannelOpen {
+		_, accepted, err := a.AcceptChannel(*msg)
+		if err != nil {
+			return nil, err
+		}
+		return &accepted, nil
+	}
+	switch mType {
+	case client.FundsCreated, client.PORRequest, client.SendPayment, client.ShardRequest, client.CloseChannel:
+	default:
+		return nil, fmt.Errorf("aldermen do not accept %v messages", mType)
+	}
+	// a message that was applied but not answered is answered now
+	if !seen {
+		if err := a.Receive(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	var response client.ChannelMessage
+	switch mType {
+	case client.FundsCreated:
+		a.mu.Lock()
+		l := a.ledger
+		a.mu.Unlock()
+		if l == nil {
+			return nil, errors.New("alderman has no ledger to check funding on")
+		}
+		response, err = a.ApproveFunding(msg.GetID(), l)
+	case client.PORRequest:
+		response, err = a.RespondToPOR(msg.GetID(), s.k)
+	case client.SendPayment:
+		return nil, nil
+	case client.ShardRequest:
+		response, err = a.SendShards(msg.GetID())
+	case client.CloseChannel:
+		channel := a.Channel(msg.GetID())
+		if state, _ := channel.State(); state != client.StateClosing {
+			return nil, nil
+		}
+		response, err = a.CloseChannel(msg.GetID())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// replay looks for a message from a client among the messages of its channel.
+// If msg was already applied, seen is true, latest reports whether it is the
+// most recent message of the channel, and reply is the alderman's message that
+// followed it, if there is one.
+func (a *Alderman) replay(msg *client.ChannelMessage) (reply *client.ChannelMessage, seen bool, latest bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	channel, ok := a.channels[channelKey(msg.GetID())]
+	if !ok || !bytes.Equal(msg.GetSenderKey(), channel.ClientPublicKey) {
+		return nil, false, false
+	}
+	hash := msg.Hash()
+	for i, applied := range channel.Messages {
+		if applied.Hash() != hash {
+			continue
+		}
+		if i+1 == len(channel.Messages) {
+			return nil, true, true
+		}
+		next := channel.Messages[i+1]
+		if bytes.Equal(next.GetSenderKey(), msg.GetSenderKey()) {
+			return nil, true, false
+		}
+		copied := *next
+		return &copied, true, false
+	}
+	return nil, false, false
+}
+
+// CheckPayments closes every channel whose client has not paid in time, as
+// Alderman.CheckPayments does, and sends the CloseChannel messages to the
+// clients that are connected. A client that countersigns the close in its
+// reply closes the channel. An error is returned if a close cannot be
+// persisted, delivered, or its countersignature applied; the other closes are
+// still sent, and the error names every channel that failed.
+func (s *Server) CheckPayments() error {
+	closes, err := s.alderman.CheckPayments()
+	var failures []string
+	if err != nil {
+		failures = append(failures, err.Error())
+	}
+	for i := range closes {
+		closeMessage := &closes[i]
+		id := channelKey(closeMessage.GetID())
+		s.mu.Lock()
+		conn := s.conns[id]
+		s.mu.Unlock()
+		if conn == nil {
+			continue
+		}
+		reply, err := conn.Call(closeMessage, transport.DefaultTimeout)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("close of channel %v not delivered: %v", id, err))
+			continue
+		}
+		if reply != nil {
+			if err := s.alderman.Receive(reply); err != nil {
+				failures = append(failures, fmt.Sprintf("countersigned close of channel %v rejected: %v", id, err))
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package alderman
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tusharjois/councilfs/client"
+	"github.com/tusharjois/councilfs/ledger"
+	"github.com/tusharjois/councilfs/por"
+	"github.com/tusharjois/councilfs/transport"
+)
+
+// callAlderman sends a client message over the network and adds the reply to
+// the client's channel.
+func callAlderman(test *testing.T, conn *transport.Client, pay *client.PaymentChannel, msg client.ChannelMessage) *client.ChannelMessage {
+	reply, err := conn.Call(&msg)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if reply != nil {
+		if err := pay.UpdateMessages(reply); err != nil {
+			test.Fatal(err)
+		}
+	}
+	return reply
+}
+
+// countersign answers the alderman's CloseChannel with the client's own.
+func countersign(pay *client.PaymentChannel, clientKey *ecdsa.PrivateKey) transport.Handler {
+	return func(from *transport.Conn, msg *client.ChannelMessage) (*client.ChannelMessage, error) {
+		if err := pay.UpdateMessages(msg); err != nil {
+			return nil, err
+		}
+		closeMessage, err := pay.Close(clientKey)
+		if err != nil {
+			return nil, err
+		}
+		return &closeMessage, nil
+	}
+}
+
+func TestServer(test *testing.T) {
+	const k uint = 2
+	now := time.Unix(1000, 0)
+	alder := New(por.GenerateKey(), func() time.Time { return now })
+	memLedger := ledger.NewMemory()
+	alder.SetLedger(memLedger)
+	server := NewServer(alder, k)
+	listener := transport.NewPipeListener()
+	defer listener.Close()
+	go server.Serve(listener)
+
+	encodedFile, err := por.CreateErasureCoding([]byte("Left Munich at 8:35 P. M., on 1st May"), 2, 4)
+	if err != nil {
+		test.Fatal(err)
+	}
+	clientKey := por.GenerateKey()
+	clientchannel, openMsg, _ := client.OpenChannel(clientKey, alder.PublicKey(), 20, time.Minute, encodedFile)
+	dial := transport.SecureDialer(listener.Dial, clientKey, clientchannel.AldermanPublicKey)
+	conn := transport.NewClient(dial, countersign(clientchannel, clientKey))
+	defer conn.Close()
+
+	if reply := callAlderman(test, conn, clientchannel, openMsg); reply == nil {
+		test.Fatal("channel open was not accepted")
+	}
+	if err := alder.StoreShards(clientchannel.GetID(), encodedFile); err != nil {
+		test.Fatal(err)
+	}
+	fundsMsg, err := clientchannel.CreateFunding(clientKey, memLedger, 100)
+	if err != nil {
+		test.Fatal(err)
+	}
+	callAlderman(test, conn, clientchannel, fundsMsg)
+	requestMsg, err := clientchannel.RequestPOR(clientKey, k)
+	if err != nil {
+		test.Fatal(err)
+	}
+	response := callAlderman(test, conn, clientchannel, requestMsg)
+
+	// a request resent after a lost reply is answered the same way again
+	resent, err := conn.Call(&requestMsg)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if resent == nil || resent.Hash() != response.Hash() {
+		test.Errorf("resent PORRequest was not answered with the same PORResponse")
+	}
+
+	paymentMsg, err := clientchannel.VerifyPOR(clientKey, k)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if reply := callAlderman(test, conn, clientchannel, paymentMsg); reply != nil {
+		test.Errorf("payment answered with %v", reply)
+	}
+	if _, err := conn.Call(&paymentMsg); err != nil {
+		test.Errorf("resent payment refused: %v", err)
+	}
+	alderchannel := alder.Channel(clientchannel.GetID())
+	if paid, _ := alderchannel.Balance(); paid != 20 {
+		test.Errorf("alderman sees %v paid, expected 20", paid)
+	}
+	if len(alderchannel.Messages) != len(clientchannel.Messages) {
+		test.Errorf("alderman holds %v messages, client %v", len(alderchannel.Messages), len(clientchannel.Messages))
+	}
+
+	// the client downloads its file back over the channel, paying for each
+	// shard, and only for the shards it needs
+	alder.SetShardPrice(2)
+	manifest := encodedFile.Manifest()
+	var file bytes.Buffer
+	retrieval, err := client.Download(clientKey, &manifest, []client.Source{{Channel: clientchannel, Peer: conn}}, 2, &file)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if errs := retrieval.Wait(); errs[0] != nil {
+		test.Error(errs[0])
+	}
+	if file.String() != "Left Munich at 8:35 P. M., on 1st May" {
+		test.Errorf("downloaded %q", file.String())
+	}
+	if paid, _ := alderchannel.Balance(); paid != uint(20+2*manifest.DataShards) {
+		test.Errorf("alderman sees %v paid, expected %v", paid, 20+2*manifest.DataShards)
+	}
+
+	// another client cannot send on the channel, nor reach an alderman that
+	// does not prove the channel's key
+	intruderKey := por.GenerateKey()
+	intruder := transport.NewClient(transport.SecureDialer(listener.Dial, intruderKey, clientchannel.AldermanPublicKey), nil)
+	defer intruder.Close()
+	if _, err := intruder.Call(&paymentMsg); err == nil {
+		test.Errorf("alderman accepted a payment from a client other than the channel's")
+	}
+	impostor := transport.NewClient(transport.SecureDialer(listener.Dial, clientKey, marshalKey(&intruderKey.PublicKey)), nil)
+	impostor.Attempts = 1
+	if _, err := impostor.Call(&paymentMsg); err != transport.ErrUnexpectedPeer {
+		test.Errorf("expected transport.ErrUnexpectedPeer from the wrong alderman, got %v", err)
+	}
+
+	// a message the alderman never answers is refused
+	if _, err := conn.Call(response); err == nil {
+		test.Errorf("alderman accepted its own PORResponse")
+	}
+
+	// a client that refuses its close is reported, without keeping the
+	// others from closing
+	refuserKey := por.GenerateKey()
+	refuserchannel, refuserOpen, _ := client.OpenChannel(refuserKey, alder.PublicKey(), 20, time.Minute, encodedFile)
+	refuse := func(from *transport.Conn, msg *client.ChannelMessage) (*client.ChannelMessage, error) {
+		return nil, errors.New("close refused")
+	}
+	refuser := transport.NewClient(transport.SecureDialer(listener.Dial, refuserKey, refuserchannel.AldermanPublicKey), refuse)
+	defer refuser.Close()
+	callAlderman(test, refuser, refuserchannel, refuserOpen)
+	refuserFunds, err := refuserchannel.CreateFunding(refuserKey, memLedger, 100)
+	if err != nil {
+		test.Fatal(err)
+	}
+	callAlderman(test, refuser, refuserchannel, refuserFunds)
+
+	// the alderman closes the lapsed channels, and the client countersigns
+	now = now.Add(2 * time.Minute)
+	err = server.CheckPayments()
+	if err == nil || !strings.Contains(err.Error(), channelKey(refuserchannel.GetID())) {
+		test.Fatalf("refused close was not reported: %v", err)
+	}
+	if strings.Contains(err.Error(), channelKey(clientchannel.GetID())) {
+		test.Errorf("countersigned close was reported: %v", err)
+	}
+	if state, _ := alderchannel.State(); state != client.StateClosed {
+		test.Errorf("alderman's channel in state %v, expected %v", state, client.StateClosed)
+	}
+	if state, _ := clientchannel.State(); state != client.StateClosed {
+		test.Errorf("client's channel in state %v, expected %v", state, client.StateClosed)
+	}
+}
@@ -0,0 +1,300 @@
+package alderman
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/tusharjois/councilfs/client"
+	"github.com/tusharjois/councilfs/por"
+)
+
+const (
+	walName      = "alderman.wal"
+	snapshotName = "alderman.snapshot"
+)
+
+// recordType identifies the update of the alderman's state described by a
+// record in the write-ahead log.
+type recordType int8
+
+const (
+	// recordAccept adds a newly accepted Channel.
+	recordAccept recordType = iota
+
+	// recordMessage adds a Message to the channel ChannelID. If Time is set,
+	// the payment timer of the channel is reset to Time, provided the Message
+	// completes a Payment for storage.
+	recordMessage
+
+	// recordFunding adds the FundsApproved Message to the channel ChannelID,
+	// records its FundingID and Amount, and starts its payment timer at Time.
+	recordFunding
+
+	// recordUntrack stops the payment timer of the channel ChannelID.
+	recordUntrack
+
+	// recordDemerits sets the Reputation of the miner with fingerprint Miner,
+	// and adds the Evidence of the failure that changed it, if there is any.
+	recordDemerits
+
+	// recordShards stores the Encoding assigned to the channel ChannelID.
+	recordShards
+
+	// recordJudged marks the challenge with hex digest Challenge as counted,
+	// whether it was answered or timed out.
+	recordJudged
+)
+
+// record is a single update of the alderman's state. Records are numbered by
+// Seq in the order they are logged.
+type record struct {
+	Seq        uint64
+	Type       recordType
+	ChannelID  []byte                 `json:",omitempty"`
+	Channel    *client.PaymentChannel `json:",omitempty"`
+	Message    *client.ChannelMessage `json:",omitempty"`
+	Encoding   *por.EncodedDataset    `json:",omitempty"`
+	FundingID  []byte                 `json:",omitempty"`
+	Amount     uint                   `json:",omitempty"`
+	Time       int64                  `json:",omitempty"`
+	Miner      string                 `json:",omitempty"`
+	Reputation *Reputation            `json:",omitempty"`
+	Evidence   *FailureEvidence       `json:",omitempty"`
+	Challenge  string                 `json:",omitempty"`
+}
+
+// storedState is the snapshot of the alderman's state, including every record
+// up to LastSeq. Tracked holds the time, in Unix nanoseconds, of the last
+// payment on every channel with a payment timer, StoragePaid what the client
+// had paid for storage by then, and Judged the hex digest of every challenge
+// already counted.
+type storedState struct {
+	LastSeq     uint64
+	Channels    map[string]*client.PaymentChannel
+	Tracked     map[string]int64
+	StoragePaid map[string]uint
+	Reputations map[string]Reputation
+	Evidence    map[string][]FailureEvidence
+	Judged      map[string]bool
+}
+
+// Store persists the state of an Alderman in a directory, as a snapshot of the
+// state plus a write-ahead log of the updates made since the snapshot. Every
+// update is synced to the log before it takes effect, so that the state can
+// be recovered after a crash. A record that was only partly written when the
+// process died is discarded on recovery; one that could not be written while
+// the process ran is cut from the log, and if it cannot be, the store fails
+// every later update.
+type Store struct {
+	dir     string
+	wal     *os.File
+	nextSeq uint64
+	failed  error
+}
+
+// OpenStore opens the store in dir, creating it if it does not exist, and
+// returns the snapshot and the records logged after it. Records already in
+// the snapshot, left behind by a crash while the snapshot was written, are
+// skipped.
+func OpenStore(dir string) (*Store, *storedState, []*record, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, nil, err
+	}
+
+	state := &storedState{
+		Channels:    make(map[string]*client.PaymentChannel),
+		Tracked:     make(map[string]int64),
+		StoragePaid: make(map[string]uint),
+		Reputations: make(map[string]Reputation),
+		Evidence:    make(map[string][]FailureEvidence),
+		Judged:      make(map[string]bool),
+	}
+	snapshot, err := ioutil.ReadFile(filepath.Join(dir, snapshotName))
+	if err == nil {
+		if err := json.Unmarshal(snapshot, state); err != nil {
+			return nil, nil, nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	records, valid, err := readRecords(wal)
+	if err != nil {
+		wal.Close()
+		return nil, nil, nil, err
+	}
+	// drop any record torn by a crash, so new records follow the valid ones
+	if err := wal.Truncate(valid); err != nil {
+		wal.Close()
+		return nil, nil, nil, err
+	}
+	if _, err := wal.Seek(valid, io.SeekStart); err != nil {
+		wal.Close()
+		return nil, nil, nil, err
+	}
+	store := &Store{dir: dir, wal: wal, nextSeq: state.LastSeq + 1}
+	var pending []*record
+	for _, rec := range records {
+		if rec.Seq > state.LastSeq {
+			pending = append(pending, rec)
+			store.nextSeq = rec.Seq + 1
+		}
+	}
+	return store, state, pending, nil
+}
+
+// readRecords reads the records of a write-ahead log, stopping at the first
+// record that is incomplete or corrupt. It returns the records and the length
+// of the log they take up.
+func readRecords(wal *os.File) ([]*record, int64, error) {
+	contents, err := ioutil.ReadAll(wal)
+	if err != nil {
+		return nil, 0, err
+	}
+	var records []*record
+	var offset int64
+	reader := bytes.NewReader(contents)
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			break
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		if uint64(length) > uint64(reader.Len()) {
+			break
+		}
+		body := make([]byte, length)
+		io.ReadFull(reader, body)
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+			break
+		}
+		rec := new(record)
+		if err := json.Unmarshal(body, rec); err != nil {
+			break
+		}
+		records = append(records, rec)
+		offset += int64(len(header)) + int64(length)
+	}
+	return records, offset, nil
+}
+
+// Append numbers a record, writes it to the write-ahead log and syncs it to
+// disk. If the record cannot be written whole, the log is cut back to where it
+// ended before.
+func (s *Store) Append(rec *record) error {
+	if s.failed != nil {
+		return s.failed
+	}
+	rec.Seq = s.nextSeq
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(body))
+	frame = append(frame, body...)
+	offset, err := s.wal.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := s.wal.Write(frame); err != nil {
+		s.rollback(offset)
+		return err
+	}
+	if err := s.wal.Sync(); err != nil {
+		s.rollback(offset)
+		return err
+	}
+	s.nextSeq++
+	return nil
+}
+
+// rollback cuts the write-ahead log back to offset, dropping a record that
+// was not written whole. If the log cannot be cut, records appended after it
+// could be lost with it on recovery, so the store fails.
+func (s *Store) rollback(offset int64) {
+	if err := s.wal.Truncate(offset); err != nil {
+		s.failed = fmt.Errorf("store failed: %v", err)
+		return
+	}
+	if _, err := s.wal.Seek(offset, io.SeekStart); err != nil {
+		s.failed = fmt.Errorf("store failed: %v", err)
+	}
+}
+
+// WriteSnapshot replaces the snapshot with state and empties the write-ahead
+// log. The new snapshot is written beside the old one and renamed over it, so
+// a crash leaves either the old snapshot and log or the new snapshot.
+func (s *Store) WriteSnapshot(state *storedState) error {
+	state.LastSeq = s.nextSeq - 1
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmpName := filepath.Join(s.dir, snapshotName+".tmp")
+	tmp, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(encoded); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, filepath.Join(s.dir, snapshotName)); err != nil {
+		return err
+	}
+	// the rename is durable only once the directory is synced, and the log
+	// must not be emptied before
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+	if err := s.wal.Truncate(0); err != nil {
+		return err
+	}
+	_, err = s.wal.Seek(0, io.SeekStart)
+	return err
+}
+
+// syncDir syncs the directory dir to disk, along with the names of the files
+// it holds.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// Close closes the write-ahead log.
+func (s *Store) Close() error {
+	if s.wal == nil {
+		return errors.New("store is already closed")
+	}
+	err := s.wal.Close()
+	s.wal = nil
+	return err
+}
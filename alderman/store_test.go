@@ -0,0 +1,253 @@
+package alderman
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tusharjois/councilfs/client"
+	"github.com/tusharjois/councilfs/por"
+)
+
+func TestStoreRecovery(test *testing.T) {
+	dir, err := ioutil.TempDir("", "alderman")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+	aldermanKey := por.GenerateKey()
+	alder, err := Open(aldermanKey, clock, dir)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	clientchannel, clientKey := openFundedChannel(test, alder, time.Minute)
+	channelID := clientchannel.GetID()
+	now = now.Add(30 * time.Second)
+	payment, err := clientchannel.SendPayment(clientKey, 20)
+	if err != nil {
+		test.Fatal(err)
+	}
+	SendToAlderman(alder, payment)
+	if err := alder.StoreShards(channelID, clientchannel.Encoding); err != nil {
+		test.Fatal(err)
+	}
+	challenge := alder.IssueChallenge(&clientKey.PublicKey, clientchannel.Encoding, 2)
+	response := forgeResponse(clientKey, challenge, clientchannel.Encoding)
+	if _, err := alder.VerifyMiner(challenge, response, clientchannel.Encoding, true); err != nil {
+		test.Fatal(err)
+	}
+	minerID := por.Fingerprint(&clientKey.PublicKey)
+	issuerKey := por.GenerateKey()
+	foreign := NewChallenge(issuerKey, &clientKey.PublicKey, clientchannel.Encoding, 2, now.Unix(), now.Add(time.Hour).Unix())
+	response = forgeResponse(clientKey, foreign, clientchannel.Encoding)
+	if _, err := alder.VerifyMiner(foreign, response, clientchannel.Encoding, true); err != nil {
+		test.Fatal(err)
+	}
+	if err := alder.Close(); err != nil {
+		test.Fatal(err)
+	}
+
+	// everything is recovered from the write-ahead log
+	recovered, err := Open(aldermanKey, clock, dir)
+	if err != nil {
+		test.Fatal(err)
+	}
+	recoveredChannel := recovered.Channel(channelID)
+	if recoveredChannel == nil {
+		test.Fatalf("channel was not recovered")
+	}
+	if !reflect.DeepEqual(recoveredChannel.Messages, clientchannel.Messages) {
+		test.Errorf("recovered messages differ from the client's")
+	}
+	if paid, _ := recoveredChannel.Balance(); paid != 20 {
+		test.Errorf("recovered balance is %v, expected 20", paid)
+	}
+	if recoveredChannel.Encoding == nil || recoveredChannel.Encoding.Length() != clientchannel.Encoding.Length() {
+		test.Errorf("assigned shards were not recovered")
+	}
+	if recovered.Demerits(minerID) != 2 {
+		test.Errorf("recovered %v demerits, expected 2", recovered.Demerits(minerID))
+	}
+	if evidence := recovered.Evidence(minerID); len(evidence) != 2 || evidence[0].Verify() != nil {
+		test.Errorf("recovered %v pieces of evidence, expected 2 valid ones", len(evidence))
+	}
+
+	// a challenge already judged is not judged again
+	response = forgeResponse(clientKey, foreign, clientchannel.Encoding)
+	if _, err := recovered.VerifyMiner(foreign, response, clientchannel.Encoding, true); err == nil {
+		test.Errorf("challenge judged again after recovery")
+	}
+	if recovered.Demerits(minerID) != 2 {
+		test.Errorf("%v demerits after judging a challenge again, expected 2", recovered.Demerits(minerID))
+	}
+
+	// the payment timer resumes from the last payment
+	now = now.Add(50 * time.Second)
+	if closes, err := recovered.CheckPayments(); err != nil || len(closes) != 0 {
+		test.Errorf("recovered channel closed before its payment was due")
+	}
+
+	// an update torn by a crash is discarded on recovery
+	walPath := filepath.Join(dir, walName)
+	before, err := ioutil.ReadFile(walPath)
+	if err != nil {
+		test.Fatal(err)
+	}
+	payment, err = clientchannel.SendPayment(clientKey, 20)
+	if err != nil {
+		test.Fatal(err)
+	}
+	SendToAlderman(recovered, payment)
+	after, err := ioutil.ReadFile(walPath)
+	if err != nil {
+		test.Fatal(err)
+	}
+	recovered.Close()
+	torn := after[:len(before)+(len(after)-len(before))/2]
+	if err := ioutil.WriteFile(walPath, torn, 0600); err != nil {
+		test.Fatal(err)
+	}
+	recovered, err = Open(aldermanKey, clock, dir)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if paid, _ := recovered.Channel(channelID).Balance(); paid != 20 {
+		test.Errorf("balance after torn update is %v, expected 20", paid)
+	}
+
+	// the update can be made again after recovery
+	SendToAlderman(recovered, payment)
+	recovered.Close()
+	recovered, err = Open(aldermanKey, clock, dir)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if paid, _ := recovered.Channel(channelID).Balance(); paid != 40 {
+		test.Errorf("balance after repeated update is %v, expected 40", paid)
+	}
+
+	// once the payment lapses, the close is recovered too
+	now = now.Add(2 * time.Minute)
+	closes, err := recovered.CheckPayments()
+	if err != nil || len(closes) != 1 {
+		test.Fatalf("expected one close, got %v (%v)", len(closes), err)
+	}
+	recovered.Close()
+	recovered, err = Open(aldermanKey, clock, dir)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer recovered.Close()
+	if state, _ := recovered.Channel(channelID).State(); state != client.StateClosing {
+		test.Errorf("recovered channel in state %v, expected %v", state, client.StateClosing)
+	}
+	if closes, _ := recovered.CheckPayments(); len(closes) != 0 {
+		test.Errorf("closed channel was closed again after recovery")
+	}
+
+	// a judgement that cannot be logged is reported, and changes nothing
+	demerits := recovered.Demerits(minerID)
+	recovered.Close()
+	challenge = recovered.IssueChallenge(&clientKey.PublicKey, clientchannel.Encoding, 2)
+	response = forgeResponse(clientKey, challenge, clientchannel.Encoding)
+	if _, err := recovered.VerifyMiner(challenge, response, clientchannel.Encoding, true); err == nil {
+		test.Errorf("judgement without a store was not reported")
+	}
+	if recovered.Demerits(minerID) != demerits {
+		test.Errorf("%v demerits after an unlogged judgement, expected %v", recovered.Demerits(minerID), demerits)
+	}
+}
+
+func TestStoreSnapshotCrash(test *testing.T) {
+	dir, err := ioutil.TempDir("", "alderman")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	aldermanKey := por.GenerateKey()
+	alder, err := Open(aldermanKey, time.Now, dir)
+	if err != nil {
+		test.Fatal(err)
+	}
+	clientchannel, clientKey := openFundedChannel(test, alder, time.Minute)
+	payment, err := clientchannel.SendPayment(clientKey, 20)
+	if err != nil {
+		test.Fatal(err)
+	}
+	SendToAlderman(alder, payment)
+
+	// crash after the snapshot is written but before the log is emptied
+	walPath := filepath.Join(dir, walName)
+	wal, err := ioutil.ReadFile(walPath)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if err := alder.Snapshot(); err != nil {
+		test.Fatal(err)
+	}
+	alder.Close()
+	if err := ioutil.WriteFile(walPath, wal, 0600); err != nil {
+		test.Fatal(err)
+	}
+
+	recovered, err := Open(aldermanKey, time.Now, dir)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer recovered.Close()
+	if !reflect.DeepEqual(recovered.Channel(clientchannel.GetID()).Messages, clientchannel.Messages) {
+		test.Errorf("records already in the snapshot were applied again")
+	}
+}
+
+func TestStoreFailedAppend(test *testing.T) {
+	dir, err := ioutil.TempDir("", "alderman")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, _, _, err := OpenStore(dir)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if err := store.Append(&record{Type: recordUntrack, ChannelID: []byte("channel")}); err != nil {
+		test.Fatal(err)
+	}
+
+	// a log that can be neither written nor cut fails the store for good
+	walPath := filepath.Join(dir, walName)
+	writable := store.wal
+	readOnly, err := os.Open(walPath)
+	if err != nil {
+		test.Fatal(err)
+	}
+	store.wal = readOnly
+	if err := store.Append(&record{Type: recordUntrack, ChannelID: []byte("channel")}); err == nil {
+		test.Errorf("record appended to a read-only log")
+	}
+	readOnly.Close()
+	store.wal = writable
+	if err := store.Append(&record{Type: recordUntrack, ChannelID: []byte("channel")}); err == nil {
+		test.Errorf("record appended after the store failed")
+	}
+	store.Close()
+
+	// only the record written whole is recovered
+	recovered, _, records, err := OpenStore(dir)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer recovered.Close()
+	if len(records) != 1 || records[0].Seq != 1 {
+		test.Errorf("recovered %v records, expected the first", len(records))
+	}
+}
@@ -0,0 +1,207 @@
+package alderman
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tusharjois/councilfs/por"
+)
+
+// DefaultResponseWindow is the time a miner has to answer a challenge.
+const DefaultResponseWindow = 30 * time.Second
+
+// TimeoutObservation is an alderman's signed statement that, at ObservedAt,
+// after the deadline of Challenge, it held no answer to the challenge from
+// the miner. The issuer of a challenge observes a timeout directly; other
+// aldermen corroborate it by relaying the challenge to the miner themselves.
+type TimeoutObservation struct {
+	Challenge  Challenge
+	Observer   []byte
+	ObservedAt int64
+	Signature  []byte
+}
+
+func (o *TimeoutObservation) digest() [sha256.Size]byte {
+	challenge := o.Challenge.Digest()
+	var observedAt [8]byte
+	binary.BigEndian.PutUint64(observedAt[:], uint64(o.ObservedAt))
+	return sha256.Sum256(append(append(append([]byte{}, challenge[:]...), o.Observer...), observedAt[:]...))
+}
+
+// Verify checks that the observation is signed by its observer, is about a
+// challenge signed by its issuer, and was made after the deadline.
+func (o *TimeoutObservation) Verify() error {
+	if err := o.Challenge.Verify(); err != nil {
+		return err
+	}
+	if !pastDeadline(time.Unix(o.ObservedAt, 0), &o.Challenge) {
+		return errors.New("timeout observed before the deadline passed")
+	}
+	return verifySignature(o.Observer, o.digest(), o.Signature)
+}
+
+// pastDeadline reports whether an answer to challenge is late at now. The
+// deadline is in whole seconds, so answers are on time throughout its second.
+func pastDeadline(now time.Time, challenge *Challenge) bool {
+	return now.Unix() > challenge.Deadline
+}
+
+func newTimeoutObservation(key *ecdsa.PrivateKey, challenge *Challenge, now time.Time) *TimeoutObservation {
+	observation := &TimeoutObservation{
+		Challenge:  *challenge,
+		Observer:   marshalKey(&key.PublicKey),
+		ObservedAt: now.Unix(),
+	}
+	digest := observation.digest()
+	observation.Signature = por.SignAndMarshal(key, digest[:])
+	return observation
+}
+
+// Relay forwards a challenge to the miner it was issued to and returns its
+// answer, or an error if the miner cannot be reached or does not answer.
+type Relay func(challenge *Challenge) (*TicketResponse, error)
+
+// SetResponseWindow sets the time miners have to answer the challenges the
+// alderman issues from now on.
+func (a *Alderman) SetResponseWindow(window time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.responseWindow = window
+}
+
+// answered marks challenge as judged if it is answered by its deadline, and
+// returns an error if it is late or was judged already. A challenge issued by
+// the alderman must also still be outstanding, and no longer is; challenges
+// issued by other aldermen are judged by their deadline alone.
+func (a *Alderman) answered(challenge *Challenge) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if pastDeadline(a.clock(), challenge) {
+		return errors.New("challenge deadline has passed")
+	}
+	digest := challenge.Digest()
+	id := hex.EncodeToString(digest[:])
+	if _, ok := a.outstanding[id]; !ok && por.FingerprintPKIX(challenge.Issuer) == por.Fingerprint(&a.key.PublicKey) {
+		return errors.New("challenge is not outstanding")
+	}
+	if err := a.judge(id); err != nil {
+		return err
+	}
+	delete(a.outstanding, id)
+	return nil
+}
+
+// judge records that the challenge with hex digest id is counted, so that it
+// is never counted again. It returns an error if the challenge was already
+// counted, or the record cannot be logged. The caller must hold a.mu.
+func (a *Alderman) judge(id string) error {
+	if a.judged[id] {
+		return errors.New("challenge already judged")
+	}
+	if err := a.persist(&record{Type: recordJudged, Challenge: id}); err != nil {
+		return err
+	}
+	a.judged[id] = true
+	return nil
+}
+
+// CheckDeadlines returns an observation, signed by the alderman, of every
+// challenge it issued whose deadline passed without an answer. The challenges
+// are no longer outstanding. To count against the miner, an observation must
+// be corroborated by other aldermen and passed to RecordTimeout.
+func (a *Alderman) CheckDeadlines() []*TimeoutObservation {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.clock()
+	var observations []*TimeoutObservation
+	for id, challenge := range a.outstanding {
+		if pastDeadline(now, challenge) {
+			observations = append(observations, newTimeoutObservation(a.key, challenge, now))
+			delete(a.outstanding, id)
+		}
+	}
+	return observations
+}
+
+// Corroborate checks an observation made by another alderman by relaying its
+// challenge to the miner. If the miner answers, it is available after all, and
+// its response is returned instead of an observation. Otherwise the alderman
+// returns its own observation of the timeout.
+func (a *Alderman) Corroborate(observation *TimeoutObservation, relay Relay) (*TimeoutObservation, *TicketResponse, error) {
+	if err := observation.Verify(); err != nil {
+		return nil, nil, err
+	}
+	now := a.clock()
+	if !pastDeadline(now, &observation.Challenge) {
+		return nil, nil, errors.New("challenge deadline has not passed")
+	}
+	if response, err := relay(&observation.Challenge); err == nil && response.Verify(&observation.Challenge) == nil {
+		return nil, response, nil
+	}
+	return newTimeoutObservation(a.key, &observation.Challenge, now), nil, nil
+}
+
+// timeoutQuorum returns the number of aldermen that must observe a timeout
+// before it counts. With a council of n members, of which f may be faulty,
+// f+1 observers include at least one honest one.
+func (a *Alderman) timeoutQuorum() int {
+	a.mu.Lock()
+	council := a.council
+	a.mu.Unlock()
+	if council == nil {
+		return 1
+	}
+	return (len(council.Members())-1)/3 + 1
+}
+
+// RecordTimeout counts a challenge issued by the alderman as unanswered, once
+// it holds observations of the timeout from enough aldermen of its council.
+// The miner then fails the challenge with NoResponse. Each challenge counts
+// at most once, whether answered or not, even across restarts.
+func (a *Alderman) RecordTimeout(observations []*TimeoutObservation) error {
+	if len(observations) == 0 {
+		return errors.New("no observations")
+	}
+	challenge := &observations[0].Challenge
+	digest := challenge.Digest()
+	if por.FingerprintPKIX(challenge.Issuer) != por.Fingerprint(&a.key.PublicKey) {
+		return errors.New("challenge was not issued by this alderman")
+	}
+	a.mu.Lock()
+	council := a.council
+	a.mu.Unlock()
+	observers := make(map[string]bool)
+	for i, observation := range observations {
+		if observation.Challenge.Digest() != digest {
+			return fmt.Errorf("observation %v is of another challenge", i)
+		}
+		if err := observation.Verify(); err != nil {
+			return fmt.Errorf("observation %v: %v", i, err)
+		}
+		observer := por.FingerprintPKIX(observation.Observer)
+		if council != nil && !council.IsMember(observer) {
+			return fmt.Errorf("observation %v is from outside the council", i)
+		}
+		observers[observer] = true
+	}
+	if quorum := a.timeoutQuorum(); len(observers) < quorum {
+		return fmt.Errorf("timeout observed by %v aldermen, need %v", len(observers), quorum)
+	}
+
+	id := hex.EncodeToString(digest[:])
+	a.mu.Lock()
+	err := a.judge(id)
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if council != nil {
+		council.Registry().RecordChallenge(por.FingerprintPKIX(challenge.Miner), false)
+	}
+	return a.recordFailure(challenge.Miner, NoResponse, nil)
+}
@@ -0,0 +1,120 @@
+package alderman
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tusharjois/councilfs/por"
+)
+
+func TestChallengeTimeout(test *testing.T) {
+	now := time.Unix(1000, 0)
+	aldermen, _, _ := newTestCouncil(4, func() time.Time { return now })
+	issuer := aldermen[0]
+	encodedFile, err := por.CreateErasureCoding([]byte("Left Munich at 8:35 P. M., on 1st May"), 2, 4)
+	if err != nil {
+		test.Fatal(err)
+	}
+	minerKey := por.GenerateKey()
+	minerID := por.Fingerprint(&minerKey.PublicKey)
+	unreachable := func(challenge *Challenge) (*TicketResponse, error) {
+		return nil, errors.New("miner unreachable")
+	}
+
+	// a challenge answered in time is not outstanding
+	answered := issuer.IssueChallenge(&minerKey.PublicKey, encodedFile, 2)
+	now = now.Add(DefaultResponseWindow / 2)
+	response := RespondToChallenge(minerKey, answered, encodedFile)
+	if passed, err := issuer.VerifyMiner(answered, response, encodedFile, true); err != nil || !passed {
+		test.Fatalf("correct ticket failed to verify")
+	}
+
+	// a late answer does not count
+	late := issuer.IssueChallenge(&minerKey.PublicKey, encodedFile, 2)
+	if observations := issuer.CheckDeadlines(); len(observations) != 0 {
+		test.Errorf("%v timeouts observed before the deadline", len(observations))
+	}
+	now = now.Add(DefaultResponseWindow + time.Second)
+	response = RespondToChallenge(minerKey, late, encodedFile)
+	if _, err := issuer.VerifyMiner(late, response, encodedFile, true); err == nil {
+		test.Errorf("late answer verified")
+	}
+	observations := issuer.CheckDeadlines()
+	if len(observations) != 1 || observations[0].Verify() != nil {
+		test.Fatalf("expected a single valid timeout observation")
+	}
+	if len(issuer.CheckDeadlines()) != 0 {
+		test.Errorf("timeout observed twice")
+	}
+
+	// the issuer alone cannot count the timeout in a council of four
+	if issuer.RecordTimeout(observations) == nil {
+		test.Errorf("uncorroborated timeout counted")
+	}
+
+	// an alderman that reaches the miner refutes the timeout
+	reachable := func(challenge *Challenge) (*TicketResponse, error) {
+		return RespondToChallenge(minerKey, challenge, encodedFile), nil
+	}
+	corroboration, response, err := aldermen[1].Corroborate(observations[0], reachable)
+	if err != nil || corroboration != nil || response == nil {
+		test.Errorf("reachable miner was not vouched for")
+	}
+
+	// an alderman that cannot reach the miner corroborates it
+	corroboration, response, err = aldermen[2].Corroborate(observations[0], unreachable)
+	if err != nil || corroboration == nil || response != nil {
+		test.Fatalf("unreachable miner was not reported: %v", err)
+	}
+	observations = append(observations, corroboration)
+	if err := issuer.RecordTimeout(observations); err != nil {
+		test.Fatal(err)
+	}
+	if demerits := issuer.Demerits(minerID); demerits != 0.5 {
+		test.Errorf("%v demerits for a timeout, expected 0.5", demerits)
+	}
+	if issuer.RecordTimeout(observations) == nil || issuer.Demerits(minerID) != 0.5 {
+		test.Errorf("timeout counted twice")
+	}
+
+	// observations are bound to their challenge and their observer
+	forged := *corroboration
+	forged.ObservedAt = forged.Challenge.Deadline - 1
+	if forged.Verify() == nil {
+		test.Errorf("observation before the deadline verified")
+	}
+	forged = *corroboration
+	forged.Observer = observations[0].Observer
+	if forged.Verify() == nil {
+		test.Errorf("observation with a swapped observer verified")
+	}
+	other := aldermen[1].IssueChallenge(&minerKey.PublicKey, encodedFile, 2)
+	now = now.Add(DefaultResponseWindow + time.Second)
+	if aldermen[0].RecordTimeout(aldermen[1].CheckDeadlines()) == nil {
+		test.Errorf("counted a timeout of another alderman's challenge")
+	}
+	if _, _, err := aldermen[2].Corroborate(&TimeoutObservation{Challenge: *other}, unreachable); err == nil {
+		test.Errorf("corroborated an unsigned observation")
+	}
+
+	// a miner may answer throughout the second of the deadline, and a timeout
+	// is observed only after it
+	onTime := issuer.IssueChallenge(&minerKey.PublicKey, encodedFile, 2)
+	now = time.Unix(onTime.Deadline, 0)
+	if observations := issuer.CheckDeadlines(); len(observations) != 0 {
+		test.Errorf("%v timeouts observed at the deadline", len(observations))
+	}
+	if newTimeoutObservation(aldermen[1].key, onTime, now).Verify() == nil {
+		test.Errorf("observation at the deadline verified")
+	}
+	after := newTimeoutObservation(aldermen[1].key, onTime, now.Add(time.Second))
+	if _, _, err := aldermen[2].Corroborate(after, unreachable); err == nil {
+		test.Errorf("timeout corroborated at the deadline")
+	}
+	now = now.Add(time.Second - time.Nanosecond)
+	response = RespondToChallenge(minerKey, onTime, encodedFile)
+	if passed, err := issuer.VerifyMiner(onTime, response, encodedFile, true); err != nil || !passed {
+		test.Errorf("answer at the deadline failed to verify: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"time"
+
+	"github.com/tusharjois/councilfs/por"
+)
+
+// bench times producing and verifying proofs of retrievability over a file for
+// every number of segments up to a maximum, writing one line of seconds and
+// segment size per proof to each output, for makeSimpleGraph.py to plot.
+func bench(args []string) error {
+	flags := newFlagSet("bench", "")
+	file := flags.String("file", "testFile.txt", "`file` to encode and prove")
+	proofOut := flags.String("proofs", "proofExecution.dat", "`file` to write proof times to")
+	verifyOut := flags.String("verifies", "verifyExecution.dat", "`file` to write verification times to")
+	maxK := flags.Int("k", 99, "prove up to this many segments")
+	flags.Parse(args)
+
+	fmt.Println("Running POR test battery")
+	readContents, err := ioutil.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+	proofFile, err := os.Create(*proofOut)
+	if err != nil {
+		return err
+	}
+	defer proofFile.Close()
+	verifyFile, err := os.Create(*verifyOut)
+	if err != nil {
+		return err
+	}
+	defer verifyFile.Close()
+
+	porKey := por.GenerateKey()
+	var blockchainVal = make([]byte, 6)
+	var seed = []byte{115, 101, 101, 100}
+	encodedSet, err := por.CreateErasureCoding(readContents, 25, 4)
+	if err != nil {
+		return err
+	}
+	unitSegment := int(math.Ceil(float64(len(readContents)) / float64(((75+1)*10)/2)))
+
+	for k := 1; k <= *maxK; k++ {
+		start := time.Now()
+		proof := por.ProducePOR(porKey, blockchainVal, encodedSet, uint(k), seed)
+		proofTime := time.Since(start)
+		if _, err := fmt.Fprintf(proofFile, "%v %d\n", proofTime.Seconds(), k*unitSegment); err != nil {
+			return err
+		}
+
+		start = time.Now()
+		verified := por.VerifyPOR(encodedSet, blockchainVal, proof, uint(k))
+		verifyTime := time.Since(start)
+		if !verified {
+			return errors.New("correctly generated POR did not verify")
+		}
+		if _, err := fmt.Fprintf(verifyFile, "%v %d\n", verifyTime.Seconds(), k*unitSegment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
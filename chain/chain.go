@@ -0,0 +1,344 @@
+// Package chain provides a minimal simulated blockchain whose blocks are won
+// with proofs of retrievability. It builds the blockchainVal that miners prove
+// storage over, v || B_l || MR(x) || T, checks winning tickets with
+// por.VerifyMine, and follows the branch with the most cumulative work.
+package chain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/tusharjois/councilfs/ledger"
+	"github.com/tusharjois/councilfs/por"
+)
+
+// Version is the version of the block headers built by this package.
+const Version uint32 = 1
+
+// Errors returned by Chain.Add, describing why a block was rejected.
+var (
+	ErrUnknownParent = errors.New("parent block is unknown")
+	ErrKnownBlock    = errors.New("block is already on the chain")
+	ErrBadTicket     = errors.New("block ticket does not win")
+)
+
+// BlockHeader is the header of a block. PrevHash is the hash of the header of
+// the previous block, MerkleRoot the Merkle root of the IDs of the block's
+// transactions and Timestamp the Unix time the block was mined. Ticket is the
+// winning PoR ticket of the miner, computed over the BlockchainVal of the
+// rest of the header.
+type BlockHeader struct {
+	Version    uint32
+	PrevHash   []byte
+	MerkleRoot []byte
+	Timestamp  int64
+	Ticket     []byte
+}
+
+// BlockchainVal returns v || B_l || MR(x) || T for the header: the value that
+// the miner's ticket is computed over.
+func (h *BlockHeader) BlockchainVal() []byte {
+	val := make([]byte, 4, 4+len(h.PrevHash)+len(h.MerkleRoot)+8)
+	binary.BigEndian.PutUint32(val, h.Version)
+	val = append(val, h.PrevHash...)
+	val = append(val, h.MerkleRoot...)
+	var timestamp [8]byte
+	binary.BigEndian.PutUint64(timestamp[:], uint64(h.Timestamp))
+	return append(val, timestamp[:]...)
+}
+
+// Hash returns the hash of the header, which covers its ticket.
+func (h *BlockHeader) Hash() []byte {
+	hash := sha256.Sum256(append(h.BlockchainVal(), h.Ticket...))
+	return hash[:]
+}
+
+// Miner returns the public key of the miner whose ticket won the block, or nil
+// for the genesis block.
+func (h *BlockHeader) Miner() []byte {
+	var ticket por.Ticket
+	if json.Unmarshal(h.Ticket, &ticket) != nil {
+		return nil
+	}
+	return ticket.PublicKey
+}
+
+// Block is a header with the transactions it commits to.
+type Block struct {
+	Header       BlockHeader
+	Transactions []*ledger.Transaction
+}
+
+// TransactionRoot returns the Merkle root of the IDs of transactions.
+func TransactionRoot(transactions []*ledger.Transaction) []byte {
+	ids := make([][]byte, len(transactions))
+	for i, tx := range transactions {
+		ids[i] = tx.ID()
+	}
+	return por.MerkleRoot(ids)
+}
+
+// Work returns the expected number of tickets needed to win a block at
+// difficulty, 2^256 / (difficulty + 1).
+func Work(difficulty *big.Int) *big.Int {
+	max := new(big.Int).Lsh(big.NewInt(1), 256)
+	return max.Div(max, new(big.Int).Add(difficulty, big.NewInt(1)))
+}
+
+// node is a block on the chain, with its height, the cumulative work of the
+// branch ending in it and the state of the storage contracts after it.
+type node struct {
+	block  *Block
+	height uint64
+	work   *big.Int
+	state  *State
+	parent *node
+
+	// whether the block has joined the main chain, and its win is recorded
+	won bool
+}
+
+// WinRecorder records that the miner with a PKIX public key fingerprint mined
+// a winning ticket. alderman.Registry is a WinRecorder.
+type WinRecorder interface {
+	RecordWin(fingerprint string)
+}
+
+// Chain is a tree of blocks rooted at a genesis block, of which the branch
+// with the most cumulative work is the main chain. Every block after the
+// genesis block must be won by a ticket over Dataset that proves K segments
+// and beats Difficulty. The ticket of each block admits Admissions pending
+// files to the storage set, and challenges Challenges stored shards whose
+// holders share the Reward of the block with its producer. If Wins is set,
+// the producer of every block is recorded there as having mined a winning
+// ticket once the block joins the main chain, for the council to judge its
+// admission; blocks that never leave a losing fork are not recorded. A Chain
+// is safe for concurrent use.
+type Chain struct {
+	Dataset    *por.EncodedDataset
+	K          uint
+	Difficulty *big.Int
+	Reward     uint
+	Admissions int
+	Challenges int
+	Wins       WinRecorder
+
+	mu     sync.Mutex
+	blocks map[string]*node
+	tip    *node
+}
+
+// New creates a chain with a genesis block at genesisTime, whose blocks are
+// won by proving k segments of dataset at difficulty.
+func New(dataset *por.EncodedDataset, k uint, difficulty *big.Int, genesisTime time.Time) *Chain {
+	genesis := &Block{Header: BlockHeader{Version: Version, Timestamp: genesisTime.Unix()}}
+	root := &node{block: genesis, work: big.NewInt(0), state: newState(), won: true}
+	return &Chain{
+		Dataset:    dataset,
+		K:          k,
+		Difficulty: difficulty,
+		Reward:     DefaultReward,
+		Admissions: DefaultAdmissions,
+		Challenges: DefaultChallenges,
+		blocks:     map[string]*node{hex.EncodeToString(genesis.Header.Hash()): root},
+		tip:        root,
+	}
+}
+
+// Tip returns the last block of the main chain.
+func (c *Chain) Tip() *Block {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tip.block
+}
+
+// Height returns the height of the tip, counting the genesis block as 0.
+func (c *Chain) Height() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tip.height
+}
+
+// TotalWork returns the cumulative work of the main chain.
+func (c *Chain) TotalWork() *big.Int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return new(big.Int).Set(c.tip.work)
+}
+
+// File returns the contract of the file with content ID contentID as of the
+// tip, or nil if it is not registered.
+func (c *Chain) File(contentID []byte) *FileContract {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tip.state.File(contentID)
+}
+
+// Stored returns the content IDs of the files in the storage set as of the
+// tip, in the order they were admitted.
+func (c *Chain) Stored() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tip.state.Stored()
+}
+
+// Unpaid returns the split of the reward of the block at height on the main
+// chain, or nil if the reward has been paid out or there is no such block.
+func (c *Chain) Unpaid(height uint64) []Payout {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Payout(nil), c.tip.state.rewards[height]...)
+}
+
+// Select returns the transactions of pending, in order, that are valid in a
+// block on top of the tip mined at timestamp. Invalid transactions are left
+// out, so the returned transactions can be put in a block as they are.
+func (c *Chain) Select(pending []*ledger.Transaction, timestamp time.Time) []*ledger.Transaction {
+	c.mu.Lock()
+	state := c.tip.state.clone()
+	ctx := &blockContext{height: c.tip.height + 1, timestamp: timestamp.Unix()}
+	c.mu.Unlock()
+	var selected []*ledger.Transaction
+	for _, tx := range pending {
+		if tx.Verify() == nil && state.apply(tx, ctx) == nil {
+			selected = append(selected, tx)
+		}
+	}
+	return selected
+}
+
+// Block returns the block with the given header hash, or nil if it is unknown.
+func (c *Chain) Block(hash []byte) *Block {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, ok := c.blocks[hex.EncodeToString(hash)]
+	if !ok {
+		return nil
+	}
+	return n.block
+}
+
+// MainChain returns the blocks of the main chain, from the genesis block to
+// the tip.
+func (c *Chain) MainChain() []*Block {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	blocks := make([]*Block, c.tip.height+1)
+	for n := c.tip; n != nil; n = n.parent {
+		blocks[n.height] = n.block
+	}
+	return blocks
+}
+
+// Template returns the header of a block on top of the tip holding
+// transactions, mined at timestamp, without a ticket.
+func (c *Chain) Template(transactions []*ledger.Transaction, timestamp time.Time) BlockHeader {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return BlockHeader{
+		Version:    Version,
+		PrevHash:   c.tip.block.Header.Hash(),
+		MerkleRoot: TransactionRoot(transactions),
+		Timestamp:  timestamp.Unix(),
+	}
+}
+
+// BlockchainVal returns the value miners must compute their tickets over to
+// extend the tip with a block holding transactions, mined at timestamp.
+func (c *Chain) BlockchainVal(transactions []*ledger.Transaction, timestamp time.Time) []byte {
+	header := c.Template(transactions, timestamp)
+	return header.BlockchainVal()
+}
+
+// Mine attempts tickets over storedFiles with minerKey until one wins a block
+// on top of the tip holding transactions, mined at timestamp, and returns the
+// block. The block still has to be added to the chain, which only accepts it
+// if the transactions are valid; pass them through Select first.
+func (c *Chain) Mine(minerKey *ecdsa.PrivateKey, storedFiles *por.EncodedDataset,
+	transactions []*ledger.Transaction, timestamp time.Time) *Block {
+	header := c.Template(transactions, timestamp)
+	header.Ticket = por.AttemptedMine(minerKey, header.BlockchainVal(), storedFiles, c.K, c.Difficulty)
+	return &Block{Header: header, Transactions: transactions}
+}
+
+// Add adds a block to the chain, and makes it the tip if its branch has more
+// cumulative work than the main chain. Ties go to the branch seen first. An
+// error is returned if the block does not extend a known block or is invalid,
+// including if any of its transactions breaks the rules of the storage
+// contracts in the branch it extends.
+func (c *Chain) Add(block *Block) error {
+	header := &block.Header
+	if header.Version != Version {
+		return fmt.Errorf("unsupported block version %v", header.Version)
+	}
+	if !bytes.Equal(header.MerkleRoot, TransactionRoot(block.Transactions)) {
+		return errors.New("Merkle root does not match the transactions")
+	}
+	for i, tx := range block.Transactions {
+		if err := tx.Verify(); err != nil {
+			return fmt.Errorf("transaction %v: %v", i, err)
+		}
+	}
+	if !por.VerifyMine(c.Dataset, header.BlockchainVal(), header.Ticket, c.K, c.Difficulty) {
+		return ErrBadTicket
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := hex.EncodeToString(header.Hash())
+	if _, ok := c.blocks[id]; ok {
+		return ErrKnownBlock
+	}
+	parent, ok := c.blocks[hex.EncodeToString(header.PrevHash)]
+	if !ok {
+		return ErrUnknownParent
+	}
+	if header.Timestamp < parent.block.Header.Timestamp {
+		return errors.New("block is older than its parent")
+	}
+	state := parent.state.clone()
+	ctx := &blockContext{height: parent.height + 1, timestamp: header.Timestamp}
+	for i, tx := range block.Transactions {
+		if err := state.apply(tx, ctx); err != nil {
+			return fmt.Errorf("transaction %v: %v", i, err)
+		}
+	}
+	state.advance(header, parent.height+1, c)
+	n := &node{
+		block:  block,
+		height: parent.height + 1,
+		work:   new(big.Int).Add(parent.work, Work(c.Difficulty)),
+		state:  state,
+		parent: parent,
+	}
+	c.blocks[id] = n
+	if n.work.Cmp(c.tip.work) > 0 {
+		c.tip = n
+		c.recordWins()
+	}
+	return nil
+}
+
+// recordWins records the wins of the blocks of the main chain not yet
+// recorded, oldest first. The caller must hold c.mu.
+func (c *Chain) recordWins() {
+	var joined []*node
+	for n := c.tip; !n.won; n = n.parent {
+		joined = append(joined, n)
+	}
+	for i := len(joined) - 1; i >= 0; i-- {
+		joined[i].won = true
+		if c.Wins != nil {
+			c.Wins.RecordWin(por.FingerprintPKIX(joined[i].block.Header.Miner()))
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/tusharjois/councilfs/ledger"
+	"github.com/tusharjois/councilfs/por"
+)
+
+func newTestChain(t *testing.T) (*Chain, *por.EncodedDataset, time.Time) {
+	dataset, err := por.CreateErasureCoding([]byte("Left Munich at 8:35 P. M., on 1st May"), 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisTime := time.Unix(1000, 0)
+	// one ticket in four wins
+	difficulty := new(big.Int).Lsh(big.NewInt(1), 254)
+	return New(dataset, 2, difficulty, genesisTime), dataset, genesisTime
+}
+
+// mineOn mines a block holding transactions on top of parent, which need not
+// be the tip.
+// winCounter counts the wins recorded for each miner.
+type winCounter map[string]int
+
+func (w winCounter) RecordWin(fingerprint string) {
+	w[fingerprint]++
+}
+
+// total returns the number of wins recorded for all miners.
+func (w winCounter) total() int {
+	var total int
+	for _, wins := range w {
+		total += wins
+	}
+	return total
+}
+
+func mineOn(c *Chain, parent *Block, transactions []*ledger.Transaction, timestamp time.Time) *Block {
+	header := BlockHeader{
+		Version:    Version,
+		PrevHash:   parent.Header.Hash(),
+		MerkleRoot: TransactionRoot(transactions),
+		Timestamp:  timestamp.Unix(),
+	}
+	header.Ticket = por.AttemptedMine(por.GenerateKey(), header.BlockchainVal(), c.Dataset, c.K, c.Difficulty)
+	return &Block{Header: header, Transactions: transactions}
+}
+
+func TestBlockchainVal(t *testing.T) {
+	c, _, genesisTime := newTestChain(t)
+	tx := ledger.NewTransaction(ledger.Funding, nil, "payload", por.GenerateKey())
+	timestamp := genesisTime.Add(time.Minute)
+
+	expected := make([]byte, 4)
+	binary.BigEndian.PutUint32(expected, Version)
+	expected = append(expected, c.Tip().Header.Hash()...)
+	expected = append(expected, tx.ID()...)
+	var encodedTime [8]byte
+	binary.BigEndian.PutUint64(encodedTime[:], uint64(timestamp.Unix()))
+	expected = append(expected, encodedTime[:]...)
+	if val := c.BlockchainVal([]*ledger.Transaction{tx}, timestamp); !bytes.Equal(val, expected) {
+		t.Errorf("blockchainVal is %x, expected v || B_l || MR(x) || T = %x", val, expected)
+	}
+}
+
+func TestMineAndForkChoice(t *testing.T) {
+	c, dataset, genesisTime := newTestChain(t)
+	genesis := c.Tip()
+	wins := make(winCounter)
+	c.Wins = wins
+	minerKey := por.GenerateKey()
+	tx := ledger.NewTransaction(ledger.Funding, nil, "payload", minerKey)
+
+	first := c.Mine(minerKey, dataset, []*ledger.Transaction{tx}, genesisTime.Add(time.Minute))
+	if err := c.Add(first); err != nil {
+		t.Fatal(err)
+	}
+	if c.Tip() != first || c.Height() != 1 {
+		t.Errorf("mined block is not the tip")
+	}
+	if !bytes.Equal(first.Header.Miner(), c.Tip().Header.Miner()) || first.Header.Miner() == nil {
+		t.Errorf("block does not name its miner")
+	}
+	if err := c.Add(first); err != ErrKnownBlock {
+		t.Errorf("expected ErrKnownBlock, got %v", err)
+	}
+	if wins[por.Fingerprint(&minerKey.PublicKey)] != 1 {
+		t.Errorf("miner has %v wins, expected 1", wins[por.Fingerprint(&minerKey.PublicKey)])
+	}
+
+	// a competing block of equal work does not displace the tip
+	fork := mineOn(c, genesis, nil, genesisTime.Add(2*time.Minute))
+	if err := c.Add(fork); err != nil {
+		t.Fatal(err)
+	}
+	if c.Tip() != first {
+		t.Errorf("tip moved to a branch with equal work")
+	}
+	if wins.total() != 1 {
+		t.Errorf("%v wins recorded, expected none for the losing fork", wins.total()-1)
+	}
+
+	// extending the fork gives it more work
+	extended := mineOn(c, fork, nil, genesisTime.Add(3*time.Minute))
+	if err := c.Add(extended); err != nil {
+		t.Fatal(err)
+	}
+	if c.Tip() != extended || c.Height() != 2 {
+		t.Errorf("tip did not move to the branch with the most work")
+	}
+	if wins.total() != 3 {
+		t.Errorf("%v wins recorded, expected 3 once the fork joins the main chain", wins.total())
+	}
+	if c.TotalWork().Cmp(new(big.Int).Mul(Work(c.Difficulty), big.NewInt(2))) != 0 {
+		t.Errorf("total work is %v, expected twice the work of a block", c.TotalWork())
+	}
+	main := c.MainChain()
+	if len(main) != 3 || main[0] != genesis || main[1] != fork || main[2] != extended {
+		t.Errorf("main chain does not follow the fork")
+	}
+	if c.Block(first.Header.Hash()) != first {
+		t.Errorf("block on the abandoned branch is forgotten")
+	}
+}
+
+func TestAddRejectsInvalidBlocks(t *testing.T) {
+	c, dataset, genesisTime := newTestChain(t)
+	genesis := c.Tip()
+	wins := make(winCounter)
+	c.Wins = wins
+	minerKey := por.GenerateKey()
+	tx := ledger.NewTransaction(ledger.Funding, nil, "payload", minerKey)
+	block := c.Mine(minerKey, dataset, []*ledger.Transaction{tx}, genesisTime.Add(time.Minute))
+
+	tampered := *block
+	tampered.Transactions = []*ledger.Transaction{ledger.NewTransaction(ledger.Funding, nil, "other", minerKey)}
+	if c.Add(&tampered) == nil {
+		t.Errorf("block with swapped transactions added")
+	}
+
+	// the ticket is bound to the rest of the header
+	moved := *block
+	moved.Header.Timestamp++
+	if err := c.Add(&moved); err != ErrBadTicket {
+		t.Errorf("expected ErrBadTicket for a block with a moved timestamp, got %v", err)
+	}
+	hard := New(dataset, c.K, big.NewInt(1), genesisTime)
+	if err := hard.Add(block); err != ErrBadTicket {
+		t.Errorf("expected ErrBadTicket for a ticket above the difficulty, got %v", err)
+	}
+
+	orphan := mineOn(c, block, nil, genesisTime.Add(2*time.Minute))
+	if err := c.Add(orphan); err != ErrUnknownParent {
+		t.Errorf("expected ErrUnknownParent, got %v", err)
+	}
+	early := mineOn(c, genesis, nil, genesisTime.Add(-time.Minute))
+	if c.Add(early) == nil {
+		t.Errorf("block older than its parent added")
+	}
+	if c.Tip() != genesis {
+		t.Errorf("invalid blocks moved the tip")
+	}
+	if wins.total() != 0 {
+		t.Errorf("invalid blocks recorded as wins")
+	}
+}
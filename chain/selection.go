@@ -0,0 +1,173 @@
+package chain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+)
+
+// Defaults for the parameters of a Chain that govern admission and rewards.
+const (
+	// DefaultAdmissions is the number of pending files a block admits to the
+	// storage set.
+	DefaultAdmissions = 1
+
+	// DefaultChallenges is the number of stored shards a block challenges,
+	// whose holders share the block reward.
+	DefaultChallenges = 4
+)
+
+// ShardChallenge is a shard of a stored file picked by a block's ticket.
+type ShardChallenge struct {
+	ContentID []byte
+	Shard     int
+}
+
+// selectionSeed returns the seed the i-th pick of purpose is derived from. The
+// seeds of a ticket are a hash chain, so every pick is fixed by the ticket.
+func selectionSeed(ticket []byte, purpose string, i int) *big.Int {
+	seed := sha256.Sum256(append([]byte(purpose), ticket...))
+	for ; i > 0; i-- {
+		seed = sha256.Sum256(seed[:])
+	}
+	return new(big.Int).SetBytes(seed[:])
+}
+
+// AdmitFiles returns the indices into pending, a list of files in the order
+// they were registered, of the n files the ticket admits to the storage set.
+// Each pick is drawn from the files not yet picked, so at most len(pending)
+// files are admitted.
+func AdmitFiles(ticket []byte, pending int, n int) []int {
+	remaining := make([]int, pending)
+	for i := range remaining {
+		remaining[i] = i
+	}
+	var admitted []int
+	for i := 0; i < n && len(remaining) > 0; i++ {
+		pick := new(big.Int).Mod(selectionSeed(ticket, "admit", i), big.NewInt(int64(len(remaining)))).Int64()
+		admitted = append(admitted, remaining[pick])
+		remaining = append(remaining[:pick], remaining[pick+1:]...)
+	}
+	return admitted
+}
+
+// ChallengeShards returns the n shards of stored, the files in the storage set
+// in the order they were admitted, that the ticket challenges. A shard may be
+// challenged more than once.
+func ChallengeShards(ticket []byte, stored []*FileContract, n int) []ShardChallenge {
+	if len(stored) == 0 {
+		return nil
+	}
+	challenges := make([]ShardChallenge, n)
+	for i := range challenges {
+		seed := selectionSeed(ticket, "challenge", i)
+		file, rest := new(big.Int).DivMod(seed, big.NewInt(int64(len(stored))), new(big.Int))
+		contract := stored[rest.Int64()]
+		shard := new(big.Int).Mod(file, big.NewInt(int64(contract.Registration.Shards()))).Int64()
+		challenges[i] = ShardChallenge{ContentID: contract.Registration.ContentID, Shard: int(shard)}
+	}
+	return challenges
+}
+
+// ShardHolder returns the public key of the alderman holding a shard of the
+// file under contract. An assignment stripes the shards of a file across its
+// aldermen in order. nil is returned if the file is not assigned.
+func ShardHolder(contract *FileContract, shard int) []byte {
+	if len(contract.Aldermen) == 0 {
+		return nil
+	}
+	return contract.Aldermen[shard%len(contract.Aldermen)]
+}
+
+// SplitReward divides reward between the producer of a block and the holders
+// of the shards it challenged. The producer keeps half, and the other half is
+// split evenly between the challenges; the share of a challenged shard that
+// nobody holds, and whatever does not divide evenly, goes to the producer.
+// Payouts to the same recipient are merged, in the order they first appear,
+// starting with the producer.
+func SplitReward(reward uint, producer []byte, holders [][]byte) []Payout {
+	payouts := []Payout{{Recipient: producer, Amount: reward}}
+	if len(holders) == 0 {
+		return payouts
+	}
+	share := (reward / 2) / uint(len(holders))
+	for _, holder := range holders {
+		if holder == nil || share == 0 {
+			continue
+		}
+		payouts[0].Amount -= share
+		merged := false
+		for i := range payouts {
+			if bytes.Equal(payouts[i].Recipient, holder) {
+				payouts[i].Amount += share
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			payouts = append(payouts, Payout{Recipient: holder, Amount: share})
+		}
+	}
+	return payouts
+}
+
+// advance applies the changes every block makes to the storage contracts
+// after its transactions: expired files leave the storage set, the ticket
+// challenges shards of the files stored so far and admits pending files,
+// and the reward of the block is allocated to the producer and the holders
+// of the challenged shards.
+func (s *State) advance(header *BlockHeader, height uint64, c *Chain) {
+	s.pending = s.unexpired(s.pending, header.Timestamp)
+	s.stored = s.unexpired(s.stored, header.Timestamp)
+
+	stored := make([]*FileContract, len(s.stored))
+	for i, id := range s.stored {
+		stored[i] = s.files[id]
+	}
+	var holders [][]byte
+	for _, challenge := range ChallengeShards(header.Ticket, stored, c.Challenges) {
+		holders = append(holders, ShardHolder(s.File(challenge.ContentID), challenge.Shard))
+	}
+	if miner := header.Miner(); miner != nil {
+		s.rewards[height] = SplitReward(c.Reward, miner, holders)
+	}
+
+	picked := make(map[int]bool)
+	for _, i := range AdmitFiles(header.Ticket, len(s.pending), c.Admissions) {
+		admitted := *s.files[s.pending[i]]
+		admitted.AdmittedAt = height
+		s.files[s.pending[i]] = &admitted
+		s.stored = append(s.stored, s.pending[i])
+		picked[i] = true
+	}
+	var pending []string
+	for i, id := range s.pending {
+		if !picked[i] {
+			pending = append(pending, id)
+		}
+	}
+	s.pending = pending
+}
+
+// unexpired returns the files of ids whose contracts have not run out at the
+// Unix time at.
+func (s *State) unexpired(ids []string, at int64) []string {
+	var kept []string
+	for _, id := range ids {
+		if !s.files[id].Expired(at) {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+// Stored returns the content IDs of the files in the storage set, in the
+// order they were admitted.
+func (s *State) Stored() [][]byte {
+	ids := make([][]byte, len(s.stored))
+	for i, id := range s.stored {
+		ids[i], _ = hex.DecodeString(id)
+	}
+	return ids
+}
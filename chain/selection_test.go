@@ -0,0 +1,110 @@
+package chain
+
+import (
+	"crypto/sha256"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tusharjois/councilfs/ledger"
+	"github.com/tusharjois/councilfs/por"
+)
+
+func TestAdmitFiles(t *testing.T) {
+	ticket := []byte("ticket")
+	admitted := AdmitFiles(ticket, 10, 4)
+	if !reflect.DeepEqual(admitted, AdmitFiles(ticket, 10, 4)) {
+		t.Errorf("admission is not determined by the ticket")
+	}
+	seen := make(map[int]bool)
+	for _, i := range admitted {
+		if i < 0 || i >= 10 || seen[i] {
+			t.Errorf("admitted %v, expected distinct indices of pending files", admitted)
+		}
+		seen[i] = true
+	}
+	if len(admitted) != 4 {
+		t.Errorf("admitted %v files, expected 4", len(admitted))
+	}
+	if all := AdmitFiles(ticket, 3, 4); len(all) != 3 {
+		t.Errorf("admitted %v of 3 pending files", len(all))
+	}
+	if none := AdmitFiles(ticket, 0, 4); len(none) != 0 {
+		t.Errorf("admitted files when none are pending")
+	}
+}
+
+func TestSplitReward(t *testing.T) {
+	producer, a, b := []byte("producer"), []byte("a"), []byte("b")
+	split := SplitReward(50, producer, [][]byte{a, nil, a, b})
+	expected := []Payout{{producer, 32}, {a, 12}, {b, 6}}
+	if !reflect.DeepEqual(split, expected) {
+		t.Errorf("reward split as %v, expected %v", split, expected)
+	}
+	if split := SplitReward(50, producer, [][]byte{producer}); !reflect.DeepEqual(split, []Payout{{producer, 50}}) {
+		t.Errorf("producer holding the challenged shard split as %v", split)
+	}
+}
+
+func TestStorageSetAndRewards(t *testing.T) {
+	c, dataset, genesisTime := newTestChain(t)
+	minerKey, clientKey := por.GenerateKey(), por.GenerateKey()
+	aldermen := [][]byte{marshalKey(t, &por.GenerateKey().PublicKey), marshalKey(t, &por.GenerateKey().PublicKey)}
+
+	var transactions []*ledger.Transaction
+	for _, name := range []string{"first", "second"} {
+		file := registration(dataset, 3600)
+		contentID := sha256.Sum256([]byte(name))
+		file.ContentID = contentID[:]
+		transactions = append(transactions,
+			ledger.NewTransaction(ledger.FileRegistration, file.ContentID, file, clientKey),
+			ledger.NewTransaction(ledger.StorageAssignment, file.ContentID,
+				StorageAssignmentPayload{ContentID: file.ContentID, Aldermen: aldermen}, clientKey))
+	}
+
+	// the ticket of each block admits one pending file
+	first := c.Mine(minerKey, dataset, transactions, genesisTime.Add(time.Minute))
+	if err := c.Add(first); err != nil {
+		t.Fatal(err)
+	}
+	pick := AdmitFiles(first.Header.Ticket, 2, 1)[0]
+	admittedID := transactions[2*pick].Ref
+	if stored := c.Stored(); len(stored) != 1 || string(stored[0]) != string(admittedID) {
+		t.Fatalf("storage set is %x, expected the file picked by the ticket", stored)
+	}
+	if contract := c.File(admittedID); contract.AdmittedAt != 1 {
+		t.Errorf("file admitted at %v, expected 1", contract.AdmittedAt)
+	}
+	if err := addBlock(c, minerKey, nil, genesisTime.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Stored()) != 2 {
+		t.Errorf("%v files stored, expected 2", len(c.Stored()))
+	}
+
+	// the holders of the challenged shards share the reward
+	third := c.Mine(minerKey, dataset, nil, genesisTime.Add(3*time.Minute))
+	if err := c.Add(third); err != nil {
+		t.Fatal(err)
+	}
+	var stored []*FileContract
+	for _, id := range c.Stored() {
+		stored = append(stored, c.File(id))
+	}
+	var holders [][]byte
+	for _, challenge := range ChallengeShards(third.Header.Ticket, stored, c.Challenges) {
+		holders = append(holders, ShardHolder(c.File(challenge.ContentID), challenge.Shard))
+	}
+	expected := SplitReward(c.Reward, third.Header.Miner(), holders)
+	if split := c.Unpaid(3); !reflect.DeepEqual(split, expected) || len(split) < 2 {
+		t.Errorf("reward of block 3 split as %v, expected %v", split, expected)
+	}
+
+	// expired files leave the storage set
+	if err := addBlock(c, minerKey, nil, genesisTime.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Stored()) != 0 {
+		t.Errorf("%v expired files still stored", len(c.Stored()))
+	}
+}
@@ -0,0 +1,264 @@
+package chain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/tusharjois/councilfs/alderman"
+	"github.com/tusharjois/councilfs/ledger"
+)
+
+// DefaultReward is the total reward a block may pay out to miners.
+const DefaultReward uint = 50
+
+// FileRegistrationPayload is the payload of a ledger.FileRegistration: the
+// sender pays Price to have the file with content ID ContentID, the SHA-256
+// of its contents, stored for Duration seconds. The file is encoded with
+// por.CreateErasureCoding(contents, R, F), Size is the length of its contents
+// and Root the Merkle root of the hashes of its shards.
+type FileRegistrationPayload struct {
+	ContentID []byte
+	Root      []byte
+	R         int
+	F         int
+	Size      int
+	Price     uint
+	Duration  int64
+}
+
+// Shards returns the number of shards the file is encoded into.
+func (p *FileRegistrationPayload) Shards() int {
+	data := (p.F * (1 + p.R)) / 2
+	return data + (data - p.F)
+}
+
+// StorageAssignmentPayload is the payload of a ledger.StorageAssignment: the
+// owner of the file with content ID ContentID assigns it to the aldermen with
+// public keys Aldermen, replacing any earlier assignment.
+type StorageAssignmentPayload struct {
+	ContentID []byte
+	Aldermen  [][]byte
+}
+
+// Payout is an amount paid to the miner with public key Recipient.
+type Payout struct {
+	Recipient []byte
+	Amount    uint
+}
+
+// RewardPayload is the payload of a ledger.RewardPayout: the miner of the
+// block at Height pays the reward of that block out to Payouts, which must be
+// exactly the split the block allocated. A block's reward can only be paid out
+// in a later block, since the split depends on the block's own ticket.
+type RewardPayload struct {
+	Height  uint64
+	Payouts []Payout
+}
+
+// FileContract is the state of a registered file on the chain. AdmittedAt is
+// the height of the block that admitted the file to the storage set, or 0 if
+// the file is still pending.
+type FileContract struct {
+	Registration FileRegistrationPayload
+	Owner        []byte
+	RegisteredAt int64
+	AdmittedAt   uint64
+	Aldermen     [][]byte
+}
+
+// Expired reports whether the contract has run out at the Unix time at.
+func (f *FileContract) Expired(at int64) bool {
+	return at >= f.RegisteredAt+f.Registration.Duration
+}
+
+// State is the state of the storage contracts after a block: the registered
+// files, pending and stored, the proofs of failure already published, and the
+// rewards of blocks that are yet to be paid out, by height.
+type State struct {
+	files   map[string]*FileContract
+	roots   map[string]string
+	proofs  map[string]bool
+	pending []string
+	stored  []string
+	rewards map[uint64][]Payout
+}
+
+func newState() *State {
+	return &State{
+		files:   make(map[string]*FileContract),
+		roots:   make(map[string]string),
+		proofs:  make(map[string]bool),
+		rewards: make(map[uint64][]Payout),
+	}
+}
+
+// clone returns a copy of the state that can be changed without changing s.
+// Contracts are replaced rather than changed, so they are shared.
+func (s *State) clone() *State {
+	cloned := newState()
+	for id, contract := range s.files {
+		cloned.files[id] = contract
+	}
+	for root, id := range s.roots {
+		cloned.roots[root] = id
+	}
+	for id := range s.proofs {
+		cloned.proofs[id] = true
+	}
+	cloned.pending = append([]string(nil), s.pending...)
+	cloned.stored = append([]string(nil), s.stored...)
+	for height, payouts := range s.rewards {
+		cloned.rewards[height] = payouts
+	}
+	return cloned
+}
+
+// File returns the contract of the file with content ID contentID, or nil if
+// the file is not registered.
+func (s *State) File(contentID []byte) *FileContract {
+	return s.files[hex.EncodeToString(contentID)]
+}
+
+// blockContext is what the validation of a transaction needs to know about
+// the block it is in.
+type blockContext struct {
+	height    uint64
+	timestamp int64
+}
+
+// apply checks a transaction against the rules of the storage contracts and
+// applies it to the state. Transactions of kinds without rules only need a
+// valid signature, which Add checks.
+func (s *State) apply(tx *ledger.Transaction, ctx *blockContext) error {
+	switch tx.Kind {
+	case ledger.FileRegistration:
+		return s.register(tx, ctx)
+	case ledger.StorageAssignment:
+		return s.assign(tx, ctx)
+	case ledger.FailureProof:
+		return s.prove(tx)
+	case ledger.RewardPayout:
+		return s.payout(tx, ctx)
+	}
+	return nil
+}
+
+func (s *State) register(tx *ledger.Transaction, ctx *blockContext) error {
+	var payload FileRegistrationPayload
+	if err := json.Unmarshal(tx.Payload, &payload); err != nil {
+		return err
+	}
+	switch {
+	case !bytes.Equal(tx.Ref, payload.ContentID):
+		return errors.New("registration does not refer to its content ID")
+	case len(payload.ContentID) != sha256.Size || len(payload.Root) != sha256.Size:
+		return errors.New("content ID and root must be SHA-256 hashes")
+	case payload.R <= 0 || payload.F <= 0 || payload.Shards() < payload.F || payload.Shards() > 256:
+		return fmt.Errorf("invalid coding parameters r = %v, f = %v", payload.R, payload.F)
+	case payload.Size <= 0 || payload.Price == 0 || payload.Duration <= 0:
+		return errors.New("registration must have a size, a price and a duration")
+	}
+	id := hex.EncodeToString(payload.ContentID)
+	if _, ok := s.files[id]; ok {
+		return fmt.Errorf("file %v is already registered", id)
+	}
+	s.files[id] = &FileContract{Registration: payload, Owner: tx.Sender, RegisteredAt: ctx.timestamp}
+	s.roots[hex.EncodeToString(payload.Root)] = id
+	s.pending = append(s.pending, id)
+	return nil
+}
+
+func (s *State) assign(tx *ledger.Transaction, ctx *blockContext) error {
+	var payload StorageAssignmentPayload
+	if err := json.Unmarshal(tx.Payload, &payload); err != nil {
+		return err
+	}
+	if !bytes.Equal(tx.Ref, payload.ContentID) {
+		return errors.New("assignment does not refer to its content ID")
+	}
+	contract := s.File(payload.ContentID)
+	if contract == nil {
+		return errors.New("assigned file is not registered")
+	}
+	if contract.Expired(ctx.timestamp) {
+		return errors.New("assigned file has expired")
+	}
+	if !bytes.Equal(tx.Sender, contract.Owner) {
+		return errors.New("only the owner of a file can assign it")
+	}
+	if len(payload.Aldermen) == 0 {
+		return errors.New("file assigned to no aldermen")
+	}
+	seen := make(map[string]bool)
+	for _, key := range payload.Aldermen {
+		if _, err := x509.ParsePKIXPublicKey(key); err != nil {
+			return err
+		}
+		if seen[string(key)] {
+			return errors.New("file assigned to an alderman twice")
+		}
+		seen[string(key)] = true
+	}
+	assigned := *contract
+	assigned.Aldermen = payload.Aldermen
+	s.files[hex.EncodeToString(payload.ContentID)] = &assigned
+	return nil
+}
+
+func (s *State) prove(tx *ledger.Transaction) error {
+	var evidence alderman.FailureEvidence
+	if err := json.Unmarshal(tx.Payload, &evidence); err != nil {
+		return err
+	}
+	if err := evidence.Verify(); err != nil {
+		return err
+	}
+	if !bytes.Equal(tx.Ref, evidence.Challenge.Miner) {
+		return errors.New("proof does not refer to the failed miner")
+	}
+	if !bytes.Equal(tx.Sender, evidence.Challenge.Issuer) {
+		return errors.New("proof is not published by the issuer of the challenge")
+	}
+	if _, ok := s.roots[hex.EncodeToString(evidence.Challenge.Root)]; !ok {
+		return errors.New("challenged dataset is not a registered file")
+	}
+	digest := evidence.Challenge.Digest()
+	id := hex.EncodeToString(digest[:])
+	if s.proofs[id] {
+		return errors.New("failure already proven")
+	}
+	s.proofs[id] = true
+	return nil
+}
+
+func (s *State) payout(tx *ledger.Transaction, ctx *blockContext) error {
+	var payload RewardPayload
+	if err := json.Unmarshal(tx.Payload, &payload); err != nil {
+		return err
+	}
+	if payload.Height >= ctx.height {
+		return fmt.Errorf("payout for block %v in block %v", payload.Height, ctx.height)
+	}
+	allocated, ok := s.rewards[payload.Height]
+	if !ok {
+		return fmt.Errorf("reward of block %v is already paid out", payload.Height)
+	}
+	if !bytes.Equal(tx.Sender, allocated[0].Recipient) {
+		return errors.New("reward is not paid out by the miner of the block")
+	}
+	if len(payload.Payouts) != len(allocated) {
+		return errors.New("payouts do not match the split of the block reward")
+	}
+	for i, payout := range payload.Payouts {
+		if !bytes.Equal(payout.Recipient, allocated[i].Recipient) || payout.Amount != allocated[i].Amount {
+			return errors.New("payouts do not match the split of the block reward")
+		}
+	}
+	delete(s.rewards, payload.Height)
+	return nil
+}
@@ -0,0 +1,216 @@
+package chain
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/tusharjois/councilfs/alderman"
+	"github.com/tusharjois/councilfs/ledger"
+	"github.com/tusharjois/councilfs/por"
+)
+
+func marshalKey(t *testing.T, key *ecdsa.PublicKey) []byte {
+	keyBytes, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyBytes
+}
+
+func registration(dataset *por.EncodedDataset, duration int64) FileRegistrationPayload {
+	contentID := sha256.Sum256([]byte("Left Munich at 8:35 P. M., on 1st May"))
+	return FileRegistrationPayload{
+		ContentID: contentID[:],
+		Root:      dataset.Root(),
+		R:         2,
+		F:         4,
+		Size:      37,
+		Price:     10,
+		Duration:  duration,
+	}
+}
+
+// addBlock mines a block holding transactions on the tip, and adds it.
+func addBlock(c *Chain, minerKey *ecdsa.PrivateKey, transactions []*ledger.Transaction, timestamp time.Time) error {
+	return c.Add(c.Mine(minerKey, c.Dataset, transactions, timestamp))
+}
+
+func TestFileContracts(t *testing.T) {
+	c, dataset, genesisTime := newTestChain(t)
+	minerKey, clientKey := por.GenerateKey(), por.GenerateKey()
+	aldermanKeys := []*ecdsa.PrivateKey{por.GenerateKey(), por.GenerateKey()}
+	file := registration(dataset, 3600)
+	if file.Shards() != int(dataset.Length()) {
+		t.Errorf("registration counts %v shards, dataset has %v", file.Shards(), dataset.Length())
+	}
+	register := ledger.NewTransaction(ledger.FileRegistration, file.ContentID, file, clientKey)
+	assignment := StorageAssignmentPayload{
+		ContentID: file.ContentID,
+		Aldermen:  [][]byte{marshalKey(t, &aldermanKeys[0].PublicKey), marshalKey(t, &aldermanKeys[1].PublicKey)},
+	}
+	assign := ledger.NewTransaction(ledger.StorageAssignment, file.ContentID, assignment, clientKey)
+	if err := addBlock(c, minerKey, []*ledger.Transaction{register, assign}, genesisTime.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	contract := c.File(file.ContentID)
+	if contract == nil || len(contract.Aldermen) != 2 || string(contract.Owner) != string(marshalKey(t, &clientKey.PublicKey)) {
+		t.Fatalf("file contract was not recorded")
+	}
+
+	// registrations are unique, and only the owner assigns a file
+	again := ledger.NewTransaction(ledger.FileRegistration, file.ContentID, file, clientKey)
+	if addBlock(c, minerKey, []*ledger.Transaction{again}, genesisTime.Add(2*time.Minute)) == nil {
+		t.Errorf("file registered twice")
+	}
+	hijack := ledger.NewTransaction(ledger.StorageAssignment, file.ContentID, assignment, minerKey)
+	if addBlock(c, minerKey, []*ledger.Transaction{hijack}, genesisTime.Add(2*time.Minute)) == nil {
+		t.Errorf("file assigned by someone other than its owner")
+	}
+	invalid := file
+	invalid.ContentID = []byte("short")
+	bad := ledger.NewTransaction(ledger.FileRegistration, invalid.ContentID, invalid, clientKey)
+	if addBlock(c, minerKey, []*ledger.Transaction{bad}, genesisTime.Add(2*time.Minute)) == nil {
+		t.Errorf("registration with an invalid content ID accepted")
+	}
+	if selected := c.Select([]*ledger.Transaction{again, hijack, bad}, genesisTime.Add(2*time.Minute)); len(selected) != 0 {
+		t.Errorf("selected %v invalid transactions", len(selected))
+	}
+
+	// contracts run out after their duration
+	late := ledger.NewTransaction(ledger.StorageAssignment, file.ContentID, StorageAssignmentPayload{
+		ContentID: file.ContentID,
+		Aldermen:  assignment.Aldermen[:1],
+	}, clientKey)
+	if addBlock(c, minerKey, []*ledger.Transaction{late}, genesisTime.Add(2*time.Hour)) == nil {
+		t.Errorf("expired file assigned")
+	}
+	if c.Height() != 1 {
+		t.Errorf("invalid blocks extended the chain")
+	}
+}
+
+func TestFailureProofs(t *testing.T) {
+	c, dataset, genesisTime := newTestChain(t)
+	minerKey, clientKey := por.GenerateKey(), por.GenerateKey()
+	aldermanKey := por.GenerateKey()
+	alder := alderman.New(aldermanKey, func() time.Time { return genesisTime })
+
+	// a failed challenge over the global dataset
+	challenge := alder.IssueChallenge(&minerKey.PublicKey, dataset, 2)
+	forged := por.ParseTicket(alderman.RespondToChallenge(minerKey, challenge, dataset).Ticket)
+	forged.ProofFiles[0].Signature = forged.ProofFiles[1].Signature
+	response := alderman.NewTicketResponse(minerKey, challenge, por.TicketMarshal(*forged))
+	proof, _, err := alderman.ProofofFailure(challenge, response, dataset, aldermanKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish := ledger.NewTransaction(ledger.FailureProof, challenge.Miner, json.RawMessage(proof), aldermanKey)
+
+	// the challenged dataset must be a registered file
+	if addBlock(c, minerKey, []*ledger.Transaction{publish}, genesisTime.Add(time.Minute)) == nil {
+		t.Errorf("proof of failure over an unregistered file accepted")
+	}
+	file := registration(dataset, 3600)
+	register := ledger.NewTransaction(ledger.FileRegistration, file.ContentID, file, clientKey)
+	if err := addBlock(c, minerKey, []*ledger.Transaction{register, publish}, genesisTime.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	// each failure is proven once, by the alderman that issued the challenge
+	republish := ledger.NewTransaction(ledger.FailureProof, challenge.Miner, json.RawMessage(proof), aldermanKey)
+	stolen := ledger.NewTransaction(ledger.FailureProof, challenge.Miner, json.RawMessage(proof), clientKey)
+	misdirected := ledger.NewTransaction(ledger.FailureProof, challenge.Issuer, json.RawMessage(proof), aldermanKey)
+	for _, tx := range []*ledger.Transaction{republish, stolen, misdirected} {
+		if addBlock(c, minerKey, []*ledger.Transaction{tx}, genesisTime.Add(2*time.Minute)) == nil {
+			t.Errorf("invalid proof of failure accepted")
+		}
+	}
+
+	// a correct ticket is no proof of failure
+	passed := alderman.RespondToChallenge(minerKey, challenge, dataset)
+	evidence := alderman.FailureEvidence{Challenge: *challenge, Response: *passed, Hashes: dataset.Hashes()}
+	unfailed := ledger.NewTransaction(ledger.FailureProof, challenge.Miner, evidence, aldermanKey)
+	if addBlock(c, minerKey, []*ledger.Transaction{unfailed}, genesisTime.Add(2*time.Minute)) == nil {
+		t.Errorf("proof of failure for a passed challenge accepted")
+	}
+}
+
+func TestRewardPayouts(t *testing.T) {
+	c, _, genesisTime := newTestChain(t)
+	minerKey, otherKey := por.GenerateKey(), por.GenerateKey()
+	miner := marshalKey(t, &minerKey.PublicKey)
+	payout := func(sender *ecdsa.PrivateKey, height uint64, payouts ...Payout) *ledger.Transaction {
+		return ledger.NewTransaction(ledger.RewardPayout, nil, RewardPayload{Height: height, Payouts: payouts}, sender)
+	}
+
+	// without stored files, the producer keeps the whole reward
+	if err := addBlock(c, minerKey, nil, genesisTime.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	split := c.Unpaid(1)
+	if len(split) != 1 || string(split[0].Recipient) != string(miner) || split[0].Amount != c.Reward {
+		t.Fatalf("reward of block 1 split as %v, expected all to its producer", split)
+	}
+
+	rejected := []*ledger.Transaction{
+		payout(otherKey, 1, split...),
+		payout(minerKey, 1, Payout{Recipient: miner, Amount: c.Reward + 1}),
+		payout(minerKey, 1, Payout{Recipient: marshalKey(t, &otherKey.PublicKey), Amount: c.Reward}),
+		payout(minerKey, 2, split...),
+	}
+	for i, tx := range rejected {
+		if addBlock(c, otherKey, []*ledger.Transaction{tx}, genesisTime.Add(2*time.Minute)) == nil {
+			t.Errorf("invalid payout %v accepted", i)
+		}
+	}
+	if err := addBlock(c, otherKey, []*ledger.Transaction{payout(minerKey, 1, split...)}, genesisTime.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if c.Unpaid(1) != nil {
+		t.Errorf("reward of block 1 still unpaid")
+	}
+	if selected := c.Select([]*ledger.Transaction{payout(minerKey, 1, split...)}, genesisTime.Add(3*time.Minute)); len(selected) != 0 {
+		t.Errorf("reward of block 1 paid out twice")
+	}
+}
+
+func TestAldermenPublishFailureProofs(t *testing.T) {
+	c, dataset, genesisTime := newTestChain(t)
+	minerKey, clientKey := por.GenerateKey(), por.GenerateKey()
+	clock := func() time.Time { return genesisTime }
+	issuer := alderman.New(por.GenerateKey(), clock)
+	witness := alderman.New(por.GenerateKey(), clock)
+	l := ledger.NewMemory()
+	issuer.SetLedger(l)
+	witness.SetLedger(l)
+
+	// both aldermen see the miner fail the challenge, but only its issuer
+	// publishes the proof
+	challenge := issuer.IssueChallenge(&minerKey.PublicKey, dataset, 2)
+	forged := por.ParseTicket(alderman.RespondToChallenge(minerKey, challenge, dataset).Ticket)
+	forged.ProofFiles[0].Signature = forged.ProofFiles[1].Signature
+	response := alderman.NewTicketResponse(minerKey, challenge, por.TicketMarshal(*forged))
+	for _, alder := range []*alderman.Alderman{witness, issuer} {
+		if passed, err := alder.VerifyMiner(challenge, response, dataset, true); err != nil || passed {
+			t.Fatalf("forged ticket verified: %v", err)
+		}
+	}
+	published, err := l.References(challenge.Miner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 1 {
+		t.Fatalf("%v proofs of failure published, expected 1", len(published))
+	}
+
+	// the chain accepts what the aldermen publish
+	file := registration(dataset, 3600)
+	register := ledger.NewTransaction(ledger.FileRegistration, file.ContentID, file, clientKey)
+	if err := addBlock(c, minerKey, append([]*ledger.Transaction{register}, published...), genesisTime.Add(time.Minute)); err != nil {
+		t.Errorf("published proof of failure rejected: %v", err)
+	}
+}
@@ -5,9 +5,12 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/tusharjois/councilfs/por"
+	"hash"
 	"time"
 )
 
@@ -46,18 +49,40 @@ const (
 
 	// SendPayment is sent when the client wants to send payment to the alderman
 	// to save the file; this can be sent either after a valid POR is verified
-	// or just on time. The payload is the payment being sent (little-endian)
+	// or just on time. The payload is a Commitment to the total paid so far.
 	SendPayment
 
 	// CloseChannel is sent by either the client or the server when the
-	// PaymentChannel is to be closed. The client sends it when the POR fails to
+	// PaymentChannel is to be closed. The payload is a CloseProposal with the
+	// final balance of the channel, which the other party countersigns with
+	// their own CloseChannel. The client sends it when the POR fails to
 	// verify or arbitrarily when the client no longer wants to maintain the
 	// connection. The alderman sends it when the client does not send the
 	// correct payment after the correct duration or arbitrarily if they no
 	// longer wish to hold the file.
 	CloseChannel
+
+	// ShardRequest is sent when the client wants to download shards of its
+	// file from the alderman. The payload is the indices of the shards in the
+	// erasure coding, or nothing for every shard the alderman holds.
+	ShardRequest
+
+	// ShardResponse is sent when the alderman answers a ShardRequest. The
+	// payload is a ShardDelivery holding the next of the requested shards and
+	// the price the alderman asks for them.
+	ShardResponse
 )
 
+var messageTypeNames = []string{"ChannelOpen", "ChannelAccepted", "FundsCreated", "FundsApproved",
+	"PORRequest", "PORResponse", "SendPayment", "CloseChannel", "ShardRequest", "ShardResponse"}
+
+func (mType MessageType) String() string {
+	if mType < 0 || int(mType) >= len(messageTypeNames) {
+		return fmt.Sprintf("MessageType(%d)", int8(mType))
+	}
+	return messageTypeNames[mType]
+}
+
 // PaymentChannel is a representation of the channel between a client and an
 // alderman.
 type PaymentChannel struct {
@@ -69,11 +94,25 @@ type PaymentChannel struct {
 	Interval          time.Duration
 	Messages          []*ChannelMessage
 	Encoding          *por.EncodedDataset
+
+	// FundingID and FundingAmount describe the funding transaction backing
+	// the channel once it has been created.
+	FundingID     []byte
+	FundingAmount uint
+
+	// DisputeWindow is how long the other party has to answer a unilateral
+	// close of the channel with a newer state.
+	DisputeWindow time.Duration
 }
 
+// DefaultDisputeWindow is the DisputeWindow of channels created by OpenChannel.
+const DefaultDisputeWindow = 24 * time.Hour
+
 const CLIENTIDSIZE uint = 128
 
-// ChannelMessage is a message between a client and an alderman. TODO: Add more description.
+// ChannelMessage is a message between a client and an alderman. Each message is
+// signed by its sender and carries the hash of the message before it in the
+// channel, so the messages of a PaymentChannel form a hash chain.
 type ChannelMessage struct {
 	mType           MessageType
 	channelID       [CLIENTIDSIZE]byte
@@ -83,11 +122,118 @@ type ChannelMessage struct {
 	prevHash        [sha256.Size]byte
 }
 
+// wireMessage is the form in which a ChannelMessage is sent between a client
+// and an alderman.
+type wireMessage struct {
+	Type      MessageType
+	ChannelID []byte
+	Signature []byte
+	Sender    []byte
+	Payload   []byte
+	PrevHash  []byte
+}
+
+// MarshalJSON encodes every field of the ChannelMessage, so that the message
+// can be sent over the wire and hashed by the message that follows it.
+func (msg ChannelMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(wireMessage{
+		Type:      msg.mType,
+		ChannelID: msg.channelID[:],
+		Signature: msg.signature,
+		Sender:    msg.senderPublicKey,
+		Payload:   msg.payload,
+		PrevHash:  msg.prevHash[:],
+	})
+}
+
+// UnmarshalJSON decodes a ChannelMessage produced by MarshalJSON. An error is
+// returned if the channel ID or previous hash are of the wrong size.
+func (msg *ChannelMessage) UnmarshalJSON(data []byte) error {
+	var wire wireMessage
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return err
+	}
+	if uint(len(wire.ChannelID)) != CLIENTIDSIZE {
+		return fmt.Errorf("channel ID has length %v, expected %v", len(wire.ChannelID), CLIENTIDSIZE)
+	}
+	if len(wire.PrevHash) != sha256.Size {
+		return fmt.Errorf("previous hash has length %v, expected %v", len(wire.PrevHash), sha256.Size)
+	}
+	if len(wire.Signature) == 0 {
+		return errors.New("message is not signed")
+	}
+	msg.mType = wire.Type
+	copy(msg.channelID[:], wire.ChannelID)
+	msg.signature = wire.Signature
+	msg.senderPublicKey = wire.Sender
+	msg.payload = wire.Payload
+	copy(msg.prevHash[:], wire.PrevHash)
+	return nil
+}
+
+// Marshal returns the wire encoding of the ChannelMessage.
+func (msg *ChannelMessage) Marshal() []byte {
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	return encoded
+}
+
+// ParseMessage decodes a ChannelMessage from its wire encoding.
+func ParseMessage(encoded []byte) (*ChannelMessage, error) {
+	msg := new(ChannelMessage)
+	if err := json.Unmarshal(encoded, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeField writes a length-prefixed field into a hash.
+func writeField(h hash.Hash, field []byte) {
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(len(field)))
+	h.Write(length[:])
+	h.Write(field)
+}
+
+// signingDigest is the digest signed by the sender of the message. It commits
+// to the type, channel, sender, payload and previous message of the message.
+func signingDigest(mType MessageType, channelID []byte, sender []byte, payload []byte,
+	prevHash [sha256.Size]byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte{byte(mType)})
+	writeField(h, channelID)
+	writeField(h, sender)
+	writeField(h, payload)
+	h.Write(prevHash[:])
+	var digest [sha256.Size]byte
+	copy(digest[:], h.Sum(nil))
+	return digest
+}
+
+// Hash returns the hash of the whole message, including its signature. The
+// next message in the channel stores this value as its previous hash.
+func (msg *ChannelMessage) Hash() [sha256.Size]byte {
+	digest := signingDigest(msg.mType, msg.channelID[:], msg.senderPublicKey, msg.payload, msg.prevHash)
+	h := sha256.New()
+	h.Write(digest[:])
+	writeField(h, msg.signature)
+	var result [sha256.Size]byte
+	copy(result[:], h.Sum(nil))
+	return result
+}
+
+// GetPrevHash returns the hash of the message that preceded this one, or all
+// zeroes if this is the first message of the channel.
+func (msg *ChannelMessage) GetPrevHash() [sha256.Size]byte {
+	return msg.prevHash
+}
+
 // GetPayload returns the MessageType of the ChannelMessage and the associated payload.
+// An error is returned if the message is not correctly signed by its sender.
 func (msg *ChannelMessage) GetPayload() (MessageType, []byte, error) {
-	// check the signature on the message 
-
-	return msg.mType, msg.payload, nil // TODO: Verification
+	return msg.mType, msg.payload, msg.Verify()
 }
 
 func (msg *ChannelMessage) GetSenderKey() []byte {
@@ -110,9 +256,37 @@ func (pay *PaymentChannel) GetInterval() time.Duration {
 	return pay.Interval
 }
 
-// update your own message channel with a pointer to a message you hold
-func (pay *PaymentChannel) UpdateMessages(msg *ChannelMessage) {
+// update your own message channel with a pointer to a message you hold. An
+// error is returned, and the message is not added, if the message does not
+// validate as the next message of the channel or is not allowed in the current
+// ChannelState.
+func (pay *PaymentChannel) UpdateMessages(msg *ChannelMessage) error {
+	var prev *ChannelMessage
+	if len(pay.Messages) > 0 {
+		prev = pay.GetMostRecent()
+	}
+	if reason := pay.checkMessage(prev, msg); reason != "" {
+		return &ValidationError{Index: len(pay.Messages), Reason: reason}
+	}
+	state, err := replayState(pay.Messages)
+	if err != nil {
+		return err
+	}
+	if _, err = step(state, prev, msg); err != nil {
+		return &ValidationError{Index: len(pay.Messages), Reason: err.Error()}
+	}
+	if msg.mType == SendPayment {
+		if _, err := pay.checkCommitment(pay.LatestCommitment(), msg); err != nil {
+			return &ValidationError{Index: len(pay.Messages), Reason: err.Error()}
+		}
+	}
+	if msg.mType == CloseChannel {
+		if err := pay.checkClose(pay.LatestCommitment(), prev, msg); err != nil {
+			return &ValidationError{Index: len(pay.Messages), Reason: err.Error()}
+		}
+	}
 	pay.Messages = append(pay.Messages, msg)
+	return nil
 }
 
 func (pay *PaymentChannel) DebugPrint() {
@@ -127,22 +301,9 @@ func NewMessage(mType MessageType, v interface{},channelID []byte, signingKey *e
 	if err != nil {
 		panic(err)
 	}
-	toSign := make([]byte, len(jsonPayload))
-	copy(toSign, jsonPayload)
 	var prevHash [sha256.Size]byte
 	if prev != nil {
-		jsonPrev, err := json.Marshal(prev)
-		if err != nil {
-			panic(err)
-		}
-		prevHash = sha256.Sum256(jsonPrev)
-	}
-	toSign = append(toSign, prevHash[:]...)
-	toSignHash := sha256.Sum256(toSign)
-
-	r, s, err := ecdsa.Sign(rand.Reader, signingKey, toSignHash[:])
-	if err != nil {
-		panic(err)
+		prevHash = prev.Hash()
 	}
 
 	publicKeyBytes, err := x509.MarshalPKIXPublicKey(&signingKey.PublicKey)
@@ -153,7 +314,6 @@ func NewMessage(mType MessageType, v interface{},channelID []byte, signingKey *e
 	newMessage := &ChannelMessage{
 		mType:           mType,
 		channelID:       [CLIENTIDSIZE]byte{},
-		signature:       []byte(fmt.Sprintf("(%d,%d)", r, s)),
 		senderPublicKey: publicKeyBytes,
 		payload:         jsonPayload,
 		prevHash:        prevHash,
@@ -167,6 +327,9 @@ func NewMessage(mType MessageType, v interface{},channelID []byte, signingKey *e
     }
 	copy(newMessage.channelID[:],channelID)
 
+	toSignHash := signingDigest(mType, newMessage.channelID[:], publicKeyBytes, jsonPayload, prevHash)
+	newMessage.signature = por.SignAndMarshal(signingKey, toSignHash[:])
+
 	return newMessage
 }
 
@@ -194,6 +357,7 @@ func OpenChannel(clientKey *ecdsa.PrivateKey, aldermanKey *ecdsa.PublicKey, paym
 
 	newChannel.Payment = payment
 	newChannel.Interval = paymentInterval
+	newChannel.DisputeWindow = DefaultDisputeWindow
 
 	// Note that this can become nil after the file is uploaded
 	// can't do this in a regular networking setting
@@ -202,18 +366,30 @@ func OpenChannel(clientKey *ecdsa.PrivateKey, aldermanKey *ecdsa.PublicKey, paym
 	newMessage := NewMessage(ChannelOpen, newChannel, newChannel.ChannelID, clientKey, nil)
 
 	newChannel.Messages = make([]*ChannelMessage, 0)
-	newChannel.UpdateMessages(newMessage)
+	if err := newChannel.UpdateMessages(newMessage); err != nil {
+		panic(err)
+	}
 
 	return newChannel, *newMessage, *encoding
 }
 
+// ErrPORFailed is returned by VerifyPOR, along with the CloseChannel message
+// to send to the alderman, when the alderman's POR fails to verify.
+var ErrPORFailed = errors.New("POR failed to verify, so the channel is closed")
+
 // VerifyPOR checks that an alderman is actually holding the file they clain to be 
-// [the POR is correctly computed]
-func (pay *PaymentChannel) VerifyPOR(clientKey *ecdsa.PrivateKey, k uint) ChannelMessage {
-	_,clientMsg, err := pay.Messages[len(pay.Messages)-1].GetPayload()
-	
+// [the POR is correctly computed]. If the POR verifies the client pays the
+// alderman, otherwise the channel is closed and ErrPORFailed is returned with
+// the close. An error is returned if the channel is not waiting on a
+// PORResponse.
+func (pay *PaymentChannel) VerifyPOR(clientKey *ecdsa.PrivateKey, k uint) (ChannelMessage, error) {
+	lastMessage := pay.GetMostRecent()
+	msgType, clientMsg, err := lastMessage.GetPayload()
 	if err != nil {
-		panic(err)
+		return ChannelMessage{}, err
+	}
+	if msgType != PORResponse {
+		return ChannelMessage{}, fmt.Errorf("most recent message is %v, not %v", msgType, PORResponse)
 	}
 	
 	if pay.Encoding != nil {
@@ -221,23 +397,22 @@ func (pay *PaymentChannel) VerifyPOR(clientKey *ecdsa.PrivateKey, k uint) Channe
 		var valuebytes []byte
 		err = json.Unmarshal(rawmsg, &valuebytes)
 		if err != nil {
-			panic(err)
+			return ChannelMessage{}, err
 		}
 		if !por.VerifyPOR(pay.Encoding, pay.BlockchainState, valuebytes, k) {
-			print("Message failed to verify")
-			closeMessage := NewMessage(CloseChannel, make([]byte, 0), pay.ChannelID, clientKey, pay.Messages[len(pay.Messages)-1])
-			pay.UpdateMessages(closeMessage)
-			return *closeMessage
+			closeMessage, err := pay.Close(clientKey)
+			if err != nil {
+				return ChannelMessage{}, err
+			}
+			return closeMessage, ErrPORFailed
 		}
 	}
 
-	payMessage := NewMessage(SendPayment, pay.Payment, pay.ChannelID, clientKey, pay.Messages[len(pay.Messages)-1])
-	pay.UpdateMessages(payMessage)
-	return *payMessage
+	return pay.SendPayment(clientKey, pay.Payment)
 }
 
-// RequestPOR done by client 
-func (pay *PaymentChannel) RequestPOR(clientKey *ecdsa.PrivateKey, k uint) ChannelMessage {
+// RequestPOR done by client. An error is returned if the channel is not active.
+func (pay *PaymentChannel) RequestPOR(clientKey *ecdsa.PrivateKey, k uint) (ChannelMessage, error) {
 	// because the client is requesting the POR, they choose the challenge and there is no
 	// puzzle value
 	// provide list of indices to test on 
@@ -247,24 +422,33 @@ func (pay *PaymentChannel) RequestPOR(clientKey *ecdsa.PrivateKey, k uint) Chann
 		panic(err)
 	}
 	
-	challenge := NewMessage(PORRequest, identifierstring, pay.ChannelID, clientKey, pay.Messages[len(pay.Messages)-1])
-    pay.UpdateMessages(challenge)
-	return *challenge
+	challenge := NewMessage(PORRequest, identifierstring, pay.ChannelID, clientKey, pay.GetMostRecent())
+	if err := pay.UpdateMessages(challenge); err != nil {
+		return ChannelMessage{}, err
+	}
+	return *challenge, nil
 }
 
-func (pay *PaymentChannel) RespondToPOR(aldermanKey *ecdsa.PrivateKey, k uint) ChannelMessage {
-	lastMessage := pay.Messages[len(pay.Messages)-1]
-    
-	if msgType, payload, _ := lastMessage.GetPayload(); msgType == PORRequest {
-        // use the payload as the challenge for the POR
-        // TODO ask TUshar if we want go tie the blockchainVal to the payment 
-        // channel... 
-        proofToSend := por.ProducePOR(aldermanKey, pay.BlockchainState, pay.Encoding, k, payload)
-        message := NewMessage(PORResponse, &proofToSend, pay.ChannelID, aldermanKey, lastMessage)
-        pay.UpdateMessages(message)
-	    return *message
-	} else {
+// RespondToPOR done by alderman. An error is returned if the most recent
+// message of the channel is not a PORRequest.
+func (pay *PaymentChannel) RespondToPOR(aldermanKey *ecdsa.PrivateKey, k uint) (ChannelMessage, error) {
+	lastMessage := pay.GetMostRecent()
+	msgType, payload, err := lastMessage.GetPayload()
+	if err != nil {
+		return ChannelMessage{}, err
+	}
+	if msgType != PORRequest {
 		// code was called with the wrong input
-		panic("Received bad input -- message was not for a POR")
+		return ChannelMessage{}, fmt.Errorf("most recent message is %v, not %v", msgType, PORRequest)
+	}
+
+	// use the payload as the challenge for the POR
+	// TODO ask TUshar if we want go tie the blockchainVal to the payment 
+	// channel... 
+	proofToSend := por.ProducePOR(aldermanKey, pay.BlockchainState, pay.Encoding, k, payload)
+	message := NewMessage(PORResponse, &proofToSend, pay.ChannelID, aldermanKey, lastMessage)
+	if err := pay.UpdateMessages(message); err != nil {
+		return ChannelMessage{}, err
 	}
-}
\ No newline at end of file
+	return *message, nil
+}
@@ -0,0 +1,392 @@
+package client
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/tusharjois/councilfs/ledger"
+	"github.com/tusharjois/councilfs/por"
+)
+
+func TestMessageWireEncoding(t *testing.T) {
+	clientKey := por.GenerateKey()
+	channelID := make([]byte, CLIENTIDSIZE)
+	channelID[0] = 1
+
+	first := NewMessage(ChannelOpen, "open", channelID, clientKey, nil)
+	second := NewMessage(PORRequest, []byte("challenge"), channelID, clientKey, first)
+
+	decoded, err := ParseMessage(second.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, second) {
+		t.Errorf("decoded message %v does not match original %v", decoded, second)
+	}
+	if decoded.Hash() != second.Hash() {
+		t.Errorf("hash of decoded message differs from original")
+	}
+
+	// the second message must commit to the contents of the first
+	if second.GetPrevHash() != first.Hash() {
+		t.Errorf("previous hash does not match hash of previous message")
+	}
+	other := NewMessage(ChannelOpen, "other", channelID, clientKey, nil)
+	third := NewMessage(PORRequest, []byte("challenge"), channelID, clientKey, other)
+	if third.GetPrevHash() == second.GetPrevHash() {
+		t.Errorf("messages with different predecessors share a previous hash")
+	}
+
+	// malformed encodings must be rejected
+	encoded := second.Marshal()
+	if _, err := ParseMessage(bytes.Replace(encoded, []byte("\"ChannelID\":\""), []byte("\"ChannelID\":\"AAAA"), 1)); err == nil {
+		t.Errorf("accepted message with oversized channel ID")
+	}
+	if _, err := ParseMessage([]byte("{}")); err == nil {
+		t.Errorf("accepted empty message")
+	}
+}
+
+// newTestChannel opens a channel between a fresh client and alderman and
+// returns the client's view of it along with both keys.
+func newTestChannel(t *testing.T) (*PaymentChannel, *ecdsa.PrivateKey, *ecdsa.PrivateKey) {
+	encoding, err := por.CreateErasureCoding([]byte("Left Munich at 8:35 P. M., on 1st May"), 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey := por.GenerateKey()
+	aldermanKey := por.GenerateKey()
+	channel, _, _ := OpenChannel(clientKey, &aldermanKey.PublicKey, 20, 10, encoding)
+	return channel, clientKey, aldermanKey
+}
+
+func TestValidate(t *testing.T) {
+	channel, clientKey, aldermanKey := newTestChannel(t)
+	accept := NewMessage(ChannelAccepted, "accept", channel.ChannelID, aldermanKey, channel.GetMostRecent())
+	if err := channel.UpdateMessages(accept); err != nil {
+		t.Fatal(err)
+	}
+	request := NewMessage(FundsCreated, []byte("funding"), channel.ChannelID, clientKey, accept)
+	if err := channel.UpdateMessages(request); err != nil {
+		t.Fatal(err)
+	}
+	if err := channel.Validate(); err != nil {
+		t.Fatalf("valid channel failed to validate: %v", err)
+	}
+
+	// messages from the wrong party, or not linked to the log, are refused
+	wrongParty := NewMessage(FundsApproved, []byte("funding"), channel.ChannelID, clientKey, request)
+	if err := channel.UpdateMessages(wrongParty); err == nil {
+		t.Errorf("accepted FundsApproved signed by the client")
+	}
+	unlinked := NewMessage(FundsApproved, []byte("funding"), channel.ChannelID, aldermanKey, accept)
+	if err := channel.UpdateMessages(unlinked); err == nil {
+		t.Errorf("accepted message that does not link to the most recent message")
+	}
+	if len(channel.Messages) != 3 {
+		t.Errorf("refused messages were added to the channel")
+	}
+
+	// tampering with the log is reported at the first divergent message
+	tampered := *channel
+	tampered.Messages = append([]*ChannelMessage{}, channel.Messages...)
+	forged := *accept
+	forged.payload = []byte("\"forged\"")
+	tampered.Messages[1] = &forged
+	err := tampered.Validate()
+	if verr, ok := err.(*ValidationError); !ok || verr.Index != 1 {
+		t.Errorf("expected divergence at message 1, got %v", err)
+	}
+
+	reordered := *channel
+	reordered.Messages = []*ChannelMessage{channel.Messages[0], channel.Messages[2], channel.Messages[1]}
+	err = reordered.Validate()
+	if verr, ok := err.(*ValidationError); !ok || verr.Index != 1 {
+		t.Errorf("expected divergence at message 1, got %v", err)
+	}
+}
+
+func TestChannelStateMachine(t *testing.T) {
+	path := []struct {
+		mType MessageType
+		state ChannelState
+	}{
+		{ChannelAccepted, StateAccepted},
+		{FundsCreated, StateFunded},
+		{FundsApproved, StateActive},
+		{SendPayment, StateActive},
+		{PORRequest, StateChallenged},
+		{PORResponse, StateChallenged},
+		{SendPayment, StateActive},
+		{CloseChannel, StateClosing},
+		{CloseChannel, StateClosed},
+	}
+	state := StateOpen
+	for _, transition := range path {
+		next, err := state.Next(transition.mType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next != transition.state {
+			t.Fatalf("%v in state %v reached %v, expected %v", transition.mType, state, next, transition.state)
+		}
+		state = next
+	}
+
+	illegal := []struct {
+		state ChannelState
+		mType MessageType
+	}{
+		{StateOpen, FundsCreated},
+		{StateAccepted, PORRequest},
+		{StateAccepted, SendPayment},
+		{StateFunded, SendPayment},
+		{StateActive, PORResponse},
+		{StateChallenged, PORRequest},
+		{StateClosing, SendPayment},
+		{StateClosed, SendPayment},
+		{StateClosed, CloseChannel},
+	}
+	for _, transition := range illegal {
+		if _, err := transition.state.Next(transition.mType); err == nil {
+			t.Errorf("%v allowed in state %v", transition.mType, transition.state)
+		}
+	}
+
+	// the channel itself refuses messages that are out of order
+	channel, clientKey, aldermanKey := newTestChannel(t)
+	if _, err := channel.RequestPOR(clientKey, 1); err == nil {
+		t.Errorf("POR requested before the channel was accepted")
+	}
+	early := NewMessage(SendPayment, 20, channel.ChannelID, clientKey, channel.GetMostRecent())
+	if err := channel.UpdateMessages(early); err == nil {
+		t.Errorf("payment sent before the channel was funded")
+	}
+	accept := NewMessage(ChannelAccepted, "accept", channel.ChannelID, aldermanKey, channel.GetMostRecent())
+	if err := channel.UpdateMessages(accept); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := channel.State(); err != nil || state != StateAccepted {
+		t.Errorf("channel in state %v, expected %v", state, StateAccepted)
+	}
+}
+
+// newFundedChannel opens a channel and funds it with the given amount, as both
+// the client and the alderman would.
+func newFundedChannel(t *testing.T, amount uint) (*PaymentChannel, *ecdsa.PrivateKey, *ecdsa.PrivateKey, *ledger.Memory) {
+	channel, clientKey, aldermanKey := newTestChannel(t)
+	accept := NewMessage(ChannelAccepted, "accept", channel.ChannelID, aldermanKey, channel.GetMostRecent())
+	if err := channel.UpdateMessages(accept); err != nil {
+		t.Fatal(err)
+	}
+	funds := ledger.NewMemory()
+	if _, err := channel.CreateFunding(clientKey, funds, amount); err != nil {
+		t.Fatal(err)
+	}
+	txID, funded, err := channel.CheckFunding(funds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if funded != amount {
+		t.Fatalf("funding of %v found for %v", funded, amount)
+	}
+	approve := NewMessage(FundsApproved, txID, channel.ChannelID, aldermanKey, channel.GetMostRecent())
+	if err := channel.UpdateMessages(approve); err != nil {
+		t.Fatal(err)
+	}
+	return channel, clientKey, aldermanKey, funds
+}
+
+func TestPaymentCommitments(t *testing.T) {
+	unfunded, unfundedKey, _ := newTestChannel(t)
+	if _, err := unfunded.SendPayment(unfundedKey, 5); err == nil {
+		t.Errorf("payment sent on a channel that is not funded")
+	}
+
+	channel, clientKey, aldermanKey, _ := newFundedChannel(t, 20)
+	if _, err := channel.SendPayment(clientKey, 5); err != nil {
+		t.Fatal(err)
+	}
+	first := channel.GetMostRecent()
+	if _, err := channel.SendPayment(clientKey, 10); err != nil {
+		t.Fatal(err)
+	}
+	latest := channel.LatestCommitment()
+	if latest.Paid != 15 || latest.Sequence != 2 {
+		t.Errorf("latest commitment pays %v at sequence %v, expected 15 at 2", latest.Paid, latest.Sequence)
+	}
+	if paid, remaining := channel.Balance(); paid != 15 || remaining != 5 {
+		t.Errorf("balance is %v paid and %v remaining, expected 15 and 5", paid, remaining)
+	}
+
+	// the client cannot pay past the funding of the channel
+	if _, err := channel.SendPayment(clientKey, 10); err == nil {
+		t.Errorf("payment exceeding the funding was sent")
+	}
+
+	// an old commitment cannot be replayed
+	replay := NewMessage(SendPayment, json.RawMessage(first.payload), channel.ChannelID, clientKey, channel.GetMostRecent())
+	if err := channel.UpdateMessages(replay); err == nil {
+		t.Errorf("old commitment was accepted again")
+	}
+
+	// nor can the alderman forge a commitment
+	forged := &Commitment{ChannelID: channel.ChannelID, Paid: 20, Sequence: 3}
+	digest := forged.Digest()
+	forged.Signature = por.SignAndMarshal(aldermanKey, digest[:])
+	forgedMsg := NewMessage(SendPayment, forged, channel.ChannelID, clientKey, channel.GetMostRecent())
+	if err := channel.UpdateMessages(forgedMsg); err == nil {
+		t.Errorf("commitment signed by the alderman was accepted")
+	}
+
+	if err := channel.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	// a commitment that cannot be parsed is passed over
+	channel.Messages = append(channel.Messages, &ChannelMessage{mType: SendPayment, payload: []byte("not a commitment")})
+	if latest := channel.LatestCommitment(); latest == nil || latest.Sequence != 2 {
+		t.Errorf("unparsable commitment was not passed over")
+	}
+}
+
+func TestCooperativeClose(t *testing.T) {
+	channel, clientKey, aldermanKey, funds := newFundedChannel(t, 20)
+	if _, err := channel.SendPayment(clientKey, 5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := channel.Close(clientKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := channel.SubmitCooperativeClose(clientKey, ledger.NewMemory()); err == nil {
+		t.Errorf("settlement submitted before the alderman countersigned")
+	}
+	// the client cannot countersign their own close
+	if _, err := channel.Close(clientKey); err == nil {
+		t.Errorf("client countersigned their own close")
+	}
+	if _, err := channel.Close(aldermanKey); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := channel.State(); state != StateClosed {
+		t.Errorf("channel in state %v, expected %v", state, StateClosed)
+	}
+	if err := channel.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	closeID, err := channel.SubmitCooperativeClose(aldermanKey, funds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settlement, err := ResolveClose(funds, closeID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settlement.Paid != 5 || settlement.Sequence != 1 {
+		t.Errorf("settled %v at sequence %v, expected 5 at 1", settlement.Paid, settlement.Sequence)
+	}
+
+	// a settled channel cannot be closed again
+	if _, err := channel.SubmitCooperativeClose(clientKey, funds); err == nil {
+		t.Errorf("settlement submitted twice")
+	}
+	if _, err := channel.PublishClose(clientKey, funds); err == nil {
+		t.Errorf("settled channel closed unilaterally")
+	}
+}
+
+func TestUnilateralClose(t *testing.T) {
+	channel, clientKey, aldermanKey, funds := newFundedChannel(t, 20)
+	if _, err := channel.SendPayment(clientKey, 5); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	funds.Clock = func() time.Time { return start }
+
+	// the client publishes an older state of the channel than the alderman holds
+	stale, err := channel.PublishClose(clientKey, funds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a dispute must carry a newer commitment than the published close
+	if _, err := channel.DisputeClose(aldermanKey, funds, stale); err == nil {
+		t.Errorf("dispute submitted without a newer commitment")
+	}
+	if _, err := channel.SendPayment(clientKey, 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveClose(funds, stale, start); err != ErrDisputeWindowOpen {
+		t.Errorf("expected open dispute window, got %v", err)
+	}
+
+	// the alderman answers within the dispute window with the newer state
+	funds.Clock = func() time.Time { return start.Add(channel.DisputeWindow / 2) }
+	if _, err := channel.DisputeClose(aldermanKey, funds, stale); err != nil {
+		t.Fatal(err)
+	}
+	settlement, err := ResolveClose(funds, stale, start.Add(channel.DisputeWindow))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settlement.Paid != 15 || settlement.Sequence != 2 {
+		t.Errorf("settled %v at sequence %v, expected 15 at 2", settlement.Paid, settlement.Sequence)
+	}
+
+	// the channel cannot be closed again, nor settled by a later close
+	if _, err := channel.PublishClose(aldermanKey, funds); err == nil {
+		t.Errorf("channel closed twice")
+	}
+	payload := UnilateralClosePayload{ChannelID: channel.ChannelID, FundingID: channel.FundingID}
+	later, err := funds.Submit(ledger.NewTransaction(ledger.UnilateralClose, channel.FundingID, payload, aldermanKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolveClose(funds, later, start.Add(2*channel.DisputeWindow)); err == nil {
+		t.Errorf("later close of a closed channel resolved")
+	}
+}
+
+func TestDisputeLowerPayment(t *testing.T) {
+	channel, clientKey, aldermanKey, funds := newFundedChannel(t, 20)
+	if _, err := channel.SendPayment(clientKey, 5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := channel.SendPayment(clientKey, 10); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	funds.Clock = func() time.Time { return start }
+	closeID, err := channel.PublishClose(aldermanKey, funds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client signs a commitment paying less at a higher sequence
+	forged := &Commitment{ChannelID: channel.ChannelID, Paid: 1, Sequence: 99}
+	digest := forged.Digest()
+	forged.Signature = por.SignAndMarshal(clientKey, digest[:])
+	encoded, err := json.Marshal(forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel.Messages = append(channel.Messages, &ChannelMessage{mType: SendPayment, payload: encoded})
+	if _, err := channel.DisputeClose(clientKey, funds, closeID); err == nil {
+		t.Errorf("dispute paying less than the published close was submitted")
+	}
+	dispute := DisputeClosePayload{Commitment: *forged}
+	if _, err := funds.Submit(ledger.NewTransaction(ledger.DisputeClose, closeID, dispute, clientKey)); err != nil {
+		t.Fatal(err)
+	}
+	settlement, err := ResolveClose(funds, closeID, start.Add(channel.DisputeWindow))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settlement.Paid != 15 || settlement.Sequence != 2 {
+		t.Errorf("settled %v at sequence %v, expected 15 at 2", settlement.Paid, settlement.Sequence)
+	}
+}
@@ -0,0 +1,409 @@
+package client
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tusharjois/councilfs/ledger"
+	"github.com/tusharjois/councilfs/por"
+)
+
+// Settlement is the final balance of a PaymentChannel. The alderman is owed
+// Paid of the channel's funding, as committed to by the client in the
+// Commitment with Sequence, and the rest of the funding returns to the client.
+type Settlement struct {
+	ChannelID []byte
+	FundingID []byte
+	Paid      uint
+	Sequence  uint64
+}
+
+// Digest returns the digest of the settlement signed by each party.
+func (s *Settlement) Digest() [sha256.Size]byte {
+	h := sha256.New()
+	writeField(h, s.ChannelID)
+	writeField(h, s.FundingID)
+	var numbers [16]byte
+	binary.BigEndian.PutUint64(numbers[:8], uint64(s.Paid))
+	binary.BigEndian.PutUint64(numbers[8:], s.Sequence)
+	h.Write(numbers[:])
+	var digest [sha256.Size]byte
+	copy(digest[:], h.Sum(nil))
+	return digest
+}
+
+// CloseProposal is the payload of a CloseChannel message: the Settlement the
+// sender agrees to, signed by them.
+type CloseProposal struct {
+	Settlement Settlement
+	Signature  []byte
+}
+
+// CooperativeClosePayload is the payload of a ledger.CooperativeClose
+// transaction, carrying the settlement signed by both parties.
+type CooperativeClosePayload struct {
+	Settlement        Settlement
+	ClientSignature   []byte
+	AldermanSignature []byte
+}
+
+// UnilateralClosePayload is the payload of a ledger.UnilateralClose
+// transaction, carrying the latest commitment held by the publisher, or nil
+// if the client never paid.
+type UnilateralClosePayload struct {
+	ChannelID  []byte
+	FundingID  []byte
+	Commitment *Commitment
+}
+
+// DisputeClosePayload is the payload of a ledger.DisputeClose transaction,
+// carrying a commitment that supersedes the one of the UnilateralClose it
+// refers to.
+type DisputeClosePayload struct {
+	Commitment Commitment
+}
+
+// ErrDisputeWindowOpen is returned when resolving a unilateral close before
+// its dispute window has passed.
+var ErrDisputeWindowOpen = errors.New("dispute window of close is still open")
+
+// settlementAfter returns the Settlement of the channel given its latest
+// commitment, which is nil if the client has not paid.
+func (pay *PaymentChannel) settlementAfter(latest *Commitment) Settlement {
+	settlement := Settlement{ChannelID: pay.ChannelID, FundingID: pay.FundingID}
+	if latest != nil {
+		settlement.Paid = latest.Paid
+		settlement.Sequence = latest.Sequence
+	}
+	return settlement
+}
+
+// checkClose checks the CloseProposal in a CloseChannel message against the
+// latest commitment of the channel. A CloseChannel that follows another must
+// come from the other party, so the two messages together are signed by both.
+func (pay *PaymentChannel) checkClose(latest *Commitment, prev *ChannelMessage, msg *ChannelMessage) error {
+	var proposal CloseProposal
+	if err := json.Unmarshal(msg.payload, &proposal); err != nil {
+		return err
+	}
+	expected := pay.settlementAfter(latest)
+	if proposal.Settlement.Digest() != expected.Digest() {
+		return errors.New("close does not settle the latest balance of the channel")
+	}
+	senderKey, err := parsePublicKey(msg.senderPublicKey)
+	if err != nil {
+		return err
+	}
+	digest := proposal.Settlement.Digest()
+	if !por.VerifyAndUnMarshal(senderKey, digest[:], proposal.Signature) {
+		return errors.New("close proposal signature does not verify")
+	}
+	if prev != nil && prev.mType == CloseChannel && bytes.Equal(prev.senderPublicKey, msg.senderPublicKey) {
+		return errors.New("close must be countersigned by the other party")
+	}
+	return nil
+}
+
+// Close is done by either party to close the channel. The CloseChannel message
+// proposes to settle the channel at its latest commitment. If the other party
+// already proposed to close, the message countersigns their proposal and the
+// channel is closed, after which either party can settle it on the ledger with
+// SubmitCooperativeClose.
+func (pay *PaymentChannel) Close(key *ecdsa.PrivateKey) (ChannelMessage, error) {
+	settlement := pay.settlementAfter(pay.LatestCommitment())
+	digest := settlement.Digest()
+	proposal := CloseProposal{Settlement: settlement, Signature: por.SignAndMarshal(key, digest[:])}
+
+	closeMessage := NewMessage(CloseChannel, proposal, pay.ChannelID, key, pay.GetMostRecent())
+	if err := pay.UpdateMessages(closeMessage); err != nil {
+		return ChannelMessage{}, err
+	}
+	return *closeMessage, nil
+}
+
+// SubmitCooperativeClose submits the settlement that both parties signed when
+// closing the channel to the ledger, and returns the transaction ID. An error
+// is returned if the channel was already closed on the ledger.
+func (pay *PaymentChannel) SubmitCooperativeClose(key *ecdsa.PrivateKey, l ledger.Ledger) ([]byte, error) {
+	state, err := pay.State()
+	if err != nil {
+		return nil, err
+	}
+	if state != StateClosed {
+		return nil, fmt.Errorf("channel in state %v has not been closed by both parties", state)
+	}
+	if err := checkUnclosed(l, pay.FundingID); err != nil {
+		return nil, err
+	}
+
+	payload := CooperativeClosePayload{}
+	for _, msg := range pay.Messages[len(pay.Messages)-2:] {
+		var proposal CloseProposal
+		if err := json.Unmarshal(msg.payload, &proposal); err != nil {
+			return nil, err
+		}
+		payload.Settlement = proposal.Settlement
+		if bytes.Equal(msg.senderPublicKey, pay.ClientPublicKey) {
+			payload.ClientSignature = proposal.Signature
+		} else {
+			payload.AldermanSignature = proposal.Signature
+		}
+	}
+	return l.Submit(ledger.NewTransaction(ledger.CooperativeClose, pay.FundingID, payload, key))
+}
+
+// PublishClose is done by either party when the other stops responding. It
+// publishes the latest commitment of the channel to the ledger, starting the
+// dispute window of the channel, and returns the transaction ID. An error is
+// returned if the channel was already closed on the ledger; a newer
+// commitment is then published with DisputeClose.
+func (pay *PaymentChannel) PublishClose(key *ecdsa.PrivateKey, l ledger.Ledger) ([]byte, error) {
+	if pay.FundingID == nil {
+		return nil, errors.New("channel was never funded")
+	}
+	if err := checkUnclosed(l, pay.FundingID); err != nil {
+		return nil, err
+	}
+	payload := UnilateralClosePayload{
+		ChannelID:  pay.ChannelID,
+		FundingID:  pay.FundingID,
+		Commitment: pay.LatestCommitment(),
+	}
+	return l.Submit(ledger.NewTransaction(ledger.UnilateralClose, pay.FundingID, payload, key))
+}
+
+// DisputeClose answers the unilateral close with ID closeID with the latest
+// commitment of the channel, and returns the transaction ID. An error is
+// returned if the channel holds no commitment that supersedes the published
+// one.
+func (pay *PaymentChannel) DisputeClose(key *ecdsa.PrivateKey, l ledger.Ledger, closeID []byte) ([]byte, error) {
+	closeTx, err := l.Lookup(closeID)
+	if err != nil {
+		return nil, err
+	}
+	var published UnilateralClosePayload
+	if err := json.Unmarshal(closeTx.Payload, &published); err != nil {
+		return nil, err
+	}
+	latest := pay.LatestCommitment()
+	if latest == nil || !supersedes(latest, published.Commitment) {
+		return nil, errors.New("channel holds no commitment that supersedes the published close")
+	}
+	payload := DisputeClosePayload{Commitment: *latest}
+	return l.Submit(ledger.NewTransaction(ledger.DisputeClose, closeID, payload, key))
+}
+
+// supersedes reports whether commitment settles a channel in place of
+// published, which is nil if the close published no commitment. As the client
+// signs every commitment, a higher Sequence alone proves nothing: the
+// commitment must pay the alderman more, or as much at a higher Sequence.
+func supersedes(commitment *Commitment, published *Commitment) bool {
+	if published == nil {
+		return true
+	}
+	if commitment.Paid != published.Paid {
+		return commitment.Paid > published.Paid
+	}
+	return commitment.Sequence > published.Sequence
+}
+
+// lookupFunding returns the funding of a channel from the ledger.
+func lookupFunding(l ledger.Ledger, fundingID []byte) (*FundingPayload, error) {
+	tx, err := l.Lookup(fundingID)
+	if err != nil {
+		return nil, err
+	}
+	if tx.Kind != ledger.Funding {
+		return nil, fmt.Errorf("transaction %x is not a funding transaction", fundingID)
+	}
+	funding := new(FundingPayload)
+	if err := json.Unmarshal(tx.Payload, funding); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(tx.Sender, funding.ClientPublicKey) {
+		return nil, fmt.Errorf("funding transaction %x was not made by its client", fundingID)
+	}
+	return funding, nil
+}
+
+// checkFundedCommitment checks that a commitment is signed by the client and
+// does not pay more than the funding of its channel.
+func checkFundedCommitment(funding *FundingPayload, commitment *Commitment) error {
+	if !bytes.Equal(commitment.ChannelID, funding.ChannelID) {
+		return errors.New("commitment is for a different channel")
+	}
+	if err := commitment.Verify(funding.ClientPublicKey); err != nil {
+		return err
+	}
+	if commitment.Paid > funding.Amount {
+		return fmt.Errorf("commitment pays %v, which is more than the funding of %v", commitment.Paid, funding.Amount)
+	}
+	return nil
+}
+
+// isParty reports whether a key is the client or alderman of a funding.
+func isParty(funding *FundingPayload, key []byte) bool {
+	return bytes.Equal(key, funding.ClientPublicKey) || bytes.Equal(key, funding.AldermanPublicKey)
+}
+
+// parseClose checks a close transaction against the funding of the channel
+// it settles, and returns the funding and the settlement the close proposes:
+// the final one of a cooperative close, or the one published by a unilateral
+// close before any dispute. A close must refer to the FundingID it settles.
+func parseClose(l ledger.Ledger, closeTx *ledger.Transaction) (*FundingPayload, *Settlement, error) {
+	switch closeTx.Kind {
+	case ledger.CooperativeClose:
+		var payload CooperativeClosePayload
+		if err := json.Unmarshal(closeTx.Payload, &payload); err != nil {
+			return nil, nil, err
+		}
+		if !bytes.Equal(closeTx.Ref, payload.Settlement.FundingID) {
+			return nil, nil, errors.New("close does not refer to the funding it settles")
+		}
+		funding, err := lookupFunding(l, payload.Settlement.FundingID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !bytes.Equal(payload.Settlement.ChannelID, funding.ChannelID) {
+			return nil, nil, errors.New("settlement is for a different channel")
+		}
+		if payload.Settlement.Paid > funding.Amount {
+			return nil, nil, errors.New("settlement pays more than the funding of the channel")
+		}
+		digest := payload.Settlement.Digest()
+		for _, signer := range []struct {
+			key       []byte
+			signature []byte
+		}{
+			{funding.ClientPublicKey, payload.ClientSignature},
+			{funding.AldermanPublicKey, payload.AldermanSignature},
+		} {
+			signerKey, err := parsePublicKey(signer.key)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !por.VerifyAndUnMarshal(signerKey, digest[:], signer.signature) {
+				return nil, nil, errors.New("settlement is not signed by both parties")
+			}
+		}
+		return funding, &payload.Settlement, nil
+
+	case ledger.UnilateralClose:
+		var payload UnilateralClosePayload
+		if err := json.Unmarshal(closeTx.Payload, &payload); err != nil {
+			return nil, nil, err
+		}
+		if !bytes.Equal(closeTx.Ref, payload.FundingID) {
+			return nil, nil, errors.New("close does not refer to the funding it settles")
+		}
+		funding, err := lookupFunding(l, payload.FundingID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !bytes.Equal(payload.ChannelID, funding.ChannelID) {
+			return nil, nil, errors.New("close is for a different channel")
+		}
+		if !isParty(funding, closeTx.Sender) {
+			return nil, nil, errors.New("close was not published by a party of the channel")
+		}
+		settlement := &Settlement{ChannelID: payload.ChannelID, FundingID: payload.FundingID}
+		if payload.Commitment != nil {
+			if err := checkFundedCommitment(funding, payload.Commitment); err != nil {
+				return nil, nil, err
+			}
+			settlement.Paid = payload.Commitment.Paid
+			settlement.Sequence = payload.Commitment.Sequence
+		}
+		return funding, settlement, nil
+	}
+	return nil, nil, fmt.Errorf("transaction %x does not close a channel", closeTx.ID())
+}
+
+// firstClose returns the ID of the first valid close published for the
+// funding with fundingID, settled or not, or nil if the channel was never
+// closed on the ledger.
+func firstClose(l ledger.Ledger, fundingID []byte) ([]byte, error) {
+	txs, err := l.References(fundingID)
+	if err != nil {
+		return nil, err
+	}
+	for _, tx := range txs {
+		if _, _, err := parseClose(l, tx); err == nil {
+			return tx.ID(), nil
+		}
+	}
+	return nil, nil
+}
+
+// checkUnclosed returns an error if the channel funded by fundingID was
+// already closed on the ledger.
+func checkUnclosed(l ledger.Ledger, fundingID []byte) error {
+	closeID, err := firstClose(l, fundingID)
+	if err != nil {
+		return err
+	}
+	if closeID != nil {
+		return fmt.Errorf("channel was already closed by transaction %x", closeID)
+	}
+	return nil
+}
+
+// ResolveClose computes the Settlement of a channel from the close transaction
+// with ID closeID on the ledger. A cooperative close is settled immediately.
+// A unilateral close is settled once its dispute window has passed as of now,
+// at the valid commitment published by either party during the window that
+// pays the alderman most, the newest of those paying as much; before that, ErrDisputeWindowOpen is returned. Only the first valid close of
+// a funding settles it; an error is returned for any later one.
+func ResolveClose(l ledger.Ledger, closeID []byte, now time.Time) (*Settlement, error) {
+	closeTx, err := l.Lookup(closeID)
+	if err != nil {
+		return nil, err
+	}
+	funding, settlement, err := parseClose(l, closeTx)
+	if err != nil {
+		return nil, err
+	}
+	first, err := firstClose(l, settlement.FundingID)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(first, closeID) {
+		return nil, fmt.Errorf("channel was already closed by transaction %x", first)
+	}
+	if closeTx.Kind == ledger.CooperativeClose {
+		return settlement, nil
+	}
+
+	deadline := time.Unix(closeTx.Timestamp, 0).Add(funding.DisputeWindow)
+	if now.Before(deadline) {
+		return nil, ErrDisputeWindowOpen
+	}
+	disputes, err := l.References(closeID)
+	if err != nil {
+		return nil, err
+	}
+	for _, dispute := range disputes {
+		if dispute.Kind != ledger.DisputeClose || !isParty(funding, dispute.Sender) ||
+			time.Unix(dispute.Timestamp, 0).After(deadline) {
+			continue
+		}
+		var disputePayload DisputeClosePayload
+		if err := json.Unmarshal(dispute.Payload, &disputePayload); err != nil {
+			continue
+		}
+		commitment := disputePayload.Commitment
+		current := &Commitment{Paid: settlement.Paid, Sequence: settlement.Sequence}
+		if checkFundedCommitment(funding, &commitment) != nil || !supersedes(&commitment, current) {
+			continue
+		}
+		settlement.Paid = commitment.Paid
+		settlement.Sequence = commitment.Sequence
+	}
+	return settlement, nil
+}
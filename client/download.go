@@ -0,0 +1,322 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/tusharjois/councilfs/por"
+)
+
+// RequestShards is done by the client to download shards of its file from the
+// alderman. Shards are named by their index in the erasure coding; requesting
+// no shards asks for every shard the alderman holds. An error is returned if
+// the channel is not active.
+func (pay *PaymentChannel) RequestShards(clientKey *ecdsa.PrivateKey, shards []int) (ChannelMessage, error) {
+	request := NewMessage(ShardRequest, shards, pay.ChannelID, clientKey, pay.GetMostRecent())
+	if err := pay.UpdateMessages(request); err != nil {
+		return ChannelMessage{}, err
+	}
+	return *request, nil
+}
+
+// ShardDelivery is the payload of a ShardResponse: the next shards of those
+// requested, the Price the alderman asks for each of them, and the indices of
+// the requested shards it holds but has not sent yet. An alderman that charges
+// for retrieval sends one shard at a time and sends no more until it is paid.
+type ShardDelivery struct {
+	Shards    *por.EncodedDataset
+	Price     uint
+	Remaining []int
+}
+
+// Due returns what the client owes for the delivered shards.
+func (delivery *ShardDelivery) Due() uint {
+	return delivery.Price * delivery.Shards.Length()
+}
+
+// shardCharge is the part of a ShardDelivery needed to tell what it costs,
+// decoded without checking the shards against their hashes.
+type shardCharge struct {
+	Price  uint
+	Shards struct {
+		Ordering []int
+	}
+}
+
+// RetrievalOwed returns what the client owes for shards the alderman has
+// delivered on the channel and that are not yet paid for. Payments made after
+// a delivery pay for it before they pay for storage. Messages that cannot be
+// parsed, which UpdateMessages never adds, are skipped.
+func (pay *PaymentChannel) RetrievalOwed() uint {
+	owed, _ := pay.retrieval()
+	return owed
+}
+
+// StoragePaid returns how much of what the client has paid on the channel
+// pays for storage rather than for shards delivered, counted the same way as
+// RetrievalOwed.
+func (pay *PaymentChannel) StoragePaid() uint {
+	_, storage := pay.retrieval()
+	return storage
+}
+
+// retrieval returns what the client owes for shards delivered on the channel,
+// and how much it has paid for storage.
+func (pay *PaymentChannel) retrieval() (uint, uint) {
+	var owed, paid, storage uint
+	for _, msg := range pay.Messages {
+		switch msg.mType {
+		case ShardResponse:
+			var charge shardCharge
+			if err := json.Unmarshal(msg.payload, &charge); err == nil {
+				owed += charge.Price * uint(len(charge.Shards.Ordering))
+			}
+		case SendPayment:
+			commitment, err := parseCommitment(msg)
+			if err != nil {
+				continue
+			}
+			if delta := commitment.Paid - paid; delta < owed {
+				owed -= delta
+			} else {
+				storage += delta - owed
+				owed = 0
+			}
+			paid = commitment.Paid
+		}
+	}
+	return owed, storage
+}
+
+// SendShards is done by the alderman to answer the ShardRequest most recently
+// received on the channel with the requested shards of the channel's
+// Encoding, asking price for each. Shards the alderman does not hold are left
+// out. If price is not zero only the first shard is sent, and the others are
+// listed as Remaining for the client to request once it has paid. An error is
+// returned if the client has not paid for the shards already delivered.
+func (pay *PaymentChannel) SendShards(aldermanKey *ecdsa.PrivateKey, price uint) (ChannelMessage, error) {
+	lastMessage := pay.GetMostRecent()
+	msgType, payload, err := lastMessage.GetPayload()
+	if err != nil {
+		return ChannelMessage{}, err
+	}
+	if msgType != ShardRequest {
+		return ChannelMessage{}, fmt.Errorf("most recent message is %v, not %v", msgType, ShardRequest)
+	}
+	if pay.Encoding == nil {
+		return ChannelMessage{}, errors.New("channel holds no shards")
+	}
+	if owed := pay.RetrievalOwed(); owed > 0 {
+		return ChannelMessage{}, fmt.Errorf("%v is owed for shards already delivered", owed)
+	}
+	var requested []int
+	if err := json.Unmarshal(payload, &requested); err != nil {
+		return ChannelMessage{}, err
+	}
+
+	ordering := pay.Encoding.Ordering()
+	positions := make(map[int]int)
+	for position, index := range ordering {
+		positions[index] = position
+	}
+	var selected []int
+	if requested == nil {
+		for position := range ordering {
+			selected = append(selected, position)
+		}
+	}
+	sent := make(map[int]bool)
+	for _, index := range requested {
+		if position, held := positions[index]; held && !sent[index] {
+			selected = append(selected, position)
+			sent[index] = true
+		}
+	}
+	if len(selected) == 0 {
+		return ChannelMessage{}, errors.New("alderman holds none of the requested shards")
+	}
+
+	delivery := ShardDelivery{Price: price}
+	if price > 0 {
+		for _, position := range selected[1:] {
+			delivery.Remaining = append(delivery.Remaining, ordering[position])
+		}
+		selected = selected[:1]
+	}
+	delivery.Shards, err = por.SelectSegments(pay.Encoding, selected)
+	if err != nil {
+		return ChannelMessage{}, err
+	}
+	message := NewMessage(ShardResponse, delivery, pay.ChannelID, aldermanKey, lastMessage)
+	if err := pay.UpdateMessages(message); err != nil {
+		return ChannelMessage{}, err
+	}
+	return *message, nil
+}
+
+// ReceivedShards returns the delivery carried by the most recent message of
+// the channel, a ShardResponse, once its shards are checked against the
+// manifest of the file. An error is returned if the alderman sent shards that
+// are not part of the file.
+func (pay *PaymentChannel) ReceivedShards(manifest *por.Manifest) (*ShardDelivery, error) {
+	msgType, payload, err := pay.GetMostRecent().GetPayload()
+	if err != nil {
+		return nil, err
+	}
+	if msgType != ShardResponse {
+		return nil, fmt.Errorf("most recent message is %v, not %v", msgType, ShardResponse)
+	}
+	delivery := new(ShardDelivery)
+	if err := json.Unmarshal(payload, delivery); err != nil {
+		return nil, err
+	}
+	if delivery.Shards == nil {
+		return nil, errors.New("alderman delivered no shards")
+	}
+	if err := manifest.Check(delivery.Shards); err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// Source is an alderman holding shards of a file: the client's channel with it
+// and the Peer that reaches it.
+type Source struct {
+	Channel *PaymentChannel
+	Peer    Peer
+}
+
+// Retrieval follows the requests of a Download that may still be running after
+// it returns.
+type Retrieval struct {
+	wg   sync.WaitGroup
+	errs []error
+}
+
+// Wait waits for every source of the download to answer or fail, and returns
+// the error of each, which is nil for the sources that delivered shards of the
+// file. The channel of a source must not be used until Wait returns.
+func (r *Retrieval) Wait() []error {
+	r.wg.Wait()
+	return r.errs
+}
+
+// delivered is a piece handed to Download by a source, and where Download
+// answers whether it needs more shards once it has taken the piece.
+type delivered struct {
+	piece *por.EncodedDataset
+	more  chan bool
+}
+
+// Download retrieves the file described by manifest from sources and writes
+// it to w. Every source is asked for all the shards it holds, and each
+// delivery that checks against the manifest is paid for once Download takes
+// it, at up to maxPrice a shard. The file is reconstructed as soon as the
+// shards are enough, without waiting for slower sources, whose deliveries are
+// then neither paid for nor followed by requests for more. Sources that fail, ask more than maxPrice, or send shards
+// that are not part of the file are passed over. An error is returned if too
+// few shards are retrieved, or the file cannot be written.
+func Download(clientKey *ecdsa.PrivateKey, manifest *por.Manifest, sources []Source, maxPrice uint,
+	w io.Writer) (*Retrieval, error) {
+	retrieval := &Retrieval{errs: make([]error, len(sources))}
+	results := make(chan delivered)
+	done := make(chan struct{})
+	defer close(done)
+	deliver := func(piece *por.EncodedDataset) (bool, bool) {
+		more := make(chan bool, 1)
+		select {
+		case results <- delivered{piece, more}:
+			return true, <-more
+		case <-done:
+			return false, false
+		}
+	}
+	for i, source := range sources {
+		retrieval.wg.Add(1)
+		go func(i int, source Source) {
+			defer retrieval.wg.Done()
+			retrieval.errs[i] = fetch(clientKey, manifest, source, maxPrice, deliver)
+		}(i, source)
+	}
+	finished := make(chan struct{})
+	go func() {
+		retrieval.wg.Wait()
+		close(finished)
+	}()
+
+	retrieved := make(map[int]bool)
+	var pieces []*por.EncodedDataset
+	for {
+		select {
+		case result := <-results:
+			pieces = append(pieces, result.piece)
+			for _, index := range result.piece.Ordering() {
+				retrieved[index] = true
+			}
+			result.more <- len(retrieved) < manifest.DataShards
+			if len(retrieved) >= manifest.DataShards {
+				data, err := por.ReconstructDataFromSegments(pieces)
+				if err != nil {
+					return retrieval, err
+				}
+				_, err = w.Write(data)
+				return retrieval, err
+			}
+		case <-finished:
+			return retrieval, fmt.Errorf("retrieved %v shards, %v needed", len(retrieved), manifest.DataShards)
+		}
+	}
+}
+
+// fetch requests every shard a source holds and hands each delivery to
+// deliver, which reports whether it took the shards and whether it needs more.
+// Deliveries that are taken are paid for before the shards that remain are
+// requested; one that is not taken is left unpaid, and ends the fetch.
+func fetch(clientKey *ecdsa.PrivateKey, manifest *por.Manifest, source Source, maxPrice uint,
+	deliver func(*por.EncodedDataset) (bool, bool)) error {
+	var wanted []int
+	for {
+		request, err := source.Channel.RequestShards(clientKey, wanted)
+		if err != nil {
+			return err
+		}
+		reply, err := source.Peer.Call(&request)
+		if err != nil {
+			return err
+		}
+		if reply == nil || reply.mType != ShardResponse {
+			return fmt.Errorf("alderman did not answer %v with %v", ShardRequest, ShardResponse)
+		}
+		if err := source.Channel.UpdateMessages(reply); err != nil {
+			return err
+		}
+		delivery, err := source.Channel.ReceivedShards(manifest)
+		if err != nil {
+			return err
+		}
+		if delivery.Price > maxPrice {
+			return fmt.Errorf("alderman asks %v a shard, more than %v", delivery.Price, maxPrice)
+		}
+		used, more := deliver(delivery.Shards)
+		if !used {
+			return nil
+		}
+		if due := delivery.Due(); due > 0 {
+			payment, err := source.Channel.SendPayment(clientKey, due)
+			if err != nil {
+				return err
+			}
+			if _, err := source.Peer.Call(&payment); err != nil {
+				return err
+			}
+		}
+		if !more || len(delivery.Remaining) == 0 {
+			return nil
+		}
+		wanted = delivery.Remaining
+	}
+}
@@ -0,0 +1,286 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/tusharjois/councilfs/ledger"
+	"github.com/tusharjois/councilfs/por"
+)
+
+// slowPeer holds back every call until it is released.
+type slowPeer struct {
+	Peer
+	release chan struct{}
+}
+
+func (p slowPeer) Call(msg *ChannelMessage) (*ChannelMessage, error) {
+	<-p.release
+	return p.Peer.Call(msg)
+}
+
+func TestDownload(t *testing.T) {
+	data := []byte("Left Munich at 8:35 P. M., on 1st May, arriving at Vienna early next morning; should have arrived at 6:46, but train was an hour late.")
+	other, err := por.CreateErasureCoding([]byte("Buda-Pesth seems a wonderful place, from the glimpse which I got of it"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// six shards, any four of which rebuild the file
+	config := UploadConfig{R: 3, F: 2, K: 1, Payment: 20, Interval: time.Minute, Funding: 100}
+	clientKey := por.GenerateKey()
+	l := ledger.NewMemory()
+	var holders []Holder
+	var aldermen []*fakeAlderman
+	for i := 0; i < 6; i++ {
+		alder := &fakeAlderman{key: por.GenerateKey(), l: l, k: config.K}
+		aldermen = append(aldermen, alder)
+		holders = append(holders, Holder{Key: &alder.key.PublicKey, Peer: alder})
+	}
+	report, err := Upload(clientKey, data, holders, l, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if durability := report.Durability(); durability.Live != 6 || durability.Needed != 4 {
+		t.Fatalf("upload is %v, expected 6 shards live and 4 needed", durability)
+	}
+
+	// one holder is slow and another now sends shards of a different file
+	slow := slowPeer{aldermen[0], make(chan struct{})}
+	aldermen[1].channel.Encoding = other
+	var sources []Source
+	for i, holder := range report.Holders {
+		sources = append(sources, Source{Channel: holder.Channel, Peer: holders[i].Peer})
+	}
+	sources[0].Peer = slow
+
+	var file bytes.Buffer
+	retrieval, err := Download(clientKey, &report.Manifest, sources, 0, &file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(file.Bytes(), data) {
+		t.Errorf("downloaded %q, expected %q", file.Bytes(), data)
+	}
+	close(slow.release)
+	errs := retrieval.Wait()
+	if errs[0] != nil || errs[1] == nil {
+		t.Errorf("sources failed with %v, expected only the lying source to fail", errs)
+	}
+	if state, err := sources[0].Channel.State(); err != nil || state != StateActive {
+		t.Errorf("slow source's channel in state %v, %v after it answered", state, err)
+	}
+
+	// without the slow holder there are too few honest shards
+	slow = slowPeer{aldermen[0], make(chan struct{})}
+	sources[0].Peer = slow
+	sources = sources[:4]
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(slow.release)
+	}()
+	file.Reset()
+	if _, err := Download(clientKey, &report.Manifest, sources[1:], 0, &file); err == nil || file.Len() != 0 {
+		t.Errorf("download from too few shards succeeded")
+	}
+}
+
+func TestSendShards(t *testing.T) {
+	encodedFile, err := por.CreateErasureCoding([]byte("Left Munich at 8:35 P. M., on 1st May"), 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	piece, err := por.SelectSegments(encodedFile, []int{1, 3, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, aldermanKey := por.GenerateKey(), por.GenerateKey()
+	alder := &fakeAlderman{key: aldermanKey, l: ledger.NewMemory(), k: 1}
+	channel, open, _ := OpenChannel(clientKey, &aldermanKey.PublicKey, 20, time.Minute, piece)
+	accepted, _ := alder.Call(&open)
+	channel.UpdateMessages(accepted)
+
+	// shards are not sent before the channel is funded
+	if _, err := channel.RequestShards(clientKey, nil); err == nil {
+		t.Errorf("shards requested on a channel that is not funded")
+	}
+	funding, err := channel.CreateFunding(clientKey, alder.l, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	approval, err := alder.Call(&funding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel.UpdateMessages(approval)
+
+	request, err := channel.RequestShards(clientKey, []int{5, 2, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := alder.Call(&request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := channel.UpdateMessages(response); err != nil {
+		t.Fatal(err)
+	}
+	manifest := encodedFile.Manifest()
+	received, err := channel.ReceivedShards(&manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ordering := received.Shards.Ordering(); len(ordering) != 2 || ordering[0] != 5 || ordering[1] != 1 {
+		t.Errorf("received shards %v, expected the held shards 5 and 1", ordering)
+	}
+	if received.Price != 0 || len(received.Remaining) != 0 {
+		t.Errorf("free delivery %+v asks a price or leaves shards", received)
+	}
+	if err := channel.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	// an alderman that charges sends a shard at a time, and no more until it
+	// is paid
+	alder.price = 3
+	request, _ = channel.RequestShards(clientKey, nil)
+	response, err = alder.Call(&request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel.UpdateMessages(response)
+	received, err = channel.ReceivedShards(&manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.Shards.Length() != 1 || received.Due() != 3 || len(received.Remaining) != 2 || received.Remaining[0] != 3 {
+		t.Errorf("priced delivery %+v, expected shard 1 and shards 3 and 5 remaining", received)
+	}
+	if owed := channel.RetrievalOwed(); owed != 3 {
+		t.Errorf("%v owed for retrieval, expected 3", owed)
+	}
+	request, _ = channel.RequestShards(clientKey, received.Remaining)
+	if _, err := alder.Call(&request); err == nil {
+		t.Errorf("alderman sent shards that were not paid for")
+	}
+	payment, err := channel.SendPayment(clientKey, received.Due())
+	if err != nil {
+		t.Fatal(err)
+	}
+	alder.Call(&payment)
+	if owed := alder.channel.RetrievalOwed(); owed != 0 {
+		t.Errorf("%v owed for retrieval after payment", owed)
+	}
+	request, _ = channel.RequestShards(clientKey, received.Remaining)
+	response, err = alder.Call(&request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel.UpdateMessages(response)
+	if received, err = channel.ReceivedShards(&manifest); err != nil || received.Shards.Ordering()[0] != 3 {
+		t.Errorf("received %+v, %v after paying, expected shard 3", received, err)
+	}
+
+	// shards of another file do not check against the manifest
+	other, _ := por.CreateErasureCoding([]byte("arriving at Vienna early next morning"), 2, 4)
+	otherManifest := other.Manifest()
+	if _, err := channel.ReceivedShards(&otherManifest); err == nil {
+		t.Errorf("shards checked against the manifest of another file")
+	}
+}
+
+func TestPaidDownload(t *testing.T) {
+	data := []byte("Left Munich at 8:35 P. M., on 1st May, arriving at Vienna early next morning; should have arrived at 6:46, but train was an hour late.")
+	config := UploadConfig{R: 3, F: 2, K: 1, Payment: 20, Interval: time.Minute, Funding: 100}
+	clientKey := por.GenerateKey()
+	l := ledger.NewMemory()
+	var holders []Holder
+	var aldermen []*fakeAlderman
+	for i := 0; i < 3; i++ {
+		alder := &fakeAlderman{key: por.GenerateKey(), l: l, k: config.K}
+		aldermen = append(aldermen, alder)
+		holders = append(holders, Holder{Key: &alder.key.PublicKey, Peer: alder})
+	}
+	report, err := Upload(clientKey, data, holders, l, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sources []Source
+	for i, holder := range report.Holders {
+		sources = append(sources, Source{Channel: holder.Channel, Peer: holders[i].Peer})
+	}
+
+	// the client pays for the shards of two aldermen, which are enough, but
+	// not for the shard sent by an alderman asking too much
+	aldermen[0].price, aldermen[1].price, aldermen[2].price = 4, 5, 50
+	var file bytes.Buffer
+	retrieval, err := Download(clientKey, &report.Manifest, sources, 5, &file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(file.Bytes(), data) {
+		t.Errorf("downloaded %q, expected %q", file.Bytes(), data)
+	}
+	if errs := retrieval.Wait(); errs[0] != nil || errs[1] != nil || errs[2] == nil {
+		t.Errorf("sources failed with %v, expected only the expensive source to fail", errs)
+	}
+	for i, alder := range aldermen {
+		paid, _ := alder.channel.Balance()
+		if expected := config.Payment + []uint{8, 10, 0}[i]; paid != expected {
+			t.Errorf("alderman %v was paid %v, expected %v", i, paid, expected)
+		}
+	}
+	if owed := aldermen[2].channel.RetrievalOwed(); owed != 50 {
+		t.Errorf("expensive alderman is owed %v, expected 50", owed)
+	}
+
+	// the unpaid alderman sends nothing more, even at its price
+	file.Reset()
+	retrieval, err = Download(clientKey, &report.Manifest, sources, 50, &file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := retrieval.Wait(); errs[2] == nil {
+		t.Errorf("alderman that was not paid sent more shards")
+	}
+	if owed := aldermen[2].channel.RetrievalOwed(); owed != 50 {
+		t.Errorf("unpaid alderman is owed %v, expected 50", owed)
+	}
+
+	// a payment that cannot be parsed pays for nothing
+	unparsable := &ChannelMessage{mType: SendPayment, payload: []byte("not a commitment")}
+	aldermen[2].channel.Messages = append(aldermen[2].channel.Messages, unparsable)
+	if owed := aldermen[2].channel.RetrievalOwed(); owed != 50 {
+		t.Errorf("alderman is owed %v after an unparsable payment, expected 50", owed)
+	}
+
+	// shards that arrive after the file is rebuilt are not paid for
+	for _, alder := range aldermen {
+		alder.price = 5
+	}
+	report, err = Upload(clientKey, data, holders, l, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow := slowPeer{aldermen[0], make(chan struct{})}
+	sources = sources[:0]
+	for i, holder := range report.Holders {
+		sources = append(sources, Source{Channel: holder.Channel, Peer: holders[i].Peer})
+	}
+	sources[0].Peer = slow
+	file.Reset()
+	retrieval, err = Download(clientKey, &report.Manifest, sources, 5, &file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(slow.release)
+	if errs := retrieval.Wait(); errs[0] != nil {
+		t.Errorf("slow source failed with %v", errs[0])
+	}
+	if paid, _ := aldermen[0].channel.Balance(); paid != config.Payment {
+		t.Errorf("slow alderman was paid %v, expected only its storage payment of %v", paid, config.Payment)
+	}
+	if owed := aldermen[0].channel.RetrievalOwed(); owed != 5 {
+		t.Errorf("slow alderman is owed %v, expected 5 for the shard it sent too late", owed)
+	}
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/tusharjois/councilfs/ledger"
+)
+
+// FundingPayload is the payload of the ledger.Funding transaction that backs a
+// PaymentChannel. It locks Amount of the client's funds into the channel, and
+// fixes the DisputeWindow used if the channel is closed unilaterally.
+type FundingPayload struct {
+	ChannelID         []byte
+	ClientPublicKey   []byte
+	AldermanPublicKey []byte
+	Amount            uint
+	DisputeWindow     time.Duration
+}
+
+// CreateFunding is done by the client once the alderman accepts the channel. It
+// submits a funding transaction of the given amount to the ledger and returns
+// the FundsCreated message carrying the transaction ID.
+func (pay *PaymentChannel) CreateFunding(clientKey *ecdsa.PrivateKey, l ledger.Ledger, amount uint) (ChannelMessage, error) {
+	state, err := pay.State()
+	if err != nil {
+		return ChannelMessage{}, err
+	}
+	if _, err := state.Next(FundsCreated); err != nil {
+		return ChannelMessage{}, err
+	}
+	if amount < pay.Payment {
+		return ChannelMessage{}, fmt.Errorf("funding of %v does not cover payment of %v", amount, pay.Payment)
+	}
+
+	tx := ledger.NewTransaction(ledger.Funding, nil, FundingPayload{
+		ChannelID:         pay.ChannelID,
+		ClientPublicKey:   pay.ClientPublicKey,
+		AldermanPublicKey: pay.AldermanPublicKey,
+		Amount:            amount,
+		DisputeWindow:     pay.DisputeWindow,
+	}, clientKey)
+	txID, err := l.Submit(tx)
+	if err != nil {
+		return ChannelMessage{}, err
+	}
+
+	message := NewMessage(FundsCreated, txID, pay.ChannelID, clientKey, pay.GetMostRecent())
+	if err := pay.UpdateMessages(message); err != nil {
+		return ChannelMessage{}, err
+	}
+	pay.FundingID = txID
+	pay.FundingAmount = amount
+	return *message, nil
+}
+
+// CheckFunding looks up the funding transaction named in the most recent
+// FundsCreated message of the channel and checks that it was made by the
+// client of this channel, to the alderman of this channel, for at least the
+// channel's Payment. The ID and amount of the funding transaction are returned.
+func (pay *PaymentChannel) CheckFunding(l ledger.Ledger) ([]byte, uint, error) {
+	msgType, payload, err := pay.GetMostRecent().GetPayload()
+	if err != nil {
+		return nil, 0, err
+	}
+	if msgType != FundsCreated {
+		return nil, 0, fmt.Errorf("most recent message is %v, not %v", msgType, FundsCreated)
+	}
+	var txID []byte
+	if err := json.Unmarshal(payload, &txID); err != nil {
+		return nil, 0, err
+	}
+
+	tx, err := l.Lookup(txID)
+	if err != nil {
+		return nil, 0, err
+	}
+	if tx.Kind != ledger.Funding {
+		return nil, 0, fmt.Errorf("transaction %x is not a funding transaction", txID)
+	}
+	if !bytes.Equal(tx.Sender, pay.ClientPublicKey) {
+		return nil, 0, fmt.Errorf("funding transaction %x was not made by the client", txID)
+	}
+	var funding FundingPayload
+	if err := json.Unmarshal(tx.Payload, &funding); err != nil {
+		return nil, 0, err
+	}
+	if !bytes.Equal(funding.ChannelID, pay.ChannelID) ||
+		!bytes.Equal(funding.ClientPublicKey, pay.ClientPublicKey) ||
+		!bytes.Equal(funding.AldermanPublicKey, pay.AldermanPublicKey) {
+		return nil, 0, fmt.Errorf("funding transaction %x is for a different channel", txID)
+	}
+	if funding.DisputeWindow != pay.DisputeWindow {
+		return nil, 0, fmt.Errorf("funding transaction %x has dispute window %v, expected %v",
+			txID, funding.DisputeWindow, pay.DisputeWindow)
+	}
+	if funding.Amount < pay.Payment {
+		return nil, 0, fmt.Errorf("funding of %v does not cover payment of %v", funding.Amount, pay.Payment)
+	}
+	return txID, funding.Amount, nil
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/tusharjois/councilfs/por"
+)
+
+// Commitment is the payload of a SendPayment message. It is signed by the
+// client and commits them to having paid the alderman Paid in total over the
+// life of the channel. Every commitment has a Sequence one higher than the one
+// before it and pays strictly more, but never more than the funding of the
+// channel, so the alderman can settle the channel with the latest commitment
+// and the client cannot spend the funding twice.
+type Commitment struct {
+	ChannelID []byte
+	Paid      uint
+	Sequence  uint64
+	Signature []byte
+}
+
+// Digest returns the digest of the commitment signed by the client.
+func (c *Commitment) Digest() [sha256.Size]byte {
+	h := sha256.New()
+	writeField(h, c.ChannelID)
+	var numbers [16]byte
+	binary.BigEndian.PutUint64(numbers[:8], uint64(c.Paid))
+	binary.BigEndian.PutUint64(numbers[8:], c.Sequence)
+	h.Write(numbers[:])
+	var digest [sha256.Size]byte
+	copy(digest[:], h.Sum(nil))
+	return digest
+}
+
+// Verify checks that the commitment is signed by the client with the given
+// PKIX encoded public key.
+func (c *Commitment) Verify(clientPublicKey []byte) error {
+	clientKey, err := parsePublicKey(clientPublicKey)
+	if err != nil {
+		return err
+	}
+	digest := c.Digest()
+	if !por.VerifyAndUnMarshal(clientKey, digest[:], c.Signature) {
+		return errors.New("commitment signature does not verify")
+	}
+	return nil
+}
+
+// parseCommitment returns the Commitment carried by a SendPayment message.
+func parseCommitment(msg *ChannelMessage) (*Commitment, error) {
+	if msg.mType != SendPayment {
+		return nil, fmt.Errorf("%v does not carry a commitment", msg.mType)
+	}
+	commitment := new(Commitment)
+	if err := json.Unmarshal(msg.payload, commitment); err != nil {
+		return nil, err
+	}
+	return commitment, nil
+}
+
+// checkCommitment checks the commitment in a SendPayment message against the
+// latest commitment of the channel, which is nil if no payment has been made.
+// The commitment in msg is returned.
+func (pay *PaymentChannel) checkCommitment(latest *Commitment, msg *ChannelMessage) (*Commitment, error) {
+	commitment, err := parseCommitment(msg)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(commitment.ChannelID, pay.ChannelID) {
+		return nil, errors.New("commitment is for a different channel")
+	}
+	if err := commitment.Verify(pay.ClientPublicKey); err != nil {
+		return nil, err
+	}
+	var paid uint
+	var sequence uint64
+	if latest != nil {
+		paid, sequence = latest.Paid, latest.Sequence
+	}
+	if commitment.Sequence != sequence+1 {
+		return nil, fmt.Errorf("commitment has sequence %v, expected %v", commitment.Sequence, sequence+1)
+	}
+	if commitment.Paid <= paid {
+		return nil, fmt.Errorf("commitment pays %v, which is not more than %v", commitment.Paid, paid)
+	}
+	if commitment.Paid > pay.FundingAmount {
+		return nil, fmt.Errorf("commitment pays %v, which is more than the funding of %v",
+			commitment.Paid, pay.FundingAmount)
+	}
+	return commitment, nil
+}
+
+// LatestCommitment returns the most recent payment commitment made by the
+// client on the channel, or nil if the client has not paid yet. A SendPayment
+// whose commitment cannot be parsed, which UpdateMessages never adds, is
+// skipped.
+func (pay *PaymentChannel) LatestCommitment() *Commitment {
+	for i := len(pay.Messages) - 1; i >= 0; i-- {
+		if pay.Messages[i].mType == SendPayment {
+			if commitment, err := parseCommitment(pay.Messages[i]); err == nil {
+				return commitment
+			}
+		}
+	}
+	return nil
+}
+
+// Balance returns the total amount the client has paid the alderman on the
+// channel, and how much of the channel's funding is left.
+func (pay *PaymentChannel) Balance() (uint, uint) {
+	var paid uint
+	if latest := pay.LatestCommitment(); latest != nil {
+		paid = latest.Paid
+	}
+	return paid, pay.FundingAmount - paid
+}
+
+// SendPayment is done by the client to pay the alderman amount more than it
+// has already been paid. The SendPayment message carries a new Commitment to
+// the total paid so far. An error is returned if the channel is not active or
+// if its funding does not cover the payment.
+func (pay *PaymentChannel) SendPayment(clientKey *ecdsa.PrivateKey, amount uint) (ChannelMessage, error) {
+	latest := pay.LatestCommitment()
+	commitment := &Commitment{ChannelID: pay.ChannelID, Paid: amount, Sequence: 1}
+	if latest != nil {
+		commitment.Paid += latest.Paid
+		commitment.Sequence += latest.Sequence
+	}
+	digest := commitment.Digest()
+	commitment.Signature = por.SignAndMarshal(clientKey, digest[:])
+
+	payMessage := NewMessage(SendPayment, commitment, pay.ChannelID, clientKey, pay.GetMostRecent())
+	if err := pay.UpdateMessages(payMessage); err != nil {
+		return ChannelMessage{}, err
+	}
+	return *payMessage, nil
+}
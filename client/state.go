@@ -0,0 +1,143 @@
+package client
+
+import (
+	"fmt"
+)
+
+// ChannelState is the state of a PaymentChannel, as determined by the messages
+// that have been sent on it. Every MessageType moves the channel from one
+// state to another, and a message that has no transition from the current state
+// is rejected. The states follow the life of a channel:
+//
+//	Open -> Accepted -> Funded -> Active <-> Challenged
+//
+// with any state able to move to Closing, and then to Closed once both parties
+// have agreed on the final balance.
+type ChannelState int8
+
+const (
+	// StateOpen is the state after the client sends ChannelOpen and before the
+	// alderman accepts the channel.
+	StateOpen ChannelState = iota
+
+	// StateAccepted is the state after the alderman sends ChannelAccepted. The
+	// client must now fund the channel.
+	StateAccepted
+
+	// StateFunded is the state after the client sends FundsCreated and before
+	// the alderman approves the funding transaction.
+	StateFunded
+
+	// StateActive is the state after the alderman sends FundsApproved. The
+	// client can now request proofs of retrievability, download shards and
+	// send payments.
+	StateActive
+
+	// StateChallenged is the state after the client sends a PORRequest, until
+	// the client verifies the PORResponse and sends payment.
+	StateChallenged
+
+	// StateClosing is the state after one party sends CloseChannel, until the
+	// other party countersigns the final balance. If they never do, the
+	// channel is closed unilaterally on the ledger.
+	StateClosing
+
+	// StateClosed is the state after both parties send CloseChannel with the
+	// same final balance. No more messages can be sent on the channel.
+	StateClosed
+)
+
+var channelStateNames = []string{"Open", "Accepted", "Funded", "Active", "Challenged", "Closing", "Closed"}
+
+func (state ChannelState) String() string {
+	if state < 0 || int(state) >= len(channelStateNames) {
+		return fmt.Sprintf("ChannelState(%d)", int8(state))
+	}
+	return channelStateNames[state]
+}
+
+// transitions maps each state to the state reached by every MessageType that
+// can be sent in it.
+var transitions = map[ChannelState]map[MessageType]ChannelState{
+	StateOpen: {
+		ChannelAccepted: StateAccepted,
+		CloseChannel:    StateClosing,
+	},
+	StateAccepted: {
+		FundsCreated: StateFunded,
+		CloseChannel: StateClosing,
+	},
+	StateFunded: {
+		FundsApproved: StateActive,
+		CloseChannel:  StateClosing,
+	},
+	StateActive: {
+		PORRequest:    StateChallenged,
+		SendPayment:   StateActive,
+		ShardRequest:  StateActive,
+		ShardResponse: StateActive,
+		CloseChannel:  StateClosing,
+	},
+	StateChallenged: {
+		PORResponse:  StateChallenged,
+		SendPayment:  StateActive,
+		CloseChannel: StateClosing,
+	},
+	StateClosing: {
+		CloseChannel: StateClosed,
+	},
+}
+
+// Next returns the state reached by sending a message of type mType in the
+// current state. An error is returned if the transition is not allowed.
+func (state ChannelState) Next(mType MessageType) (ChannelState, error) {
+	next, ok := transitions[state][mType]
+	if !ok {
+		return state, fmt.Errorf("cannot send %v on a channel in state %v", mType, state)
+	}
+	return next, nil
+}
+
+// step returns the state reached when msg follows prev on a channel in the
+// given state, where prev is nil if msg is the first message. Besides the
+// transitions of ChannelState, a PORResponse must directly answer a PORRequest,
+// and a ShardResponse a ShardRequest.
+func step(state ChannelState, prev *ChannelMessage, msg *ChannelMessage) (ChannelState, error) {
+	if prev == nil {
+		if msg.mType != ChannelOpen {
+			return state, fmt.Errorf("channel must begin with %v, not %v", ChannelOpen, msg.mType)
+		}
+		return StateOpen, nil
+	}
+	if msg.mType == PORResponse && prev.mType != PORRequest {
+		return state, fmt.Errorf("%v does not answer a %v", PORResponse, PORRequest)
+	}
+	if msg.mType == ShardResponse && prev.mType != ShardRequest {
+		return state, fmt.Errorf("%v does not answer a %v", ShardResponse, ShardRequest)
+	}
+	return state.Next(msg.mType)
+}
+
+// replayState computes the state of a channel by replaying its messages.
+func replayState(log []*ChannelMessage) (ChannelState, error) {
+	var state ChannelState
+	var prev *ChannelMessage
+	for i, msg := range log {
+		var err error
+		state, err = step(state, prev, msg)
+		if err != nil {
+			return state, &ValidationError{Index: i, Reason: err.Error()}
+		}
+		prev = msg
+	}
+	return state, nil
+}
+
+// State returns the current state of the channel. An error is returned if the
+// channel has no messages or its messages do not follow the state machine.
+func (pay *PaymentChannel) State() (ChannelState, error) {
+	if len(pay.Messages) == 0 {
+		return StateOpen, fmt.Errorf("channel has no messages")
+	}
+	return replayState(pay.Messages)
+}
@@ -0,0 +1,194 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tusharjois/councilfs/ledger"
+	"github.com/tusharjois/councilfs/por"
+)
+
+// Peer carries the messages of a channel to an alderman and returns its
+// replies, which are nil for messages that need none. A transport.Client is a
+// Peer reaching an alderman over the network.
+type Peer interface {
+	Call(msg *ChannelMessage) (*ChannelMessage, error)
+}
+
+// Holder is an alderman chosen to store part of an upload, and the Peer that
+// reaches it.
+type Holder struct {
+	Key  *ecdsa.PublicKey
+	Peer Peer
+}
+
+// UploadConfig describes how a file is uploaded. The file is erasure coded
+// with parameters R and F, as por.CreateErasureCoding does, and each holder
+// is paid Payment every Interval from a channel funded with Funding. Receipt
+// of the shards is verified with a proof of retrievability over K segments.
+type UploadConfig struct {
+	R        int
+	F        int
+	K        uint
+	Payment  uint
+	Interval time.Duration
+	Funding  uint
+}
+
+// HolderReport is the outcome of an upload to one holder: the shards placed on
+// it, the channel opened with it, and the error that stopped the upload, if
+// any. Shards are live once the holder proved it holds them.
+type HolderReport struct {
+	Alderman []byte
+	Shards   []int
+	Channel  *PaymentChannel
+	Err      error
+}
+
+// Live reports whether the holder proved it holds its shards.
+func (report *HolderReport) Live() bool {
+	return report.Err == nil
+}
+
+// Durability summarizes how safely a file is stored: Live of its Total shards
+// are held by aldermen that proved it, and Needed of them reconstruct it.
+type Durability struct {
+	Live   int
+	Needed int
+	Total  int
+}
+
+// Durable reports whether enough shards are live to reconstruct the file.
+func (d Durability) Durable() bool {
+	return d.Live >= d.Needed
+}
+
+func (d Durability) String() string {
+	return fmt.Sprintf("%v of %v shards live, %v needed", d.Live, d.Total, d.Needed)
+}
+
+// UploadReport is the outcome of an upload. The Manifest of the encoded file
+// is what the client keeps to check the shards it later downloads.
+type UploadReport struct {
+	por.Manifest
+	Holders []HolderReport
+}
+
+// Durability returns the durability of the uploaded file.
+func (report *UploadReport) Durability() Durability {
+	d := Durability{Needed: report.DataShards, Total: len(report.Hashes)}
+	for _, holder := range report.Holders {
+		if holder.Live() {
+			d.Live += len(holder.Shards)
+		}
+	}
+	return d
+}
+
+// Place spreads shards shards over holders holders, giving shard i to holder
+// i mod holders, so that losing any one holder loses as few shards as
+// possible.
+func Place(shards int, holders int) [][]int {
+	placement := make([][]int, holders)
+	for i := 0; i < shards; i++ {
+		placement[i%holders] = append(placement[i%holders], i)
+	}
+	return placement
+}
+
+// Upload encodes data, places its shards across holders, and uploads to each
+// holder concurrently: it opens a channel carrying the holder's shards, funds
+// the channel on l, and checks receipt with a proof of retrievability, paying
+// for it if it verifies and closing the channel if it does not. A holder that
+// fails does not stop the others; the report tells which shards are live. An
+// error is returned only if the file cannot be encoded.
+func Upload(clientKey *ecdsa.PrivateKey, data []byte, holders []Holder, l ledger.Ledger,
+	config UploadConfig) (*UploadReport, error) {
+	if len(holders) == 0 {
+		return nil, fmt.Errorf("no aldermen to upload to")
+	}
+	encoding, err := por.CreateErasureCoding(data, config.R, config.F)
+	if err != nil {
+		return nil, err
+	}
+	report := &UploadReport{Manifest: encoding.Manifest(), Holders: make([]HolderReport, len(holders))}
+
+	var wg sync.WaitGroup
+	for i, shards := range Place(int(encoding.Length()), len(holders)) {
+		holderKey, err := x509.MarshalPKIXPublicKey(holders[i].Key)
+		if err != nil {
+			return nil, err
+		}
+		report.Holders[i] = HolderReport{Alderman: holderKey, Shards: shards}
+		if len(shards) == 0 {
+			report.Holders[i].Err = fmt.Errorf("no shards placed")
+			continue
+		}
+		wg.Add(1)
+		go func(holder Holder, result *HolderReport) {
+			defer wg.Done()
+			result.Channel, result.Err = uploadTo(clientKey, encoding, holder, result.Shards, l, config)
+		}(holders[i], &report.Holders[i])
+	}
+	wg.Wait()
+	return report, nil
+}
+
+// uploadTo runs the upload of shards to a single holder.
+func uploadTo(clientKey *ecdsa.PrivateKey, encoding *por.EncodedDataset, holder Holder, shards []int,
+	l ledger.Ledger, config UploadConfig) (*PaymentChannel, error) {
+	piece, err := por.SelectSegments(encoding, shards)
+	if err != nil {
+		return nil, err
+	}
+	channel, open, _ := OpenChannel(clientKey, holder.Key, config.Payment, config.Interval, piece)
+	exchange := func(msg ChannelMessage, expected MessageType) error {
+		reply, err := holder.Peer.Call(&msg)
+		if err != nil {
+			return err
+		}
+		if reply == nil {
+			return fmt.Errorf("alderman did not answer %v", msg.mType)
+		}
+		if reply.mType != expected {
+			return fmt.Errorf("alderman answered %v with %v, expected %v", msg.mType, reply.mType, expected)
+		}
+		return channel.UpdateMessages(reply)
+	}
+
+	if err := exchange(open, ChannelAccepted); err != nil {
+		return channel, err
+	}
+	funding, err := channel.CreateFunding(clientKey, l, config.Funding)
+	if err != nil {
+		return channel, err
+	}
+	if err := exchange(funding, FundsApproved); err != nil {
+		return channel, err
+	}
+	request, err := channel.RequestPOR(clientKey, config.K)
+	if err != nil {
+		return channel, err
+	}
+	if err := exchange(request, PORResponse); err != nil {
+		return channel, err
+	}
+	verdict, verifyErr := channel.VerifyPOR(clientKey, config.K)
+	if verifyErr != nil && verifyErr != ErrPORFailed {
+		return channel, verifyErr
+	}
+	reply, err := holder.Peer.Call(&verdict)
+	if verifyErr == ErrPORFailed {
+		if err == nil && reply != nil {
+			err = channel.UpdateMessages(reply)
+		}
+		if err != nil {
+			return channel, fmt.Errorf("alderman failed to prove receipt of its shards, and its close failed: %v", err)
+		}
+		return channel, fmt.Errorf("alderman failed to prove receipt of its shards")
+	}
+	return channel, err
+}
@@ -0,0 +1,218 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tusharjois/councilfs/ledger"
+	"github.com/tusharjois/councilfs/por"
+)
+
+// fakeAlderman answers the messages of a single channel the way an alderman
+// does, asking price for each shard downloaded. A lying alderman keeps other
+// shards than those it was sent, and a corrupting one answers a close with a
+// countersignature that does not verify.
+type fakeAlderman struct {
+	key     *ecdsa.PrivateKey
+	l       ledger.Ledger
+	k       uint
+	price   uint
+	lie     *por.EncodedDataset
+	corrupt bool
+	channel *PaymentChannel
+}
+
+func (f *fakeAlderman) Call(sent *ChannelMessage) (*ChannelMessage, error) {
+	msg, err := ParseMessage(sent.Marshal())
+	if err != nil {
+		return nil, err
+	}
+	if msg.mType == ChannelOpen {
+		f.channel = new(PaymentChannel)
+		if err := json.Unmarshal(msg.payload, f.channel); err != nil {
+			return nil, err
+		}
+	}
+	if err := f.channel.UpdateMessages(msg); err != nil {
+		return nil, err
+	}
+	var reply *ChannelMessage
+	switch msg.mType {
+	case ChannelOpen:
+		reply = NewMessage(ChannelAccepted, f.channel, msg.GetID(), f.key, msg)
+		if f.lie != nil {
+			f.channel.Encoding = f.lie
+		}
+	case FundsCreated:
+		txID, amount, err := f.channel.CheckFunding(f.l)
+		if err != nil {
+			return nil, err
+		}
+		f.channel.FundingID, f.channel.FundingAmount = txID, amount
+		reply = NewMessage(FundsApproved, txID, msg.GetID(), f.key, msg)
+	case PORRequest:
+		response, err := f.channel.RespondToPOR(f.key, f.k)
+		return &response, err
+	case ShardRequest:
+		response, err := f.channel.SendShards(f.key, f.price)
+		return &response, err
+	case CloseChannel:
+		if !f.corrupt {
+			return nil, nil
+		}
+		response, err := f.channel.Close(f.key)
+		if err != nil {
+			return nil, err
+		}
+		response.signature = append([]byte(nil), response.signature...)
+		response.signature[len(response.signature)-1] ^= 0xff
+		return &response, nil
+	default:
+		return nil, nil
+	}
+	return reply, f.channel.UpdateMessages(reply)
+}
+
+// unreachable is a Peer whose alderman cannot be reached.
+type unreachable struct{}
+
+func (unreachable) Call(*ChannelMessage) (*ChannelMessage, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestUpload(t *testing.T) {
+	data := []byte("Left Munich at 8:35 P. M., on 1st May, arriving at Vienna early next morning; should have arrived at 6:46, but train was an hour late.")
+	other, err := por.CreateErasureCoding([]byte("Buda-Pesth seems a wonderful place, from the glimpse which I got of it"), 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := UploadConfig{R: 2, F: 4, K: 2, Payment: 20, Interval: time.Minute, Funding: 100}
+	clientKey := por.GenerateKey()
+	l := ledger.NewMemory()
+
+	newHolders := func() ([]Holder, []*fakeAlderman) {
+		var holders []Holder
+		var aldermen []*fakeAlderman
+		for i := 0; i < 3; i++ {
+			alder := &fakeAlderman{key: por.GenerateKey(), l: l, k: config.K}
+			aldermen = append(aldermen, alder)
+			holders = append(holders, Holder{Key: &alder.key.PublicKey, Peer: alder})
+		}
+		return holders, aldermen
+	}
+
+	holders, aldermen := newHolders()
+	report, err := Upload(clientKey, data, holders, l, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	durability := report.Durability()
+	if durability != (Durability{Live: 8, Needed: 6, Total: 8}) || !durability.Durable() {
+		t.Errorf("upload is %v, expected all 8 shards live", durability)
+	}
+	for i, holder := range report.Holders {
+		if !holder.Live() {
+			t.Errorf("holder %v failed: %v", i, holder.Err)
+		}
+		if paid, _ := aldermen[i].channel.Balance(); paid != config.Payment {
+			t.Errorf("holder %v was paid %v, expected %v", i, paid, config.Payment)
+		}
+		if holder.Channel.Encoding.Length() != uint(len(holder.Shards)) {
+			t.Errorf("holder %v was sent %v shards, placed %v", i, holder.Channel.Encoding.Length(), len(holder.Shards))
+		}
+	}
+
+	// a holder that keeps other shards, and one that cannot be reached, leave
+	// too few shards live
+	holders, aldermen = newHolders()
+	aldermen[0].lie = other
+	holders[1].Peer = unreachable{}
+	report, err = Upload(clientKey, data, holders, l, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Holders[0].Live() || report.Holders[1].Live() || !report.Holders[2].Live() {
+		t.Errorf("only the honest, reachable holder should be live")
+	}
+	if state, _ := report.Holders[0].Channel.State(); state != StateClosing {
+		t.Errorf("channel with the lying holder in state %v, expected %v", state, StateClosing)
+	}
+	if durability := report.Durability(); durability.Live != 2 || durability.Durable() {
+		t.Errorf("upload is %v, expected 2 shards live", durability)
+	}
+
+	// a corrupted countersignature of the close is reported, and not added
+	holders, aldermen = newHolders()
+	aldermen[0].lie = other
+	aldermen[0].corrupt = true
+	report, err = Upload(clientKey, data, holders, l, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := report.Holders[0].Err; failed == nil || !strings.Contains(failed.Error(), "close failed") {
+		t.Errorf("corrupted close was not reported: %v", failed)
+	}
+	if state, _ := report.Holders[0].Channel.State(); state != StateClosing {
+		t.Errorf("channel with the corrupting holder in state %v, expected %v", state, StateClosing)
+	}
+}
+
+func TestVerifyPORFailure(t *testing.T) {
+	encodedFile, err := por.CreateErasureCoding([]byte("Left Munich at 8:35 P. M., on 1st May"), 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := por.CreateErasureCoding([]byte("arriving at Vienna early next morning"), 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey := por.GenerateKey()
+	alder := &fakeAlderman{key: por.GenerateKey(), l: ledger.NewMemory(), k: 2, lie: other}
+	channel, open, _ := OpenChannel(clientKey, &alder.key.PublicKey, 20, time.Minute, encodedFile)
+	exchange := func(msg ChannelMessage) {
+		reply, err := alder.Call(&msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := channel.UpdateMessages(reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exchange(open)
+	funding, err := channel.CreateFunding(clientKey, alder.l, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange(funding)
+	request, err := channel.RequestPOR(clientKey, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange(request)
+
+	// the POR over other shards fails, and the channel is closed
+	verdict, err := channel.VerifyPOR(clientKey, 2)
+	if err != ErrPORFailed {
+		t.Errorf("expected ErrPORFailed, got %v", err)
+	}
+	if verdict.mType != CloseChannel {
+		t.Errorf("failed POR answered with %v, expected %v", verdict.mType, CloseChannel)
+	}
+	if state, _ := channel.State(); state != StateClosing {
+		t.Errorf("channel in state %v, expected %v", state, StateClosing)
+	}
+}
+
+func TestPlace(t *testing.T) {
+	placement := Place(8, 3)
+	if len(placement) != 3 || len(placement[0]) != 3 || len(placement[2]) != 2 || placement[1][1] != 4 {
+		t.Errorf("placed shards as %v", placement)
+	}
+	if placement := Place(2, 3); len(placement[2]) != 0 {
+		t.Errorf("placed shards as %v, expected the third holder to get none", placement)
+	}
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/tusharjois/councilfs/por"
+)
+
+// ValidationError reports the first message in the log of a PaymentChannel
+// that does not follow from the messages before it.
+type ValidationError struct {
+	Index  int
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid message %v in channel: %v", e.Index, e.Reason)
+}
+
+// sentByClient and sentByAlderman report which party of the channel is
+// allowed to send a message of the given type. CloseChannel can be sent by
+// either party.
+func sentByClient(mType MessageType) bool {
+	switch mType {
+	case ChannelOpen, FundsCreated, PORRequest, SendPayment, CloseChannel, ShardRequest:
+		return true
+	}
+	return false
+}
+
+func sentByAlderman(mType MessageType) bool {
+	switch mType {
+	case ChannelAccepted, FundsApproved, PORResponse, CloseChannel, ShardResponse:
+		return true
+	}
+	return false
+}
+
+// parsePublicKey parses a PKIX encoded ECDSA public key.
+func parsePublicKey(keyBytes []byte) (*ecdsa.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaKey, correctType := key.(*ecdsa.PublicKey)
+	if !correctType {
+		return nil, errors.New("public key is not an ecdsa key")
+	}
+	return ecdsaKey, nil
+}
+
+// Verify checks that the message is correctly signed by the public key it
+// claims to be sent from.
+func (msg *ChannelMessage) Verify() error {
+	senderKey, err := parsePublicKey(msg.senderPublicKey)
+	if err != nil {
+		return fmt.Errorf("bad sender key: %v", err)
+	}
+	digest := signingDigest(msg.mType, msg.channelID[:], msg.senderPublicKey, msg.payload, msg.prevHash)
+	if !por.VerifyAndUnMarshal(senderKey, digest[:], msg.signature) {
+		return errors.New("signature does not verify")
+	}
+	return nil
+}
+
+// checkMessage checks that msg can follow prev in the channel, where prev is
+// nil if msg is the first message.
+func (pay *PaymentChannel) checkMessage(prev *ChannelMessage, msg *ChannelMessage) string {
+	if msg == nil {
+		return "message is missing"
+	}
+	if !bytes.Equal(msg.channelID[:], pay.ChannelID) {
+		return "message belongs to a different channel"
+	}
+	if prev == nil {
+		if msg.prevHash != [sha256.Size]byte{} {
+			return "first message has a previous hash"
+		}
+	} else if msg.prevHash != prev.Hash() {
+		return "previous hash does not match previous message"
+	}
+	if err := msg.Verify(); err != nil {
+		return err.Error()
+	}
+	fromClient := bytes.Equal(msg.senderPublicKey, pay.ClientPublicKey)
+	fromAlderman := bytes.Equal(msg.senderPublicKey, pay.AldermanPublicKey)
+	if !(fromClient && sentByClient(msg.mType)) && !(fromAlderman && sentByAlderman(msg.mType)) {
+		return fmt.Sprintf("message of type %v sent by the wrong party", msg.mType)
+	}
+	return ""
+}
+
+// Validate walks the message log of the channel and checks that every message
+// belongs to the channel, links to the message before it, is correctly signed,
+// is sent by the party allowed to send a message of its type, and is allowed
+// by the ChannelState the channel is in. Payments must carry valid, increasing
+// Commitments, and closes must settle the latest one. The first message that fails these
+// checks is reported as a *ValidationError, so that either party can prove the
+// history of the channel in a dispute.
+func (pay *PaymentChannel) Validate() error {
+	var state ChannelState
+	var prev *ChannelMessage
+	var latest *Commitment
+	for i, msg := range pay.Messages {
+		if reason := pay.checkMessage(prev, msg); reason != "" {
+			return &ValidationError{Index: i, Reason: reason}
+		}
+		var err error
+		if state, err = step(state, prev, msg); err != nil {
+			return &ValidationError{Index: i, Reason: err.Error()}
+		}
+		if msg.mType == SendPayment {
+			if latest, err = pay.checkCommitment(latest, msg); err != nil {
+				return &ValidationError{Index: i, Reason: err.Error()}
+			}
+		}
+		if msg.mType == CloseChannel {
+			if err = pay.checkClose(latest, prev, msg); err != nil {
+				return &ValidationError{Index: i, Reason: err.Error()}
+			}
+		}
+		prev = msg
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/tusharjois/councilfs/por"
+)
+
+func keygen(args []string) error {
+	flags := newFlagSet("keygen", "")
+	out := flags.String("out", "key.pem", "`file` to write the key to; it must not exist")
+	flags.Parse(args)
+
+	key := por.GenerateKey()
+	if err := writeKey(*out, key); err != nil {
+		return err
+	}
+	fmt.Println(por.Fingerprint(&key.PublicKey))
+	return nil
+}
+
+func encode(args []string) error {
+	flags := newFlagSet("encode", "file")
+	r := flags.Int("r", 2, "erasure coding parameter r")
+	f := flags.Int("f", 4, "erasure coding parameter f")
+	out := flags.String("out", "shards", "shard `directory` to write")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("no file to encode")
+	}
+
+	data, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	enc, err := por.CreateErasureCoding(data, *r, *f)
+	if err != nil {
+		return err
+	}
+	if err := writeDataset(*out, enc); err != nil {
+		return err
+	}
+	manifest := enc.Manifest()
+	fmt.Printf("%v shards, any %v of which rebuild the file, root %x\n",
+		len(manifest.Hashes), manifest.DataShards, manifest.Root)
+	return nil
+}
+
+func decode(args []string) error {
+	flags := newFlagSet("decode", "")
+	dir := flags.String("dir", "shards", "shard `directory` to read")
+	out := flags.String("out", "", "`file` to write, or standard output")
+	flags.Parse(args)
+
+	_, enc, err := readDataset(*dir)
+	if err != nil {
+		return err
+	}
+	data, err := por.ReconstructDataFromSegments([]*por.EncodedDataset{enc})
+	if err != nil {
+		return err
+	}
+	return writeOutput(*out, data)
+}
+
+func prove(args []string) error {
+	flags := newFlagSet("prove", "")
+	keyFile := flags.String("key", "key.pem", "`file` holding the prover's key")
+	dir := flags.String("dir", "shards", "shard `directory` to prove, holding every shard")
+	k := flags.Uint("k", 4, "number of segments to prove")
+	block := flags.String("block", DefaultBlockchainVal, "blockchainVal to prove over, in hex")
+	seed := flags.String("seed", "", "seed of the ticket in hex; random if empty")
+	out := flags.String("out", "", "`file` to write the ticket to, or standard output")
+	flags.Parse(args)
+
+	key, err := readKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	manifest, enc, err := readFullDataset(*dir)
+	if err != nil {
+		return err
+	}
+	if err := checkSegments(*k, len(manifest.Hashes)); err != nil {
+		return err
+	}
+	blockchainVal, err := parseBlockchainVal(*block)
+	if err != nil {
+		return err
+	}
+	seedBytes := make([]byte, 12)
+	if *seed == "" {
+		if _, err := rand.Read(seedBytes); err != nil {
+			return err
+		}
+	} else if seedBytes, err = hex.DecodeString(*seed); err != nil {
+		return fmt.Errorf("seed is not hex: %v", err)
+	}
+	return writeOutput(*out, por.ProducePOR(key, blockchainVal, enc, *k, seedBytes))
+}
+
+func verify(args []string) error {
+	flags := newFlagSet("verify", "ticket")
+	dir := flags.String("dir", "shards", "shard `directory` whose manifest the ticket is checked against")
+	k := flags.Uint("k", 4, "number of segments the ticket must prove")
+	block := flags.String("block", DefaultBlockchainVal, "blockchainVal the ticket is over, in hex")
+	bits := flags.Uint("bits", 0, "difficulty in bits the ticket must beat")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("no ticket to verify")
+	}
+
+	manifest, err := readManifest(*dir)
+	if err != nil {
+		return err
+	}
+	if err := checkSegments(*k, len(manifest.Hashes)); err != nil {
+		return err
+	}
+	ticket, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	blockchainVal, err := parseBlockchainVal(*block)
+	if err != nil {
+		return err
+	}
+	difficultyParam, err := difficulty(*bits)
+	if err != nil {
+		return err
+	}
+	if err := por.CheckMine(manifest.Hashes, blockchainVal, ticket, *k, difficultyParam); err != nil {
+		return err
+	}
+	fmt.Println("ticket verifies")
+	return nil
+}
+
+func mine(args []string) error {
+	flags := newFlagSet("mine", "")
+	keyFile := flags.String("key", "key.pem", "`file` holding the miner's key")
+	dir := flags.String("dir", "shards", "shard `directory` to mine over, holding every shard")
+	k := flags.Uint("k", 4, "number of segments to prove")
+	block := flags.String("block", DefaultBlockchainVal, "blockchainVal to mine over, in hex")
+	bits := flags.Uint("bits", 8, "difficulty in bits the ticket must beat")
+	out := flags.String("out", "", "`file` to write the ticket to, or standard output")
+	flags.Parse(args)
+
+	key, err := readKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	manifest, enc, err := readFullDataset(*dir)
+	if err != nil {
+		return err
+	}
+	if err := checkSegments(*k, len(manifest.Hashes)); err != nil {
+		return err
+	}
+	blockchainVal, err := parseBlockchainVal(*block)
+	if err != nil {
+		return err
+	}
+	difficultyParam, err := difficulty(*bits)
+	if err != nil {
+		return err
+	}
+	return writeOutput(*out, por.AttemptedMine(key, blockchainVal, enc, *k, difficultyParam))
+}
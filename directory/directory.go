@@ -0,0 +1,250 @@
+// Package directory lists the aldermen that clients can store files with:
+// where to reach them, what they charge, how much space they have free and how
+// reliable they have been. A Directory is built from the announcements and
+// records of the council on the ledger, or loaded from a local registry file,
+// and clients choose the aldermen for an upload from it.
+package directory
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tusharjois/councilfs/alderman"
+	"github.com/tusharjois/councilfs/ledger"
+	"github.com/tusharjois/councilfs/por"
+)
+
+// Ref is the name every ledger.Announcement refers to.
+var Ref = []byte("councilfs directory")
+
+// ErrTooFewAldermen is returned by Choose when fewer aldermen than requested
+// meet the criteria.
+var ErrTooFewAldermen = errors.New("too few aldermen meet the criteria")
+
+// Announcement is the payload of a ledger.Announcement: the address at which
+// an alderman serves clients, the Payment it asks per interval of a channel,
+// what it asks for each shard a client downloads, and the bytes it has free
+// for new shards.
+type Announcement struct {
+	Address    string
+	Price      uint
+	ShardPrice uint
+	Capacity   uint64
+}
+
+// Announce publishes an announcement of the alderman with key to l.
+func Announce(l ledger.Ledger, key *ecdsa.PrivateKey, announcement Announcement) ([]byte, error) {
+	return l.Submit(ledger.NewTransaction(ledger.Announcement, Ref, announcement, key))
+}
+
+// Listing is the entry of an alderman in a Directory. Key is the PKIX encoding
+// of its public key, Demerits are those its published failures carry, and
+// Announced is the Unix time of the announcement the listing is built from.
+type Listing struct {
+	Key        []byte
+	Address    string
+	Price      uint
+	ShardPrice uint
+	Capacity   uint64
+	Demerits   float64
+	Announced  int64
+}
+
+// PublicKey parses the public key of the alderman.
+func (listing *Listing) PublicKey() (*ecdsa.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(listing.Key)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaKey, correctType := key.(*ecdsa.PublicKey)
+	if !correctType {
+		return nil, errors.New("alderman key is not an ecdsa key")
+	}
+	return ecdsaKey, nil
+}
+
+// Directory is a set of listings keyed by the fingerprint of their key. It is
+// safe for concurrent use.
+type Directory struct {
+	mu       sync.Mutex
+	listings map[string]Listing
+}
+
+// New creates a directory holding listings.
+func New(listings ...Listing) *Directory {
+	d := &Directory{listings: make(map[string]Listing)}
+	for _, listing := range listings {
+		d.Add(listing)
+	}
+	return d
+}
+
+// FromLedger builds the directory of the current aldermen from l. Every member
+// of the council, as replayed from genesis by alderman.LedgerMembership, that
+// has announced itself is listed with its latest announcement, and judged by
+// the proofs of its failures with policy at now.
+func FromLedger(l ledger.Ledger, genesis []*ecdsa.PublicKey, policy alderman.ReputationPolicy, now time.Time) (*Directory, error) {
+	txs, err := l.References(Ref)
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]*ledger.Transaction)
+	var announcers [][]byte
+	for _, tx := range txs {
+		if tx.Kind != ledger.Announcement || tx.Verify() != nil {
+			continue
+		}
+		id := por.FingerprintPKIX(tx.Sender)
+		if _, seen := latest[id]; !seen {
+			announcers = append(announcers, tx.Sender)
+		}
+		// announcements are in the order the ledger accepted them
+		latest[id] = tx
+	}
+	members, err := alderman.LedgerMembership(l, genesis, announcers)
+	if err != nil {
+		return nil, err
+	}
+
+	d := New()
+	for id, tx := range latest {
+		key, ok := members[id]
+		if !ok {
+			continue
+		}
+		var announcement Announcement
+		if err := json.Unmarshal(tx.Payload, &announcement); err != nil {
+			continue
+		}
+		demerits, err := alderman.LedgerReputation(l, key, policy, now)
+		if err != nil {
+			return nil, err
+		}
+		d.Add(Listing{
+			Key:        tx.Sender,
+			Address:    announcement.Address,
+			Price:      announcement.Price,
+			ShardPrice: announcement.ShardPrice,
+			Capacity:   announcement.Capacity,
+			Demerits:   demerits,
+			Announced:  tx.Timestamp,
+		})
+	}
+	return d, nil
+}
+
+// Load reads a directory from the registry file at path.
+func Load(path string) (*Directory, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var listings []Listing
+	if err := json.Unmarshal(encoded, &listings); err != nil {
+		return nil, fmt.Errorf("malformed registry file %v: %v", path, err)
+	}
+	return New(listings...), nil
+}
+
+// Save writes the directory to the registry file at path. The file is written
+// beside path and renamed over it, so a crash leaves the old file or the new.
+func (d *Directory) Save(path string) error {
+	encoded, err := json.MarshalIndent(d.Listings(), "", "\t")
+	if err != nil {
+		return err
+	}
+	tmpName := path + ".tmp"
+	if err := ioutil.WriteFile(tmpName, encoded, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
+
+// Add lists an alderman, replacing its previous listing.
+func (d *Directory) Add(listing Listing) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.listings[por.FingerprintPKIX(listing.Key)] = listing
+}
+
+// Remove removes the listing of the alderman with fingerprint.
+func (d *Directory) Remove(fingerprint string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.listings, fingerprint)
+}
+
+// Lookup returns the listing of the alderman with fingerprint.
+func (d *Directory) Lookup(fingerprint string) (Listing, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	listing, ok := d.listings[fingerprint]
+	return listing, ok
+}
+
+// Listings returns every listing, ordered by fingerprint.
+func (d *Directory) Listings() []Listing {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ids := make([]string, 0, len(d.listings))
+	for id := range d.listings {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	listings := make([]Listing, len(ids))
+	for i, id := range ids {
+		listings[i] = d.listings[id]
+	}
+	return listings
+}
+
+// Criteria are what a client requires of the aldermen of an upload. Space is
+// the capacity each must have free for its shards, and aldermen asking more
+// than MaxPrice or MaxShardPrice, unless they are zero, or carrying more than
+// MaxDemerits are passed over.
+type Criteria struct {
+	Space         uint64
+	MaxPrice      uint
+	MaxShardPrice uint
+	MaxDemerits   float64
+}
+
+// Choose picks n distinct aldermen that meet criteria for an upload. The most
+// reliable aldermen are preferred, then the cheapest, then those with the most
+// free space, so the same directory always yields the same choice.
+// ErrTooFewAldermen is returned if fewer than n meet the criteria.
+func (d *Directory) Choose(n int, criteria Criteria) ([]Listing, error) {
+	var candidates []Listing
+	for _, listing := range d.Listings() {
+		switch {
+		case listing.Capacity < criteria.Space:
+		case criteria.MaxPrice != 0 && listing.Price > criteria.MaxPrice:
+		case criteria.MaxShardPrice != 0 && listing.ShardPrice > criteria.MaxShardPrice:
+		case listing.Demerits > criteria.MaxDemerits:
+		default:
+			candidates = append(candidates, listing)
+		}
+	}
+	if len(candidates) < n {
+		return nil, ErrTooFewAldermen
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Demerits != b.Demerits {
+			return a.Demerits < b.Demerits
+		}
+		if a.Price != b.Price {
+			return a.Price < b.Price
+		}
+		return a.Capacity > b.Capacity
+	})
+	return candidates[:n], nil
+}
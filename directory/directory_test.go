@@ -0,0 +1,124 @@
+package directory
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tusharjois/councilfs/alderman"
+	"github.com/tusharjois/councilfs/ledger"
+	"github.com/tusharjois/councilfs/por"
+)
+
+func marshalKey(key *ecdsa.PublicKey) []byte {
+	encoded, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		panic(err)
+	}
+	return encoded
+}
+
+func TestFromLedger(t *testing.T) {
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+	l := ledger.NewMemory()
+	l.Clock = clock
+	keys := []*ecdsa.PrivateKey{por.GenerateKey(), por.GenerateKey(), por.GenerateKey()}
+	var genesis []*ecdsa.PublicKey
+	for _, key := range keys {
+		genesis = append(genesis, &key.PublicKey)
+	}
+
+	Announce(l, keys[0], Announcement{Address: "old:1", Price: 20, Capacity: 1 << 20})
+	now = now.Add(time.Minute)
+	Announce(l, keys[0], Announcement{Address: "alder0:1", Price: 20, Capacity: 1 << 20})
+	Announce(l, keys[1], Announcement{Address: "alder1:1", Price: 10, Capacity: 1 << 10})
+	Announce(l, keys[2], Announcement{Address: "alder2:1", Price: 5, Capacity: 1 << 30})
+	// a miner that is not on the council is not listed
+	Announce(l, por.GenerateKey(), Announcement{Address: "outsider:1", Price: 1, Capacity: 1 << 30})
+
+	// the third member fails a challenge, and the proof is published
+	dataset, err := por.CreateErasureCoding([]byte("Left Munich at 8:35 P. M., on 1st May"), 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := por.CreateErasureCoding([]byte("arriving at Vienna early next morning"), 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenger := alderman.New(keys[0], clock)
+	challenger.SetLedger(l)
+	challenge := challenger.IssueChallenge(genesis[2], dataset, 2)
+	response := alderman.RespondToChallenge(keys[2], challenge, other)
+	if passed, err := challenger.VerifyMiner(challenge, response, dataset, true); err != nil || passed {
+		t.Fatal("ticket over the wrong dataset verified")
+	}
+
+	d, err := FromLedger(l, genesis, alderman.DefaultReputationPolicy(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listings := d.Listings()
+	if len(listings) != 3 {
+		t.Fatalf("directory lists %v aldermen, expected 3", len(listings))
+	}
+	first, ok := d.Lookup(por.Fingerprint(genesis[0]))
+	if !ok || first.Address != "alder0:1" || first.Announced != now.Unix() {
+		t.Errorf("listing %+v is not built from the latest announcement", first)
+	}
+	failed, _ := d.Lookup(por.Fingerprint(genesis[2]))
+	if failed.Demerits != 1 {
+		t.Errorf("failing alderman carries %v demerits, expected 1", failed.Demerits)
+	}
+	if key, err := failed.PublicKey(); err != nil || por.Fingerprint(key) != por.Fingerprint(genesis[2]) {
+		t.Errorf("listing key does not parse: %v", err)
+	}
+}
+
+func TestChoose(t *testing.T) {
+	keys := make([][]byte, 4)
+	for i := range keys {
+		keys[i] = marshalKey(&por.GenerateKey().PublicKey)
+	}
+	d := New(
+		Listing{Key: keys[0], Address: "cheap", Price: 5, ShardPrice: 3, Capacity: 1 << 20},
+		Listing{Key: keys[1], Address: "roomy", Price: 10, ShardPrice: 1, Capacity: 1 << 30},
+		Listing{Key: keys[2], Address: "full", Price: 1, Capacity: 10},
+		Listing{Key: keys[3], Address: "unreliable", Price: 1, Capacity: 1 << 30, Demerits: 2},
+	)
+
+	chosen, err := d.Choose(2, Criteria{Space: 1 << 10, MaxDemerits: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chosen) != 2 || chosen[0].Address != "cheap" || chosen[1].Address != "roomy" {
+		t.Errorf("chose %+v, expected the cheap and then the roomy alderman", chosen)
+	}
+	if _, err := d.Choose(2, Criteria{Space: 1 << 10, MaxPrice: 5, MaxDemerits: 1}); err != ErrTooFewAldermen {
+		t.Errorf("expected ErrTooFewAldermen, got %v", err)
+	}
+	if chosen, err := d.Choose(1, Criteria{Space: 1 << 10, MaxShardPrice: 2, MaxDemerits: 1}); err != nil || chosen[0].Address != "roomy" {
+		t.Errorf("chose %+v, %v, expected the alderman with cheap retrieval", chosen, err)
+	}
+	if chosen, err := d.Choose(3, Criteria{Space: 1 << 10, MaxDemerits: 3}); err != nil || chosen[0].Address != "cheap" {
+		t.Errorf("chose %+v, %v, expected the reliable aldermen first", chosen, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "aldermen.json")
+	if err := d.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Listings()) != 4 {
+		t.Errorf("loaded %v listings, expected 4", len(loaded.Listings()))
+	}
+	loaded.Remove(por.FingerprintPKIX(keys[3]))
+	if _, ok := loaded.Lookup(por.FingerprintPKIX(keys[3])); ok {
+		t.Errorf("removed listing still present")
+	}
+}
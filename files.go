@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+
+	"github.com/tusharjois/councilfs/por"
+)
+
+// ManifestName is the name of the manifest in a shard directory. The shard
+// with index i in the erasure coding is stored beside it as shard-i.
+const ManifestName = "manifest.json"
+
+// DefaultBlockchainVal is the blockchainVal proofs are made over unless one is
+// given, in hex.
+const DefaultBlockchainVal = "000000000000"
+
+func shardPath(dir string, index int) string {
+	return filepath.Join(dir, fmt.Sprintf("shard-%d", index))
+}
+
+// writeKey writes key to a new PEM file at path, readable only by its owner.
+func writeKey(path string, key *ecdsa.PrivateKey) error {
+	encoded, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: "EC PRIVATE KEY", Bytes: encoded}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readKey reads a key written by writeKey.
+func readKey(path string) (*ecdsa.PrivateKey, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(encoded)
+	if block == nil || block.Type != "EC PRIVATE KEY" {
+		return nil, fmt.Errorf("%v does not hold an EC private key", path)
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// writeDataset writes every shard of enc, and its manifest, to the shard
+// directory dir, creating it if needed.
+func writeDataset(dir string, enc *por.EncodedDataset) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for i, shard := range enc.Shards() {
+		if err := ioutil.WriteFile(shardPath(dir, enc.Ordering()[i]), shard, 0600); err != nil {
+			return err
+		}
+	}
+	encoded, err := json.MarshalIndent(enc.Manifest(), "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, ManifestName), encoded, 0600)
+}
+
+// readManifest reads the manifest of the shard directory dir.
+func readManifest(dir string) (*por.Manifest, error) {
+	encoded, err := ioutil.ReadFile(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return nil, err
+	}
+	manifest := new(por.Manifest)
+	if err := json.Unmarshal(encoded, manifest); err != nil {
+		return nil, fmt.Errorf("malformed manifest in %v: %v", dir, err)
+	}
+	return manifest, nil
+}
+
+// readDataset reads the manifest of the shard directory dir and the shards it
+// holds, which need not be all of them.
+func readDataset(dir string) (*por.Manifest, *por.EncodedDataset, error) {
+	manifest, err := readManifest(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	shards := make(map[int][]byte)
+	for index := range manifest.Hashes {
+		shard, err := ioutil.ReadFile(shardPath(dir, index))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		shards[index] = shard
+	}
+	enc, err := manifest.Dataset(shards)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v: %v", dir, err)
+	}
+	return manifest, enc, nil
+}
+
+// readFullDataset reads a shard directory like readDataset, but fails unless
+// it holds every shard, as proofs of retrievability are made over the whole
+// dataset.
+func readFullDataset(dir string) (*por.Manifest, *por.EncodedDataset, error) {
+	manifest, enc, err := readDataset(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if int(enc.Length()) != len(manifest.Hashes) {
+		return nil, nil, fmt.Errorf("%v holds %v of %v shards", dir, enc.Length(), len(manifest.Hashes))
+	}
+	return manifest, enc, nil
+}
+
+// parseBlockchainVal decodes a hex encoded blockchainVal.
+func parseBlockchainVal(encoded string) ([]byte, error) {
+	blockchainVal, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("blockchainVal is not hex: %v", err)
+	}
+	return blockchainVal, nil
+}
+
+// difficulty returns the difficulty parameter that a ticket beats with
+// probability 2^-bits.
+func difficulty(bits uint) (*big.Int, error) {
+	if bits > 256 {
+		return nil, errors.New("difficulty cannot exceed 256 bits")
+	}
+	return new(big.Int).Lsh(big.NewInt(1), 256-bits), nil
+}
+
+// checkSegments checks that k segments can be proved over a dataset of the
+// given number of shards.
+func checkSegments(k uint, shards int) error {
+	if k == 0 {
+		return errors.New("k must be at least 1")
+	}
+	if k > uint(shards) {
+		return fmt.Errorf("k of %v exceeds the %v shards of the dataset", k, shards)
+	}
+	return nil
+}
+
+// writeOutput writes data to the file at path, or standard output if path is
+// empty.
+func writeOutput(path string, data []byte) error {
+	if path == "" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
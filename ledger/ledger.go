@@ -0,0 +1,312 @@
+// Package ledger provides the abstraction of the blockchain that clients and
+// aldermen use to publish transactions, such as the funding transactions that
+// back payment channels, the settlements that close them, the proofs that
+// miners failed their challenges and the changes of the alderman council.
+package ledger
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tusharjois/councilfs/por"
+)
+
+// Kind identifies what a Transaction does. The payloads of the transactions
+// that concern payment channels are defined by the client package.
+type Kind uint8
+
+const (
+	// Funding locks funds of a client into a payment channel with an
+	// alderman.
+	Funding Kind = iota
+
+	// CooperativeClose settles a payment channel with a final balance signed
+	// by both the client and the alderman. It refers to the ID of the
+	// channel's Funding.
+	CooperativeClose
+
+	// UnilateralClose starts settling a payment channel with the latest state
+	// held by one party. It refers to the ID of the channel's Funding.
+	UnilateralClose
+
+	// DisputeClose answers a UnilateralClose with a newer state of the
+	// channel during the dispute window. It refers to the UnilateralClose.
+	DisputeClose
+
+	// FailureProof publishes the evidence that a miner failed a challenge. It
+	// refers to the public key of the miner, and its payload is defined by the
+	// alderman package.
+	FailureProof
+
+	// MembershipChange publishes the certificate of an ejection from, or a
+	// promotion to, the alderman council. It refers to the public key of the
+	// alderman concerned, and its payload is defined by the alderman package.
+	MembershipChange
+
+	// FileRegistration registers a file to be stored for a price and a
+	// duration. It refers to the content ID of the file, and its payload is
+	// defined by the chain package, as are those of the kinds below.
+	FileRegistration
+
+	// StorageAssignment assigns a registered file to the aldermen that store
+	// it. It refers to the content ID of the file.
+	StorageAssignment
+
+	// RewardPayout pays the reward of a block to miners. It refers to nothing.
+	RewardPayout
+
+	// Announcement publishes the address, price and free capacity of an
+	// alderman. It refers to a name shared by every announcement, so that they
+	// can all be found, and its payload is defined by the directory package.
+	Announcement
+)
+
+// Transaction is a signed transaction published to a Ledger. Ref names what
+// the transaction refers to, such as a channel or an earlier transaction, and
+// Timestamp is the Unix time at which the ledger accepted the transaction.
+type Transaction struct {
+	Kind      Kind
+	Ref       []byte
+	Payload   []byte
+	Sender    []byte
+	Signature []byte
+	Timestamp int64
+}
+
+// ErrNotFound is returned when a transaction is not on the ledger.
+var ErrNotFound = errors.New("transaction not found")
+
+// Block is a batch of transactions sealed by the ledger, in the order in which
+// they were accepted. Blocks are numbered from zero by Height, and each names
+// the hash of the one before it.
+type Block struct {
+	Height       uint64
+	PrevHash     []byte
+	Timestamp    int64
+	Transactions []*Transaction
+}
+
+// Hash returns the hash of the block, which covers its header and the IDs of
+// its transactions.
+func (b *Block) Hash() []byte {
+	h := sha256.New()
+	var header [16]byte
+	binary.BigEndian.PutUint64(header[:8], b.Height)
+	binary.BigEndian.PutUint64(header[8:], uint64(b.Timestamp))
+	h.Write(header[:])
+	h.Write(b.PrevHash)
+	for _, tx := range b.Transactions {
+		h.Write(tx.ID())
+	}
+	return h.Sum(nil)
+}
+
+// Ledger is a store of transactions, such as a blockchain.
+type Ledger interface {
+	// Submit publishes a transaction and returns its ID.
+	Submit(tx *Transaction) ([]byte, error)
+
+	// Lookup returns the transaction with the given ID, or ErrNotFound.
+	Lookup(id []byte) (*Transaction, error)
+
+	// References returns the transactions whose Ref is ref, in the order in
+	// which they were accepted.
+	References(ref []byte) ([]*Transaction, error)
+
+	// Subscribe calls notify with every block sealed from now on, in order,
+	// until the returned function is called.
+	Subscribe(notify func(*Block)) (cancel func())
+}
+
+func signingDigest(kind Kind, ref []byte, payload []byte, sender []byte) [sha256.Size]byte {
+	toSign, err := json.Marshal(Transaction{Kind: kind, Ref: ref, Payload: payload, Sender: sender})
+	if err != nil {
+		panic(err)
+	}
+	return sha256.Sum256(toSign)
+}
+
+// NewTransaction creates a transaction of the given kind referring to ref, with
+// the JSON encoding of v as its payload, signed by senderKey.
+func NewTransaction(kind Kind, ref []byte, v interface{}, senderKey *ecdsa.PrivateKey) *Transaction {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	sender, err := x509.MarshalPKIXPublicKey(&senderKey.PublicKey)
+	if err != nil {
+		panic(err)
+	}
+	digest := signingDigest(kind, ref, payload, sender)
+	return &Transaction{
+		Kind:      kind,
+		Ref:       ref,
+		Payload:   payload,
+		Sender:    sender,
+		Signature: por.SignAndMarshal(senderKey, digest[:]),
+	}
+}
+
+// ID returns the identifier of the transaction, which covers everything but the
+// Timestamp assigned by the ledger.
+func (tx *Transaction) ID() []byte {
+	digest := signingDigest(tx.Kind, tx.Ref, tx.Payload, tx.Sender)
+	id := sha256.Sum256(append(digest[:], tx.Signature...))
+	return id[:]
+}
+
+// Verify checks that the transaction is signed by its sender.
+func (tx *Transaction) Verify() error {
+	key, err := x509.ParsePKIXPublicKey(tx.Sender)
+	if err != nil {
+		return err
+	}
+	senderKey, correctType := key.(*ecdsa.PublicKey)
+	if !correctType {
+		return errors.New("sender key is not an ecdsa key")
+	}
+	digest := signingDigest(tx.Kind, tx.Ref, tx.Payload, tx.Sender)
+	if !por.VerifyAndUnMarshal(senderKey, digest[:], tx.Signature) {
+		return errors.New("transaction signature does not verify")
+	}
+	return nil
+}
+
+// Memory is a Ledger held in memory, for use in tests and simulations. It
+// accepts transactions as soon as they are submitted, and groups them into a
+// block whenever Seal is called. It is safe for concurrent use.
+type Memory struct {
+	// Clock returns the time at which transactions are accepted. It can be
+	// replaced to simulate the passing of time.
+	Clock func() time.Time
+
+	mu           sync.Mutex
+	transactions map[string]*Transaction
+	order        []*Transaction
+	pending      []*Transaction
+	blocks       []*Block
+
+	// sealing serializes Seal, so subscribers see blocks in order
+	sealing     sync.Mutex
+	subscribers map[int]func(*Block)
+	nextSub     int
+}
+
+// NewMemory creates an empty in-memory ledger.
+func NewMemory() *Memory {
+	return &Memory{
+		Clock:        time.Now,
+		transactions: make(map[string]*Transaction),
+		subscribers:  make(map[int]func(*Block)),
+	}
+}
+
+// Submit publishes a transaction to the ledger. An error is returned if the
+// transaction is not correctly signed or is already on the ledger.
+func (m *Memory) Submit(tx *Transaction) ([]byte, error) {
+	if err := tx.Verify(); err != nil {
+		return nil, err
+	}
+	id := tx.ID()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := hex.EncodeToString(id)
+	if _, present := m.transactions[key]; present {
+		return nil, fmt.Errorf("transaction %v already submitted", key)
+	}
+	stored := *tx
+	stored.Timestamp = m.Clock().Unix()
+	m.transactions[key] = &stored
+	m.order = append(m.order, &stored)
+	m.pending = append(m.pending, &stored)
+	return id, nil
+}
+
+// Lookup returns the transaction with the given ID.
+func (m *Memory) Lookup(id []byte) (*Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tx, present := m.transactions[hex.EncodeToString(id)]
+	if !present {
+		return nil, ErrNotFound
+	}
+	found := *tx
+	return &found, nil
+}
+
+// References returns the transactions referring to ref.
+func (m *Memory) References(ref []byte) ([]*Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var found []*Transaction
+	for _, tx := range m.order {
+		if bytes.Equal(tx.Ref, ref) {
+			copied := *tx
+			found = append(found, &copied)
+		}
+	}
+	return found, nil
+}
+
+// Subscribe calls notify with every block sealed from now on. notify is called
+// by Seal, and must not call Seal itself.
+func (m *Memory) Subscribe(notify func(*Block)) (cancel func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := m.nextSub
+	m.nextSub++
+	m.subscribers[id] = notify
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.subscribers, id)
+	}
+}
+
+// Seal groups the transactions accepted since the last block into a new block
+// and hands it to the subscribers. Blocks may be empty.
+func (m *Memory) Seal() *Block {
+	m.sealing.Lock()
+	defer m.sealing.Unlock()
+
+	m.mu.Lock()
+	block := &Block{Height: uint64(len(m.blocks)), Timestamp: m.Clock().Unix()}
+	if len(m.blocks) > 0 {
+		block.PrevHash = m.blocks[len(m.blocks)-1].Hash()
+	}
+	for _, tx := range m.pending {
+		copied := *tx
+		block.Transactions = append(block.Transactions, &copied)
+	}
+	m.pending = nil
+	m.blocks = append(m.blocks, block)
+	var notify []func(*Block)
+	for _, subscriber := range m.subscribers {
+		notify = append(notify, subscriber)
+	}
+	m.mu.Unlock()
+
+	for _, subscriber := range notify {
+		subscriber(block)
+	}
+	return block
+}
+
+// Block returns the block at height, or nil if it has not been sealed.
+func (m *Memory) Block(height uint64) *Block {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if height >= uint64(len(m.blocks)) {
+		return nil
+	}
+	return m.blocks[height]
+}
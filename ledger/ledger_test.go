@@ -0,0 +1,92 @@
+package ledger
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tusharjois/councilfs/por"
+)
+
+func TestMemory(t *testing.T) {
+	key := por.GenerateKey()
+	ledger := NewMemory()
+
+	tx := NewTransaction(Funding, nil, "payload", key)
+	id, err := ledger.Submit(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(id, tx.ID()) {
+		t.Errorf("ledger returned ID %x for transaction %x", id, tx.ID())
+	}
+	found, err := ledger.Lookup(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(found.Payload, tx.Payload) {
+		t.Errorf("looked up payload %s, expected %s", found.Payload, tx.Payload)
+	}
+
+	if _, err := ledger.Submit(tx); err == nil {
+		t.Errorf("transaction submitted twice")
+	}
+	if _, err := ledger.Lookup(make([]byte, len(id))); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	referring := NewTransaction(DisputeClose, id, "dispute", key)
+	if _, err := ledger.Submit(referring); err != nil {
+		t.Fatal(err)
+	}
+	references, err := ledger.References(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(references) != 1 || !bytes.Equal(references[0].ID(), referring.ID()) {
+		t.Errorf("expected one transaction referring to %x, found %v", id, references)
+	}
+
+	forged := NewTransaction(Funding, nil, "payload", key)
+	forged.Payload = []byte("\"forged\"")
+	if _, err := ledger.Submit(forged); err == nil {
+		t.Errorf("transaction with forged payload was submitted")
+	}
+}
+
+func TestMemoryBlocks(t *testing.T) {
+	key := por.GenerateKey()
+	ledger := NewMemory()
+	var seen []*Block
+	cancel := ledger.Subscribe(func(block *Block) { seen = append(seen, block) })
+
+	first := NewTransaction(Funding, nil, "first", key)
+	second := NewTransaction(Funding, nil, "second", key)
+	ledger.Submit(first)
+	ledger.Submit(second)
+	block := ledger.Seal()
+	if block.Height != 0 || len(block.Transactions) != 2 {
+		t.Fatalf("block %v holds %v transactions, expected block 0 with 2", block.Height, len(block.Transactions))
+	}
+	if !bytes.Equal(block.Transactions[0].ID(), first.ID()) || !bytes.Equal(block.Transactions[1].ID(), second.ID()) {
+		t.Errorf("block does not hold the transactions in the order they were accepted")
+	}
+
+	third := NewTransaction(Funding, nil, "third", key)
+	ledger.Submit(third)
+	next := ledger.Seal()
+	if next.Height != 1 || !bytes.Equal(next.PrevHash, block.Hash()) || len(next.Transactions) != 1 {
+		t.Errorf("second block does not follow the first")
+	}
+	if len(seen) != 2 || seen[0] != block || seen[1] != next {
+		t.Errorf("subscriber saw %v blocks, expected 2", len(seen))
+	}
+	if ledger.Block(1) != next || ledger.Block(2) != nil {
+		t.Errorf("blocks are not kept by height")
+	}
+
+	cancel()
+	ledger.Seal()
+	if len(seen) != 2 {
+		t.Errorf("subscriber notified after cancelling")
+	}
+}
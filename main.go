@@ -1,80 +1,80 @@
+// Command councilfs works with the files, keys and proofs of retrievability of
+// councilfs from the command line, so that workflows can be scripted without
+// writing Go. Usage:
+//
+//	councilfs <command> [flags] [arguments]
+//
+// The commands are:
+//
+//	keygen  generate a key for a client, alderman or miner
+//	encode  erasure code a file into a shard directory and its manifest
+//	decode  rebuild a file from the shards in a shard directory
+//	prove   produce a proof of retrievability ticket over a shard directory
+//	verify  check a ticket against the manifest of a shard directory
+//	mine    produce a ticket that beats a difficulty
+//	bench   time proofs of retrievability over a file
+//
+// Run "councilfs <command> -h" for the flags of a command.
 package main
 
-import(
+import (
+	"flag"
 	"fmt"
-	"io/ioutil"
-	"github.com/tusharjois/councilfs/por"
-	"time"
 	"os"
-	"math"
 )
 
+// command is a subcommand of councilfs. run is passed the arguments that
+// follow the name of the command.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
 
-func main() {
-    fmt.Print("Running POR test battery")
-    readContents, err := ioutil.ReadFile("testFile.txt")
-    if err != nil {
-    	panic(err)
-    }
-    var proofFile *os.File;
-    _, err = os.Stat("proofExecution.dat")
-    if err == nil {
-    	proofFile, err = os.Create("proofExecution.dat")
-    	if err != nil {
-    		panic(err)
-    	}
-    } else {
-    	proofFile, err = os.OpenFile("proofExecution.dat", os.O_APPEND|os.O_WRONLY, 0600)
-    	if err != nil {
-    	    panic(err)
-    	}
-    }
-    defer proofFile.Close()
-
-    var verifyFile *os.File;
-    _, err = os.Stat("verifyExecution.dat")
-    if err == nil {
-    	verifyFile, err = os.Create("verifyExecution.dat")
-    	if err != nil {
-    		panic(err)
-    	}
-    } else {
-    	verifyFile, err = os.OpenFile("verifyExecution.txt", os.O_APPEND|os.O_WRONLY, 0600)
-    	if err != nil {
-    		panic(err)
-    	}
-    }
+var commands = []command{
+	{"keygen", "generate a key for a client, alderman or miner", keygen},
+	{"encode", "erasure code a file into a shard directory and its manifest", encode},
+	{"decode", "rebuild a file from the shards in a shard directory", decode},
+	{"prove", "produce a proof of retrievability ticket over a shard directory", prove},
+	{"verify", "check a ticket against the manifest of a shard directory", verify},
+	{"mine", "produce a ticket that beats a difficulty", mine},
+	{"bench", "time proofs of retrievability over a file", bench},
+}
 
-    defer verifyFile.Close()
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: councilfs <command> [flags] [arguments]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8v%v\n", cmd.name, cmd.summary)
+	}
+	os.Exit(2)
+}
 
-    porKey := por.GenerateKey()
-    var blockchainVal = make([]byte, 6)
-    var seed = []byte{115,101,101,100}
-    encodedSet, error := por.CreateErasureCoding(readContents, 25, 4)
-    if error != nil {
-        panic(error)
-    }
-    unitSegment := int(math.Ceil(float64(len(readContents)) / float64(((75 + 1)*10)/2))) 
-    
-    for k := 1; k < 100; k ++ {
-        start := time.Now()
-        proof := por.ProducePOR(porKey, blockchainVal, encodedSet, uint(k), seed)
-        total_time := time.Since(start)
-    	writeToFile := fmt.Sprintf("%v %d\n", total_time.Seconds(), k*unitSegment)
-        if _, err := proofFile.WriteString(writeToFile); err != nil {
-        	panic(err)
-        }
+// newFlagSet creates the flags of the command name, whose arguments are
+// described by arguments in its usage message.
+func newFlagSet(name string, arguments string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: councilfs %v [flags] %v\n", name, arguments)
+		flags.PrintDefaults()
+	}
+	return flags
+}
 
-        startV := time.Now()
-        verify := por.VerifyPOR(encodedSet,blockchainVal, proof, uint(k))
-        sVtime := time.Since(startV)
-        if !verify {
-        	fmt.Print("This shouldn't happen...  you need to debug")
-        }
-    	writeToFile = fmt.Sprintf("%v %d\n", sVtime.Seconds(), k*unitSegment)
-        if _, err := verifyFile.WriteString(writeToFile); err != nil {
-        	panic(err)
-        }
-    }
-    
-}
\ No newline at end of file
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "councilfs %v: %v\n", cmd.name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "councilfs: unknown command %q\n", os.Args[1])
+	usage()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// run runs the command name from the commands table with args.
+func run(t *testing.T, name string, args ...string) error {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd.run(args)
+		}
+	}
+	t.Fatalf("no command %v", name)
+	return nil
+}
+
+// newShardDir encodes data into a shard directory in dir, and returns its
+// path.
+func newShardDir(t *testing.T, dir string, data []byte) string {
+	input := filepath.Join(dir, "input")
+	if err := ioutil.WriteFile(input, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	shards := filepath.Join(dir, "shards")
+	if err := run(t, "encode", "-r", "2", "-f", "4", "-out", shards, input); err != nil {
+		t.Fatal(err)
+	}
+	return shards
+}
+
+func TestEncodeDecode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "councilfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := []byte("Left Munich at 8:35 P. M., on 1st May, arriving at Vienna early next morning")
+	shards := newShardDir(t, dir, data)
+
+	// any of the manifest's DataShards rebuild the file
+	manifest, err := readManifest(shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parity := len(manifest.Hashes) - manifest.DataShards
+	for index := 0; index < parity; index++ {
+		if err := os.Remove(shardPath(shards, index)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	output := filepath.Join(dir, "output")
+	if err := run(t, "decode", "-dir", shards, "-out", output); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Errorf("decoded %q, expected %q", decoded, data)
+	}
+
+	// fewer do not
+	if err := os.Remove(shardPath(shards, parity)); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(t, "decode", "-dir", shards, "-out", output); err == nil {
+		t.Errorf("file rebuilt from too few shards")
+	}
+}
+
+func TestProveVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "councilfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	shards := newShardDir(t, dir, []byte("Left Munich at 8:35 P. M., on 1st May"))
+	key := filepath.Join(dir, "key.pem")
+	if err := run(t, "keygen", "-out", key); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(t, "keygen", "-out", key); err == nil {
+		t.Errorf("keygen overwrote an existing key")
+	}
+
+	ticket := filepath.Join(dir, "ticket")
+	if err := run(t, "prove", "-key", key, "-dir", shards, "-k", "2", "-out", ticket); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(t, "verify", "-dir", shards, "-k", "2", ticket); err != nil {
+		t.Errorf("ticket failed to verify: %v", err)
+	}
+	if err := run(t, "verify", "-dir", shards, "-k", "2", "-block", "ffffffffffff", ticket); err == nil {
+		t.Errorf("ticket verified over another blockchainVal")
+	}
+
+	// a mined ticket beats its difficulty
+	mined := filepath.Join(dir, "mined")
+	if err := run(t, "mine", "-key", key, "-dir", shards, "-k", "2", "-bits", "2", "-out", mined); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(t, "verify", "-dir", shards, "-k", "2", "-bits", "2", mined); err != nil {
+		t.Errorf("mined ticket failed to verify: %v", err)
+	}
+
+	// k must name at least one segment, and no more than there are shards
+	for _, k := range []string{"0", "9"} {
+		if err := run(t, "prove", "-key", key, "-dir", shards, "-k", k, "-out", ticket); err == nil {
+			t.Errorf("proved with k of %v", k)
+		}
+		if err := run(t, "verify", "-dir", shards, "-k", k, ticket); err == nil {
+			t.Errorf("verified with k of %v", k)
+		}
+		if err := run(t, "mine", "-key", key, "-dir", shards, "-k", k, "-bits", "0", "-out", mined); err == nil {
+			t.Errorf("mined with k of %v", k)
+		}
+	}
+}
+
+func TestReadDataset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "councilfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	shards := newShardDir(t, dir, []byte("Left Munich at 8:35 P. M., on 1st May"))
+
+	if _, _, err := readDataset(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("read a directory that does not exist")
+	}
+
+	// proofs need every shard
+	if err := os.Remove(shardPath(shards, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readDataset(shards); err != nil {
+		t.Errorf("partial dataset was not read: %v", err)
+	}
+	if _, _, err := readFullDataset(shards); err == nil {
+		t.Errorf("partial dataset was read as a full one")
+	}
+
+	// shards must match the manifest
+	if err := ioutil.WriteFile(shardPath(shards, 1), []byte("not a shard"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readDataset(shards); err == nil {
+		t.Errorf("dataset read with a corrupt shard")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(shards, ManifestName), []byte("not a manifest"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readDataset(shards); err == nil {
+		t.Errorf("dataset read with a malformed manifest")
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"crypto/elliptic"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
 	"crypto/rand"
@@ -73,7 +75,8 @@ func VerifyAndUnMarshal(minerKey *ecdsa.PublicKey, message []byte, sig []byte) b
 	sigScan := bytes.NewReader(sig)
 	_, err := fmt.Fscanf(sigScan, "(%d,%d)", r, s)
 	if err != nil {
-		panic(err)
+		// a malformed signature cannot verify
+		return false
 	}
 	sigCheck := ecdsa.Verify(minerKey, message[:], r, s)
 
@@ -174,70 +177,95 @@ func ParseTicket(ticket []byte) *Ticket {
 	return structuredTicket
 }
 
+// Errors returned by CheckPOR, describing why a ticket failed to verify.
+var (
+	ErrMalformedTicket = errors.New("ticket is malformed")
+	ErrWrongSegment    = errors.New("ticket contains a segment that does not match the dataset")
+	ErrBadSignature    = errors.New("ticket contains a signature that does not verify")
+)
+
 // Verifies that a given POR ticket is correct in that the following must be true:
 // 1) the POR was created with the correct blockchainVal [it matches the previous block in history]
 // 2) the included files are segments of the fileDigests held by the verifier
 // 3) the final value passes the publicly known difficulty parameter Z
 func VerifyPOR(fileDigests *EncodedDataset , blockchainVal []byte, ticket []byte, k uint) bool {
-	structuredTicket := ParseTicket(ticket)
+	return CheckPOR(fileDigests.hashes, blockchainVal, ticket, k) == nil
+}
+
+// CheckPOR verifies a POR ticket like VerifyPOR, but only needs the hashes of
+// the shards of the dataset, in order, rather than the shards themselves. This
+// lets a third party that only knows the digest of a dataset check a ticket.
+// If the ticket does not verify, the returned error is ErrMalformedTicket,
+// ErrWrongSegment or ErrBadSignature.
+func CheckPOR(hashes [][]byte, blockchainVal []byte, ticket []byte, k uint) error {
+	structuredTicket := new(Ticket)
+	if err := json.Unmarshal(ticket, structuredTicket); err != nil {
+		return ErrMalformedTicket
+	}
+	if uint(len(structuredTicket.ProofFiles)) < k || len(hashes) == 0 {
+		return ErrMalformedTicket
+	}
 	// validate the ticket
 	s, r := big.NewInt(0), big.NewInt(0)
 	currentSig := []byte(fmt.Sprintf("(%d,%d)", r, s))
-	writtenKey, error := x509.ParsePKIXPublicKey(structuredTicket.PublicKey)
-	if error != nil {
-		panic(error)
+	writtenKey, err := x509.ParsePKIXPublicKey(structuredTicket.PublicKey)
+	if err != nil {
+		return ErrMalformedTicket
 	}
 	// TODO: maybe change this but it should only ever be an ecdsa public key
 	minersKey, correctType := writtenKey.(*ecdsa.PublicKey)
 	if !correctType {
-		fmt.Print("Type of miners key should only be ecdsa, fail")
-		return false
+		return ErrMalformedTicket
 	}
 
-	idStr := append(blockchainVal, structuredTicket.PublicKey...)
+	idStr := append(append([]byte{}, blockchainVal...), structuredTicket.PublicKey...)
 	hashStr := append(idStr, structuredTicket.Seed...)
 	shaRes := sha256.Sum256(hashStr)
-	currentFile := calculateFileIndex(shaRes, int64(len(fileDigests.shards)))
+	currentFile := calculateFileIndex(shaRes, int64(len(hashes)))
 	for i := 0; uint(i) < k; i++ {
-
-		if len(structuredTicket.ProofFiles) <= i {
-			fmt.Printf("Length Proof Files: %v\n", len(structuredTicket.ProofFiles))
-			fmt.Printf("Index: %v\n", i)
-		}
 		currFileInfo := structuredTicket.ProofFiles[i]
-		if currentFile > int64(len(fileDigests.shards)) {
-		    panic("Current file index is larger than number of files held")
-		}
-		if currentFile > int64(len(fileDigests.hashes)) {
-		    panic("Current file index is larger than number of hashes held")
-		}
-		hashStr = append(idStr, currentSig...)
-		hashStr = append(hashStr, fileDigests.shards[currentFile]...)
-		currentHash := sha256.Sum256(hashStr)
         // the merkle proof right now is basically just a hash of the segment. 
         // so there are two ways to do this: have the verifier hold more information
         // or have the prover provide more information and the verifier do more computation
         checkHash := sha256.Sum256(currFileInfo.FileSegment)
-		if !bytes.Equal(checkHash[:], fileDigests.hashes[currentFile]) {
-			panic("File segment of Verifier does not match Prover's file")
-			return false
-			//panic("File segment of Verifier does not match Prover's file")
+		if !bytes.Equal(checkHash[:], hashes[currentFile]) {
+			return ErrWrongSegment
 		}
+		// the segment matches the verifier's hash, so it can stand in for the
+		// verifier's own copy of the shard
+		hashStr = append(idStr, currentSig...)
+		hashStr = append(hashStr, currFileInfo.FileSegment...)
+		currentHash := sha256.Sum256(hashStr)
 
-        //fmt.Printf("Verifier Hash and Sig %v and %v\n", currentHash[:], currFileInfo.Signature)
 		if !VerifyAndUnMarshal(minersKey, currentHash[:], currFileInfo.Signature) {
-            return false
+			return ErrBadSignature
 		}
 		
 		// note this is problematic right now because it could select the same value twice
 		currentSig = currFileInfo.Signature
 		hashStr = append(idStr, currentSig...)
 		shaRes = sha256.Sum256(hashStr)
-		currentFile = calculateFileIndex(shaRes, int64(len(fileDigests.shards)))
+		currentFile = calculateFileIndex(shaRes, int64(len(hashes)))
 	}
 
-	// calculate final hash value
-	return true
+	return nil
+}
+
+// ErrLosingTicket is returned by CheckMine for a ticket that verifies but does
+// not beat the difficulty parameter.
+var ErrLosingTicket = errors.New("ticket does not beat the difficulty")
+
+// CheckMine verifies a mined ticket like VerifyMine, but only needs the hashes
+// of the shards of the dataset, as CheckPOR does. If the ticket does not
+// verify, the error is one returned by CheckPOR, or ErrLosingTicket.
+func CheckMine(hashes [][]byte, blockchainVal []byte, ticket []byte, k uint, difficultyParam *big.Int) error {
+	if err := CheckPOR(hashes, blockchainVal, ticket, k); err != nil {
+		return err
+	}
+	if !checkForWinningTicket(blockchainVal, ticket, difficultyParam) {
+		return ErrLosingTicket
+	}
+	return nil
 }
 
 // Bare bones interface for producing an ecdsa asymmetric key. Accepts no arguments and pulls from cryptographic randomness 
@@ -249,3 +277,20 @@ func GenerateKey() *ecdsa.PrivateKey {
 
 	return privKey
 }
+
+// Fingerprint returns a canonical identifier for an ecdsa public key: the hex
+// encoded SHA-256 hash of its PKIX encoding. Unlike the key itself, it can be
+// compared with == and used as a map key.
+func Fingerprint(key *ecdsa.PublicKey) string {
+	keyBytes, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		panic(err)
+	}
+	return FingerprintPKIX(keyBytes)
+}
+
+// FingerprintPKIX returns the Fingerprint of a PKIX encoded public key.
+func FingerprintPKIX(keyBytes []byte) string {
+	hash := sha256.Sum256(keyBytes)
+	return hex.EncodeToString(hash[:])
+}
@@ -29,3 +29,74 @@ func TestPOR(test *testing.T) {
 
 	return
 }
+
+func TestCheckPOR(test *testing.T) {
+	minerKey := GenerateKey()
+	blockchainVal := []byte("blockchainVal")
+	encoding, err := CreateErasureCoding([]byte("qwertyuiopasdfghjkl"), 4, 4)
+	if err != nil {
+		test.Fatal(err)
+	}
+	ticket := ProducePOR(minerKey, blockchainVal, encoding, 3, []byte("seed"))
+	if err := CheckPOR(encoding.Hashes(), blockchainVal, ticket, 3); err != nil {
+		test.Errorf("correct ticket failed to check against hashes: %v", err)
+	}
+
+	forged := ParseTicket(ticket)
+	forged.ProofFiles[1].Signature = forged.ProofFiles[0].Signature
+	if err := CheckPOR(encoding.Hashes(), blockchainVal, TicketMarshal(*forged), 3); err != ErrBadSignature {
+		test.Errorf("expected ErrBadSignature, got %v", err)
+	}
+
+	forged = ParseTicket(ticket)
+	forged.ProofFiles[0].FileSegment = []byte("not a segment")
+	if err := CheckPOR(encoding.Hashes(), blockchainVal, TicketMarshal(*forged), 3); err != ErrWrongSegment {
+		test.Errorf("expected ErrWrongSegment, got %v", err)
+	}
+	if VerifyPOR(encoding, blockchainVal, TicketMarshal(*forged), 3) {
+		test.Errorf("ticket with wrong segment verified")
+	}
+
+	if err := CheckPOR(encoding.Hashes(), blockchainVal, ticket, 4); err != ErrMalformedTicket {
+		test.Errorf("expected ErrMalformedTicket for short ticket, got %v", err)
+	}
+	if err := CheckPOR(encoding.Hashes(), blockchainVal, []byte("{"), 3); err != ErrMalformedTicket {
+		test.Errorf("expected ErrMalformedTicket for bad encoding, got %v", err)
+	}
+}
+
+func TestCheckMine(test *testing.T) {
+	minerKey := GenerateKey()
+	blockchainVal := []byte("blockchainVal")
+	encoding, err := CreateErasureCoding([]byte("qwertyuiopasdfghjklzxcvbnm,."), 2, 4)
+	if err != nil {
+		test.Fatal(err)
+	}
+	difficulty := new(big.Int).Lsh(big.NewInt(1), 250)
+	ticket := AttemptedMine(minerKey, blockchainVal, encoding, 3, difficulty)
+	if err := CheckMine(encoding.Hashes(), blockchainVal, ticket, 3, difficulty); err != nil {
+		test.Errorf("mined ticket does not verify: %v", err)
+	}
+	if err := CheckMine(encoding.Hashes(), blockchainVal, ticket, 3, big.NewInt(0)); err != ErrLosingTicket {
+		test.Errorf("expected ErrLosingTicket against a target of zero, got %v", err)
+	}
+	if err := CheckMine(encoding.Hashes(), []byte("otherVal"), ticket, 3, difficulty); err == nil {
+		test.Errorf("ticket verified against another blockchainVal")
+	}
+}
+
+func TestMerkleRoot(test *testing.T) {
+	leaves := make([][]byte, 3)
+	for i := range leaves {
+		hash := sha256.Sum256([]byte{byte(i)})
+		leaves[i] = hash[:]
+	}
+	pair := sha256.Sum256(append(append([]byte{}, leaves[0]...), leaves[1]...))
+	expected := sha256.Sum256(append(pair[:], leaves[2]...))
+	if root := MerkleRoot(leaves); string(root) != string(expected[:]) {
+		test.Errorf("root of three leaves is %x, expected %x", root, expected)
+	}
+	if root := MerkleRoot(leaves[:1]); string(root) != string(leaves[0]) {
+		test.Errorf("root of one leaf is %x, expected the leaf", root)
+	}
+}
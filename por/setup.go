@@ -3,6 +3,7 @@ package por
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/klauspost/reedsolomon"
@@ -20,35 +21,171 @@ type EncodedDataset struct {
 	originalLen     int
 }
 
+// encodedDatasetJSON is the form in which an EncodedDataset is stored and sent.
+type encodedDatasetJSON struct {
+	Shards          [][]byte
+	Hashes          [][]byte
+	Ordering        []int
+	NumDataShards   int
+	NumParityShards int
+	OriginalLen     int
+}
+
+// MarshalJSON encodes the shards of the EncodedDataset along with the
+// parameters of the erasure coding they belong to.
+func (enc EncodedDataset) MarshalJSON() ([]byte, error) {
+	return json.Marshal(encodedDatasetJSON{enc.shards, enc.hashes, enc.ordering,
+		enc.numDataShards, enc.numParityShards, enc.originalLen})
+}
+
+// UnmarshalJSON decodes an EncodedDataset produced by MarshalJSON. An error is
+// returned if the shards do not match their hashes.
+func (enc *EncodedDataset) UnmarshalJSON(data []byte) error {
+	var decoded encodedDatasetJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	if len(decoded.Shards) != len(decoded.Hashes) || len(decoded.Shards) != len(decoded.Ordering) {
+		return fmt.Errorf("dataset has %v shards, %v hashes and %v orderings",
+			len(decoded.Shards), len(decoded.Hashes), len(decoded.Ordering))
+	}
+	for i, shard := range decoded.Shards {
+		shardHash := sha256.Sum256(shard)
+		if !bytes.Equal(shardHash[:], decoded.Hashes[i]) {
+			return fmt.Errorf("hash of shard %v does not match dataset", decoded.Ordering[i])
+		}
+	}
+	*enc = EncodedDataset{decoded.Shards, decoded.Hashes, decoded.Ordering,
+		decoded.NumDataShards, decoded.NumParityShards, decoded.OriginalLen}
+	return nil
+}
+
 // Length returns the number of shards in the EncodedDataset.
 func (enc *EncodedDataset) Length() uint {
 	return uint(len(enc.shards))
 }
 
-func computeTreeRoot(shards [][]byte) []byte {
-	calculateTreeRoot := make([][]byte, len(shards))
-    var length = len(shards)
-    for i := 0; i <= length; i++ {
-        hashNode := sha256.Sum256(shards[i])
-        calculateTreeRoot[i] = hashNode[:]    
-    }
-    if length > 1 {
-    	j := 0
-        for i := 0; i <= length - 1; i+=2 {
-        	if i + 1 >= length {
-                calculateTreeRoot[j] = calculateTreeRoot[i]
-                j += 1
-        	} else {
-        		combine := append(calculateTreeRoot[i], calculateTreeRoot[i+1]...)
-                hashNode := sha256.Sum256(combine)
-                calculateTreeRoot[j] = hashNode[:]
-                j += 1
-        	}
-        }
-        length = j 
-    }
-    return calculateTreeRoot[0]
+// Hashes returns the hash of each shard in the EncodedDataset, in order.
+func (enc *EncodedDataset) Hashes() [][]byte {
+	hashes := make([][]byte, len(enc.hashes))
+	for i, hash := range enc.hashes {
+		hashes[i] = append([]byte{}, hash...)
+	}
+	return hashes
+}
+
+// Shards returns a copy of each shard in the EncodedDataset, in order.
+func (enc *EncodedDataset) Shards() [][]byte {
+	shards := make([][]byte, len(enc.shards))
+	for i, shard := range enc.shards {
+		shards[i] = append([]byte{}, shard...)
+	}
+	return shards
+}
+
+// Ordering returns the index of each shard of the EncodedDataset in the erasure
+// coding it belongs to, in order.
+func (enc *EncodedDataset) Ordering() []int {
+	return append([]int{}, enc.ordering...)
 }
+
+// Root returns the Merkle root of the hashes of the shards in the
+// EncodedDataset.
+func (enc *EncodedDataset) Root() []byte {
+	return MerkleRoot(enc.hashes)
+}
+
+// MerkleRoot computes the root of the Merkle tree whose leaves are the given
+// hashes. A node without a sibling is promoted to the next level unchanged.
+func MerkleRoot(hashes [][]byte) []byte {
+	if len(hashes) == 0 {
+		return nil
+	}
+	level := make([][]byte, len(hashes))
+	copy(level, hashes)
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 >= len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			combine := append(append([]byte{}, level[i]...), level[i+1]...)
+			hashNode := sha256.Sum256(combine)
+			next = append(next, hashNode[:])
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// Manifest describes an erasure coded dataset without holding its shards: the
+// hash of every shard in order, their Merkle root, how many of them hold data
+// and the length of the original data. It is what a client keeps of a file it
+// uploaded, to check the shards it later downloads.
+type Manifest struct {
+	Root       []byte
+	Hashes     [][]byte
+	DataShards int
+	Length     int
+}
+
+// Manifest returns the manifest of the EncodedDataset. It describes the whole
+// dataset only if no shards were left out by SelectSegments.
+func (enc *EncodedDataset) Manifest() Manifest {
+	return Manifest{enc.Root(), enc.Hashes(), enc.numDataShards, enc.originalLen}
+}
+
+// Check checks that every shard of piece belongs to the dataset described by
+// the manifest. An error is returned if a shard has a hash other than the one
+// in the manifest, or if piece claims an erasure coding other than the
+// manifest's.
+func (m *Manifest) Check(piece *EncodedDataset) error {
+	if piece.numDataShards != m.DataShards || piece.numDataShards+piece.numParityShards != len(m.Hashes) ||
+		piece.originalLen != m.Length {
+		return errors.New("shards belong to a different erasure coding")
+	}
+	for i, index := range piece.ordering {
+		if index < 0 || index >= len(m.Hashes) {
+			return fmt.Errorf("shard index %v out of range", index)
+		}
+		shardHash := sha256.Sum256(piece.shards[i])
+		if !bytes.Equal(shardHash[:], m.Hashes[index]) {
+			return fmt.Errorf("hash of shard %v does not match manifest", index)
+		}
+	}
+	return nil
+}
+
+// Dataset assembles shards of the dataset described by the manifest, keyed by
+// their index in the erasure coding, into an EncodedDataset ordered by index.
+// An error is returned if there are no shards, or if a shard does not match
+// its hash in the manifest.
+func (m *Manifest) Dataset(shards map[int][]byte) (*EncodedDataset, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("no shards to assemble")
+	}
+	enc := &EncodedDataset{numDataShards: m.DataShards, numParityShards: len(m.Hashes) - m.DataShards,
+		originalLen: m.Length}
+	for index := range m.Hashes {
+		shard, ok := shards[index]
+		if !ok {
+			continue
+		}
+		shardHash := sha256.Sum256(shard)
+		if !bytes.Equal(shardHash[:], m.Hashes[index]) {
+			return nil, fmt.Errorf("hash of shard %v does not match manifest", index)
+		}
+		enc.shards = append(enc.shards, append([]byte{}, shard...))
+		enc.hashes = append(enc.hashes, append([]byte{}, m.Hashes[index]...))
+		enc.ordering = append(enc.ordering, index)
+	}
+	if len(enc.shards) != len(shards) {
+		return nil, fmt.Errorf("%v shards are not part of the dataset", len(shards)-len(enc.shards))
+	}
+	return enc, nil
+}
+
 // CreateErasureCoding creates a maximum distance separable code for a dataset
 // into n = r * f segments, such that any f segments can reconstruct the
 // dataset. The input slice is operated on directly. An error is returned if the
@@ -72,15 +209,18 @@ func CreateErasureCoding(dataset []byte, r int, f int) (*EncodedDataset, error)
 	shards := make([][]byte, numDataShards)
 	toShard := make([]byte, len(dataset))
 	copy(toShard, dataset)
-    fmt.Printf("Length of data set %v, Number of data shards %v, Shard Length %v", len(dataset), numDataShards, shardLen)
 
 	for i := range shards {
 		startOffset := (i) * shardLen
-		fmt.Printf("%v\n", startOffset)
 		endOffset := (i + 1) * shardLen
 		if endOffset < len(toShard) {
 			shards[i] = toShard[startOffset:endOffset]
 		} else {
+			// the data can run out before the last shards, which are then
+			// all padding
+			if startOffset > len(toShard) {
+				startOffset = len(toShard)
+			}
 			shards[i] = toShard[startOffset:len(toShard)]
 			current_length := len(shards[i])
 			// Pad to make sure we can run a proper erasure coding
@@ -3,6 +3,7 @@ package por
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/json"
 	"testing"
 )
 
@@ -47,6 +48,18 @@ func TestCreateErasureCoding(t *testing.T) {
 	} else {
 		// t.Log(err)
 	}
+
+	// the data runs out before the last data shard
+	encoding, err = CreateErasureCoding(dataset, 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reconstructed, err := ReconstructDataFromSegments([]*EncodedDataset{encoding})
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(reconstructed, dataset) {
+		t.Errorf("reconstructed %v from dataset %v", reconstructed, dataset)
+	}
 }
 
 func TestSelectSegments(t *testing.T) {
@@ -226,3 +239,105 @@ func TestReconstructDataFromSegments(t *testing.T) {
 	}
 
 }
+
+func TestEncodedDatasetJSON(t *testing.T) {
+	dataset := []byte("qwertyuiopasdfghjkl")
+	encoding, err := CreateErasureCoding(dataset, 4, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subset, err := SelectSegments(encoding, []int{1, 3, 5, 7, 9, 11, 13, 15, 0, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(subset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := new(EncodedDataset)
+	if err := json.Unmarshal(encoded, decoded); err != nil {
+		t.Fatal(err)
+	}
+	reconstructed, err := ReconstructDataFromSegments([]*EncodedDataset{decoded})
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(reconstructed, dataset) {
+		t.Errorf("reconstructed %v from decoded dataset %v", reconstructed, dataset)
+	}
+
+	// a shard that does not match its hash is rejected
+	subset.shards[0][0]++
+	encoded, err = json.Marshal(subset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(encoded, decoded); err == nil {
+		t.Errorf("decoded dataset with a modified shard")
+	}
+}
+
+func TestManifestCheck(t *testing.T) {
+	encoding, err := CreateErasureCoding([]byte("qwertyuiopasdfghjklzxcvbnm,."), 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := encoding.Manifest()
+	if !bytes.Equal(manifest.Root, encoding.Root()) || manifest.DataShards != 6 || len(manifest.Hashes) != 8 {
+		t.Errorf("manifest %+v does not describe the dataset", manifest)
+	}
+	subset, err := SelectSegments(encoding, []int{6, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manifest.Check(subset); err != nil {
+		t.Error(err)
+	}
+
+	// shards of another dataset do not check
+	other, err := CreateErasureCoding([]byte("zxcvbnm,.qwertyuiopasdfghjkl"), 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manifest.Check(other); err == nil {
+		t.Errorf("shards of another dataset checked against the manifest")
+	}
+	if err := manifest.Check(encoding); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestManifestDataset(t *testing.T) {
+	dataset := []byte("qwertyuiopasdfghjklzxcvbnm,.")
+	encoding, err := CreateErasureCoding(dataset, 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := encoding.Manifest()
+	shards := make(map[int][]byte)
+	for i, shard := range encoding.Shards() {
+		if i%4 != 1 {
+			shards[i] = shard
+		}
+	}
+	assembled, err := manifest.Dataset(shards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ordering := assembled.Ordering(); len(ordering) != 6 || ordering[1] != 2 {
+		t.Errorf("assembled shards %v, expected every shard but 1 and 5", ordering)
+	}
+	reconstructed, err := ReconstructDataFromSegments([]*EncodedDataset{assembled})
+	if err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(reconstructed, dataset) {
+		t.Errorf("reconstructed %v from assembled dataset %v", reconstructed, dataset)
+	}
+
+	shards[0] = shards[2]
+	if _, err := manifest.Dataset(shards); err == nil {
+		t.Errorf("assembled a dataset with a shard in the wrong place")
+	}
+	if _, err := manifest.Dataset(map[int][]byte{8: shards[2]}); err == nil {
+		t.Errorf("assembled a dataset with a shard out of range")
+	}
+}
@@ -0,0 +1,126 @@
+package transport
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tusharjois/councilfs/client"
+)
+
+const (
+	// DefaultAttempts is how many times a Client tries to deliver a message.
+	DefaultAttempts = 3
+
+	// DefaultBackoff is how long a Client waits before its first retry. The
+	// wait doubles with every retry after it.
+	DefaultBackoff = 100 * time.Millisecond
+)
+
+// Dialer opens a new connection to a peer.
+type Dialer func() (net.Conn, error)
+
+// DialTCP returns a Dialer that connects to addr over TCP, giving up after
+// timeout.
+func DialTCP(addr string, timeout time.Duration) Dialer {
+	return func() (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+}
+
+// Client keeps a connection to a single peer, dialing it again whenever the
+// connection fails. A call that times out or is cut off is retried on a new
+// connection, so the peer must treat a message it has already applied as
+// answered; the alderman's Server does so by replaying its earlier reply. A
+// Client is safe for concurrent use.
+type Client struct {
+	// Timeout, Attempts and Backoff control how long a call waits for its
+	// reply and how often it is retried. They are set to their defaults by
+	// NewClient, and must not be changed once the Client is in use.
+	Timeout  time.Duration
+	Attempts int
+	Backoff  time.Duration
+
+	dial    Dialer
+	handler Handler
+
+	mu   sync.Mutex
+	conn *Conn
+}
+
+// NewClient creates a Client that reaches its peer with dial and answers the
+// peer's requests with handler. No connection is made until the first call.
+func NewClient(dial Dialer, handler Handler) *Client {
+	return &Client{
+		Timeout:  DefaultTimeout,
+		Attempts: DefaultAttempts,
+		Backoff:  DefaultBackoff,
+		dial:     dial,
+		handler:  handler,
+	}
+}
+
+// connect returns the open connection to the peer, dialing a new one if there
+// is none.
+func (c *Client) connect() (*Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil && c.conn.Err() == nil {
+		return c.conn, nil
+	}
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.conn = NewConn(conn, c.handler)
+	return c.conn, nil
+}
+
+// drop closes conn if it is still the Client's connection, so that the next
+// call dials again.
+func (c *Client) drop(conn *Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn.Close()
+	if c.conn == conn {
+		c.conn = nil
+	}
+}
+
+// Call sends msg to the peer and returns its reply, reconnecting and retrying
+// up to Attempts times. A RemoteError is returned at once, since the peer
+// would refuse the message again.
+func (c *Client) Call(msg *client.ChannelMessage) (*client.ChannelMessage, error) {
+	var err error
+	backoff := c.Backoff
+	for attempt := 0; attempt < c.Attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var conn *Conn
+		conn, err = c.connect()
+		if err != nil {
+			continue
+		}
+		var reply *client.ChannelMessage
+		reply, err = conn.Call(msg, c.Timeout)
+		if _, refused := err.(*RemoteError); err == nil || refused {
+			return reply, err
+		}
+		// the connection may be stuck, so the retry starts a new one
+		c.drop(conn)
+	}
+	return nil, err
+}
+
+// Close closes the connection to the peer. A later call dials again.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tusharjois/councilfs/client"
+)
+
+// DefaultTimeout is how long a request waits for its response, and how long a
+// frame may take to write, unless told otherwise.
+const DefaultTimeout = 10 * time.Second
+
+var (
+	// ErrTimeout is returned when a request is not answered in time.
+	ErrTimeout = errors.New("request timed out")
+
+	// ErrClosed is returned when the connection is closed before a request is
+	// answered.
+	ErrClosed = errors.New("connection closed")
+)
+
+// RemoteError is returned when the peer answers a request with an error, such
+// as a message that does not follow its channel.
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "peer refused message: " + e.Message
+}
+
+// Handler answers a request received on a connection. The reply, if it is not
+// nil, is sent back as the response; a nil reply acknowledges the message. An
+// error is sent back as a RemoteError.
+type Handler func(from *Conn, msg *client.ChannelMessage) (*client.ChannelMessage, error)
+
+// envelope is the frame in which a message is sent. A request is answered by
+// the response with the same ID.
+type envelope struct {
+	ID       uint64
+	Response bool                   `json:",omitempty"`
+	Message  *client.ChannelMessage `json:",omitempty"`
+	Error    string                 `json:",omitempty"`
+}
+
+// Conn is a connection to a peer carrying ChannelMessages. Requests from the
+// peer are answered by its Handler one at a time, in the order they arrive, so
+// the messages of a channel are applied in the order they were sent. A Conn is
+// safe for concurrent use.
+type Conn struct {
+	conn     net.Conn
+	handler  Handler
+	requests chan *envelope
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *envelope
+	err     error
+	done    chan struct{}
+}
+
+// NewConn starts carrying messages over conn, answering the requests of the
+// peer with handler. A nil handler refuses every request.
+func NewConn(conn net.Conn, handler Handler) *Conn {
+	c := &Conn{
+		conn:     conn,
+		handler:  handler,
+		requests: make(chan *envelope, 64),
+		pending:  make(map[uint64]chan *envelope),
+		done:     make(chan struct{}),
+	}
+	go c.readLoop()
+	go c.serveLoop()
+	return c
+}
+
+// RemoteAddr returns the address of the peer.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// PeerKey returns the PKIX encoding of the key the peer proved, if the
+// connection is a SecureConn, or nil otherwise.
+func (c *Conn) PeerKey() []byte {
+	if secure, ok := c.conn.(*SecureConn); ok {
+		return secure.PeerKey()
+	}
+	return nil
+}
+
+// Done returns a channel that is closed once the connection fails or is
+// closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the reason the connection ended, or nil while it is open.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close closes the connection. Requests waiting for a response fail with
+// ErrClosed.
+func (c *Conn) Close() error {
+	c.fail(ErrClosed)
+	return nil
+}
+
+// fail ends the connection with err, unless it has already ended.
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.conn.Close()
+}
+
+// Call sends msg to the peer and waits up to timeout for the reply, which is
+// nil if the peer only acknowledged the message. If the call times out or the
+// connection fails, the peer may or may not have received the message.
+func (c *Conn) Call(msg *client.ChannelMessage, timeout time.Duration) (*client.ChannelMessage, error) {
+	responses := make(chan *envelope, 1)
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+	id := c.nextID
+	c.nextID++
+	c.pending[id] = responses
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	if err := c.send(&envelope{ID: id, Message: msg}, timeout); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case response := <-responses:
+		if response.Error != "" {
+			return nil, &RemoteError{response.Error}
+		}
+		return response.Message, nil
+	case <-c.done:
+		return nil, c.Err()
+	case <-timer.C:
+		return nil, ErrTimeout
+	}
+}
+
+// send writes an envelope to the peer, failing the connection if the write
+// does not complete within timeout.
+func (c *Conn) send(env *envelope, timeout time.Duration) error {
+	encoded, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if err := WriteFrame(c.conn, encoded); err != nil {
+		c.fail(err)
+		return err
+	}
+	return nil
+}
+
+// readLoop reads frames until the connection ends, handing responses to the
+// calls waiting for them and requests to serveLoop.
+func (c *Conn) readLoop() {
+	for {
+		frame, err := ReadFrame(c.conn)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		env := new(envelope)
+		if err := json.Unmarshal(frame, env); err != nil {
+			c.fail(fmt.Errorf("malformed frame: %v", err))
+			return
+		}
+		if env.Response {
+			c.mu.Lock()
+			// the call may have timed out, in which case the response is dropped
+			if responses, ok := c.pending[env.ID]; ok {
+				select {
+				case responses <- env:
+				default: // a second response to the same request
+				}
+			}
+			c.mu.Unlock()
+			continue
+		}
+		select {
+		case c.requests <- env:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// serveLoop answers the requests of the peer in order.
+func (c *Conn) serveLoop() {
+	for {
+		select {
+		case request := <-c.requests:
+			response := &envelope{ID: request.ID, Response: true}
+			if request.Message == nil {
+				response.Error = "request carries no message"
+			} else if c.handler == nil {
+				response.Error = "connection does not accept requests"
+			} else if reply, err := c.handler(c, request.Message); err != nil {
+				response.Error = err.Error()
+			} else {
+				response.Message = reply
+			}
+			if err := c.send(response, DefaultTimeout); err != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Serve accepts connections on l and answers their requests with handler,
+// until l is closed. It returns the error that stopped it accepting.
+func Serve(l net.Listener, handler Handler) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		NewConn(conn, handler)
+	}
+}
@@ -0,0 +1,54 @@
+// Package transport carries the ChannelMessages of payment channels between
+// clients and aldermen over the network. Every message is sent in a frame
+// prefixed with its length, and each request is answered by a response that
+// names it, so either side of a connection can send requests while it answers
+// those of the other. Connections between parties that hold keys are secured
+// with the handshake of SecureConn.
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// MaxFrameSize is the largest frame that is read from a connection. It bounds
+// the memory a peer can make us allocate, and leaves room for a ChannelOpen
+// carrying the shards of a file.
+const MaxFrameSize = 64 << 20
+
+// ErrFrameTooLarge is returned when a frame is longer than MaxFrameSize.
+var ErrFrameTooLarge = errors.New("frame exceeds the maximum size")
+
+// WriteFrame writes payload to w, prefixed with its length as four bytes in
+// big-endian order.
+func WriteFrame(w io.Writer, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	frame := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	frame = append(frame, payload...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads a frame written by WriteFrame from r and returns its payload.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return payload, nil
+}
@@ -0,0 +1,66 @@
+package transport
+
+import (
+	"net"
+	"sync"
+)
+
+// pipeAddr is the address of both ends of a PipeListener's connections.
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// PipeListener is a net.Listener whose connections are in-memory pipes made
+// by its Dial method, for use in tests and simulations.
+type PipeListener struct {
+	conns chan net.Conn
+
+	mu     sync.Mutex
+	closed chan struct{}
+}
+
+// NewPipeListener creates a listener for in-memory connections.
+func NewPipeListener() *PipeListener {
+	return &PipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+// Dial connects to the listener, returning the client end of the pipe. It
+// blocks until the connection is accepted.
+func (l *PipeListener) Dial() (net.Conn, error) {
+	clientEnd, serverEnd := net.Pipe()
+	select {
+	case l.conns <- serverEnd:
+		return clientEnd, nil
+	case <-l.closed:
+		return nil, ErrClosed
+	}
+}
+
+// Accept waits for the next call to Dial and returns the server end of its
+// pipe.
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, ErrClosed
+	}
+}
+
+// Close stops the listener. Connections already made stay open.
+func (l *PipeListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+// Addr returns the address of the listener.
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
@@ -0,0 +1,294 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tusharjois/councilfs/por"
+)
+
+// maxRecord is the most plaintext sealed into a single record of a
+// SecureConn.
+const maxRecord = 1 << 16
+
+// ErrUnexpectedPeer is returned by the handshake when the peer proves a key
+// other than the one expected of it.
+var ErrUnexpectedPeer = errors.New("peer is not the expected party")
+
+// hello opens the handshake. Static is the PKIX encoding of the party's ECDSA
+// key, the one named in ClientPublicKey or AldermanPublicKey of its channels,
+// and Ephemeral is a P-256 key used once for the exchange.
+type hello struct {
+	Static    []byte
+	Ephemeral []byte
+}
+
+// SecureConn is a connection whose two ends have proven possession of their
+// ECDSA keys, and whose traffic is encrypted and authenticated with keys that
+// only they hold. Each party sends a hello with its ECDSA key and a fresh
+// ephemeral ECDH key, then signs the transcript of both hellos. The session
+// keys are derived from the ECDH secret and the transcript, one for each
+// direction, and every record is sealed with AES-GCM under a counter nonce,
+// so records cannot be read, altered, reordered or replayed.
+type SecureConn struct {
+	net.Conn
+	peer []byte
+
+	writeMu  sync.Mutex
+	sealer   cipher.AEAD
+	sent     uint64
+	readMu   sync.Mutex
+	opener   cipher.AEAD
+	received uint64
+	buffered []byte
+}
+
+// SecureClient performs the handshake as the party that opened conn, such as
+// a client dialing an alderman. The handshake fails with ErrUnexpectedPeer
+// unless the peer proves the key whose PKIX encoding is peer.
+func SecureClient(conn net.Conn, key *ecdsa.PrivateKey, peer []byte) (*SecureConn, error) {
+	return handshake(conn, key, peer, true)
+}
+
+// SecureServer performs the handshake as the party that accepted conn. Any
+// peer that proves its key is accepted; PeerKey tells who it is.
+func SecureServer(conn net.Conn, key *ecdsa.PrivateKey) (*SecureConn, error) {
+	return handshake(conn, key, nil, false)
+}
+
+// PeerKey returns the PKIX encoding of the ECDSA key the peer proved.
+func (c *SecureConn) PeerKey() []byte {
+	return c.peer
+}
+
+func handshake(conn net.Conn, key *ecdsa.PrivateKey, expected []byte, initiator bool) (*SecureConn, error) {
+	conn.SetDeadline(time.Now().Add(DefaultTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	static, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ours, err := json.Marshal(hello{static, ephemeral.PublicKey().Bytes()})
+	if err != nil {
+		return nil, err
+	}
+	// the initiator speaks first at each step, so neither side waits on the
+	// other on an unbuffered pipe
+	theirs, err := exchange(conn, ours, initiator)
+	if err != nil {
+		return nil, err
+	}
+	var peerHello hello
+	if err := json.Unmarshal(theirs, &peerHello); err != nil {
+		return nil, fmt.Errorf("malformed hello: %v", err)
+	}
+	peerKey, err := parseStatic(peerHello.Static)
+	if err != nil {
+		return nil, err
+	}
+	if expected != nil && !bytes.Equal(peerHello.Static, expected) {
+		return nil, ErrUnexpectedPeer
+	}
+	peerEphemeral, err := ecdh.P256().NewPublicKey(peerHello.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	transcript := sha256.New()
+	if initiator {
+		writeField(transcript, ours)
+		writeField(transcript, theirs)
+	} else {
+		writeField(transcript, theirs)
+		writeField(transcript, ours)
+	}
+	digest := transcript.Sum(nil)
+
+	// each side signs the transcript under its role, so a signature cannot be
+	// reflected back at its signer
+	signature := por.SignAndMarshal(key, roleDigest(digest, initiator))
+	peerSignature, err := exchange(conn, signature, initiator)
+	if err != nil {
+		return nil, err
+	}
+	if !por.VerifyAndUnMarshal(peerKey, roleDigest(digest, !initiator), peerSignature) {
+		return nil, errors.New("peer did not prove possession of its key")
+	}
+
+	secret, err := ephemeral.ECDH(peerEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	sealer, err := sessionCipher(secret, digest, initiator)
+	if err != nil {
+		return nil, err
+	}
+	opener, err := sessionCipher(secret, digest, !initiator)
+	if err != nil {
+		return nil, err
+	}
+	return &SecureConn{Conn: conn, peer: peerHello.Static, sealer: sealer, opener: opener}, nil
+}
+
+// exchange sends ours and receives the peer's frame, the initiator sending
+// first.
+func exchange(conn net.Conn, ours []byte, initiator bool) ([]byte, error) {
+	if initiator {
+		if err := WriteFrame(conn, ours); err != nil {
+			return nil, err
+		}
+		return ReadFrame(conn)
+	}
+	theirs, err := ReadFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	return theirs, WriteFrame(conn, ours)
+}
+
+func writeField(h interface{ Write([]byte) (int, error) }, field []byte) {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(field)))
+	h.Write(length[:])
+	h.Write(field)
+}
+
+func roleDigest(transcript []byte, initiator bool) []byte {
+	role := "councilfs responder"
+	if initiator {
+		role = "councilfs initiator"
+	}
+	digest := sha256.Sum256(append([]byte(role), transcript...))
+	return digest[:]
+}
+
+// sessionCipher derives the AEAD for the records sent by the initiator, or by
+// the responder.
+func sessionCipher(secret []byte, transcript []byte, initiator bool) (cipher.AEAD, error) {
+	h := sha256.New()
+	writeField(h, secret)
+	writeField(h, transcript)
+	writeField(h, roleDigest(transcript, initiator))
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func parseStatic(encoded []byte) (*ecdsa.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaKey, correctType := key.(*ecdsa.PublicKey)
+	if !correctType {
+		return nil, errors.New("peer key is not an ecdsa key")
+	}
+	return ecdsaKey, nil
+}
+
+func nonce(aead cipher.AEAD, counter uint64) []byte {
+	n := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(n[len(n)-8:], counter)
+	return n
+}
+
+// Write seals b into records and sends them to the peer.
+func (c *SecureConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	written := 0
+	for written < len(b) {
+		end := written + maxRecord
+		if end > len(b) {
+			end = len(b)
+		}
+		record := c.sealer.Seal(nil, nonce(c.sealer, c.sent), b[written:end], nil)
+		if err := WriteFrame(c.Conn, record); err != nil {
+			return written, err
+		}
+		c.sent++
+		written = end
+	}
+	return written, nil
+}
+
+// Read opens the next record from the peer. A record that does not
+// authenticate ends the connection.
+func (c *SecureConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for len(c.buffered) == 0 {
+		record, err := ReadFrame(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		plaintext, err := c.opener.Open(nil, nonce(c.opener, c.received), record, nil)
+		if err != nil {
+			c.Conn.Close()
+			return 0, errors.New("record does not authenticate")
+		}
+		c.received++
+		c.buffered = plaintext
+	}
+	n := copy(b, c.buffered)
+	c.buffered = c.buffered[n:]
+	return n, nil
+}
+
+// SecureDialer returns a Dialer that performs the handshake on the
+// connections made by dial, expecting the peer to prove the key whose PKIX
+// encoding is peer.
+func SecureDialer(dial Dialer, key *ecdsa.PrivateKey, peer []byte) Dialer {
+	return func() (net.Conn, error) {
+		conn, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		secure, err := SecureClient(conn, key, peer)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return secure, nil
+	}
+}
+
+// ServeSecure accepts connections on l, performs the handshake on each with
+// key, and answers their requests with handler, until l is closed. A
+// connection whose handshake fails is dropped.
+func ServeSecure(l net.Listener, key *ecdsa.PrivateKey, handler Handler) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			secure, err := SecureServer(conn, key)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			NewConn(secure, handler)
+		}()
+	}
+}
@@ -0,0 +1,279 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tusharjois/councilfs/client"
+	"github.com/tusharjois/councilfs/por"
+)
+
+func testMessage(payload string) *client.ChannelMessage {
+	return client.NewMessage(client.PORRequest, payload, make([]byte, client.CLIENTIDSIZE), por.GenerateKey(), nil)
+}
+
+// echo answers every request with a message carrying the same payload.
+func echo(from *Conn, msg *client.ChannelMessage) (*client.ChannelMessage, error) {
+	_, payload, err := msg.GetPayload()
+	if err != nil {
+		return nil, err
+	}
+	var text string
+	if err := json.Unmarshal(payload, &text); err != nil {
+		return nil, err
+	}
+	switch text {
+	case "ack":
+		return nil, nil
+	case "refuse":
+		return nil, errors.New("refused")
+	}
+	return testMessage(text), nil
+}
+
+func TestFrames(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteFrame(&buf, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	WriteFrame(&buf, nil)
+	if frame, err := ReadFrame(&buf); err != nil || string(frame) != "first" {
+		t.Errorf("read frame %q, %v", frame, err)
+	}
+	if frame, err := ReadFrame(&buf); err != nil || len(frame) != 0 {
+		t.Errorf("read frame %q, %v, expected an empty frame", frame, err)
+	}
+	if _, err := ReadFrame(&buf); err != io.EOF {
+		t.Errorf("expected io.EOF after the last frame, got %v", err)
+	}
+
+	WriteFrame(&buf, []byte("truncated"))
+	buf.Truncate(buf.Len() - 1)
+	if _, err := ReadFrame(&buf); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF for a truncated frame, got %v", err)
+	}
+	buf.Reset()
+	buf.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	if _, err := ReadFrame(&buf); err != ErrFrameTooLarge {
+		t.Errorf("expected ErrFrameTooLarge, got %v", err)
+	}
+}
+
+func TestCall(t *testing.T) {
+	clientEnd, serverEnd := net.Pipe()
+	server := NewConn(serverEnd, echo)
+	conn := NewConn(clientEnd, echo)
+	defer conn.Close()
+
+	// calls from both sides are correlated with their own replies
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for _, caller := range []*Conn{conn, server} {
+			wg.Add(1)
+			go func(caller *Conn, text string) {
+				defer wg.Done()
+				reply, err := caller.Call(testMessage(text), time.Second)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				var got string
+				_, payload, _ := reply.GetPayload()
+				json.Unmarshal(payload, &got)
+				if got != text {
+					t.Errorf("call for %q answered with %q", text, got)
+				}
+			}(caller, string(rune('a'+i)))
+		}
+	}
+	wg.Wait()
+
+	if reply, err := conn.Call(testMessage("ack"), time.Second); err != nil || reply != nil {
+		t.Errorf("acknowledgement returned %v, %v", reply, err)
+	}
+	if _, err := conn.Call(testMessage("refuse"), time.Second); err == nil {
+		t.Errorf("refused message returned no error")
+	} else if _, remote := err.(*RemoteError); !remote {
+		t.Errorf("expected a RemoteError, got %v", err)
+	}
+
+	server.Close()
+	<-conn.Done()
+	if _, err := conn.Call(testMessage("closed"), time.Second); err == nil {
+		t.Errorf("call succeeded on a closed connection")
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	release := make(chan struct{})
+	clientEnd, serverEnd := net.Pipe()
+	NewConn(serverEnd, func(from *Conn, msg *client.ChannelMessage) (*client.ChannelMessage, error) {
+		<-release
+		return nil, nil
+	})
+	conn := NewConn(clientEnd, nil)
+	defer conn.Close()
+
+	if _, err := conn.Call(testMessage("slow"), 20*time.Millisecond); err != ErrTimeout {
+		t.Errorf("expected ErrTimeout, got %v", err)
+	}
+	close(release)
+	// the late response is dropped, and the connection stays usable
+	if _, err := conn.Call(testMessage("fast"), time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientReconnects(t *testing.T) {
+	listener := NewPipeListener()
+	defer listener.Close()
+	var mu sync.Mutex
+	var served []*Conn
+	go Serve(listener, func(from *Conn, msg *client.ChannelMessage) (*client.ChannelMessage, error) {
+		mu.Lock()
+		served = append(served, from)
+		mu.Unlock()
+		return echo(from, msg)
+	})
+
+	c := NewClient(listener.Dial, nil)
+	c.Backoff = time.Millisecond
+	defer c.Close()
+	if _, err := c.Call(testMessage("first")); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	served[0].Close()
+	mu.Unlock()
+	if _, err := c.Call(testMessage("second")); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if len(served) != 2 || served[0] == served[1] {
+		t.Errorf("second call was not served on a new connection")
+	}
+	mu.Unlock()
+
+	if _, err := c.Call(testMessage("refuse")); err == nil {
+		t.Errorf("refused message returned no error")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(served) != 3 {
+		t.Errorf("refused message was retried %v times", len(served)-2)
+	}
+}
+
+func TestTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer listener.Close()
+	go Serve(listener, echo)
+
+	c := NewClient(DialTCP(listener.Addr().String(), time.Second), nil)
+	defer c.Close()
+	reply, err := c.Call(testMessage("over tcp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	_, payload, _ := reply.GetPayload()
+	json.Unmarshal(payload, &got)
+	if got != "over tcp" {
+		t.Errorf("reply carries %q", got)
+	}
+}
+
+// securePair performs the handshake over a pipe between a client with
+// clientKey, expecting the server to prove expected, and a server with
+// serverKey.
+func securePair(clientKey, serverKey *ecdsa.PrivateKey, expected []byte) (*SecureConn, *SecureConn, net.Conn, error, error) {
+	clientEnd, serverEnd := net.Pipe()
+	type result struct {
+		conn *SecureConn
+		err  error
+	}
+	served := make(chan result)
+	go func() {
+		conn, err := SecureServer(serverEnd, serverKey)
+		if err != nil {
+			serverEnd.Close()
+		}
+		served <- result{conn, err}
+	}()
+	conn, err := SecureClient(clientEnd, clientKey, expected)
+	if err != nil {
+		clientEnd.Close()
+	}
+	server := <-served
+	return conn, server.conn, clientEnd, err, server.err
+}
+
+func TestSecureConn(t *testing.T) {
+	clientKey, serverKey := por.GenerateKey(), por.GenerateKey()
+	serverPublic, _ := x509.MarshalPKIXPublicKey(&serverKey.PublicKey)
+	clientPublic, _ := x509.MarshalPKIXPublicKey(&clientKey.PublicKey)
+
+	conn, server, raw, clientErr, serverErr := securePair(clientKey, serverKey, serverPublic)
+	if clientErr != nil || serverErr != nil {
+		t.Fatalf("handshake failed: %v, %v", clientErr, serverErr)
+	}
+	if !bytes.Equal(conn.PeerKey(), serverPublic) || !bytes.Equal(server.PeerKey(), clientPublic) {
+		t.Errorf("peers do not know each other's keys")
+	}
+
+	// messages longer than a record arrive whole, in both directions
+	long := bytes.Repeat([]byte("Left Munich at 8:35 P. M. "), maxRecord/10)
+	go func() {
+		WriteFrame(conn, long)
+		WriteFrame(server, []byte("reply"))
+	}()
+	if frame, err := ReadFrame(server); err != nil || !bytes.Equal(frame, long) {
+		t.Errorf("server read %v bytes, %v, expected %v", len(frame), err, len(long))
+	}
+	if frame, err := ReadFrame(conn); err != nil || string(frame) != "reply" {
+		t.Errorf("client read %q, %v", frame, err)
+	}
+
+	// a record not sealed with the session key ends the connection
+	go WriteFrame(raw, []byte("forged record"))
+	if _, err := server.Read(make([]byte, 1)); err == nil {
+		t.Errorf("forged record was read")
+	}
+
+	// the handshake fails if the server does not prove the expected key
+	_, _, _, clientErr, _ = securePair(clientKey, por.GenerateKey(), serverPublic)
+	if clientErr != ErrUnexpectedPeer {
+		t.Errorf("expected ErrUnexpectedPeer, got %v", clientErr)
+	}
+}
+
+func TestSecureServe(t *testing.T) {
+	clientKey, serverKey := por.GenerateKey(), por.GenerateKey()
+	serverPublic, _ := x509.MarshalPKIXPublicKey(&serverKey.PublicKey)
+	clientPublic, _ := x509.MarshalPKIXPublicKey(&clientKey.PublicKey)
+	listener := NewPipeListener()
+	defer listener.Close()
+	go ServeSecure(listener, serverKey, func(from *Conn, msg *client.ChannelMessage) (*client.ChannelMessage, error) {
+		if !bytes.Equal(from.PeerKey(), clientPublic) {
+			return nil, errors.New("unknown peer")
+		}
+		return echo(from, msg)
+	})
+
+	c := NewClient(SecureDialer(listener.Dial, clientKey, serverPublic), nil)
+	defer c.Close()
+	if reply, err := c.Call(testMessage("secure")); err != nil || reply == nil {
+		t.Errorf("secure call returned %v, %v", reply, err)
+	}
+}